@@ -57,6 +57,8 @@
 package bloom
 
 import (
+	"encoding/binary"
+	"errors"
 	"math"
 )
 
@@ -144,6 +146,66 @@ func (f *Filter) Count() int64 {
 	return f.count
 }
 
+// encodingVersion is the first byte of a filter encoded by MarshalBinary.
+const encodingVersion = 1
+
+// ErrInvalidEncoding is returned by UnmarshalBinary if the data was not
+// produced by MarshalBinary.
+var ErrInvalidEncoding = errors.New("bloom: invalid encoding")
+
+// MarshalBinary encodes the filter so it can be stored and later restored
+// by UnmarshalBinary. The encoding is the same on all machines.
+func (f *Filter) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 1+3*binary.MaxVarintLen64, 1+3*binary.MaxVarintLen64+8*len(f.data))
+	buf[0] = encodingVersion
+	n := 1
+	n += binary.PutUvarint(buf[n:], uint64(f.lookups))
+	n += binary.PutVarint(buf[n:], f.count)
+	n += binary.PutUvarint(buf[n:], uint64(len(f.data)))
+	buf = buf[:n]
+	var word [8]byte
+	for _, w := range f.data {
+		binary.LittleEndian.PutUint64(word[:], w)
+		buf = append(buf, word[:]...)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary replaces the contents of the filter with one encoded by
+// MarshalBinary.
+func (f *Filter) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 || data[0] != encodingVersion {
+		return ErrInvalidEncoding
+	}
+	data = data[1:]
+	lookups, n := binary.Uvarint(data)
+	if n <= 0 || lookups == 0 || lookups > 64 {
+		return ErrInvalidEncoding
+	}
+	data = data[n:]
+	count, n := binary.Varint(data)
+	if n <= 0 || count < 0 {
+		return ErrInvalidEncoding
+	}
+	data = data[n:]
+	words, n := binary.Uvarint(data)
+	// The length of the bit array must be a power of 2. Check the count
+	// of words before multiplying so a huge count cannot overflow.
+	if n <= 0 || words == 0 || words&(words-1) != 0 || words > uint64(len(data)-n)/8 ||
+		uint64(len(data)-n) != 8*words {
+		return ErrInvalidEncoding
+	}
+	data = data[n:]
+
+	f.data = make([]uint64, words)
+	for i := range f.data {
+		f.data[i] = binary.LittleEndian.Uint64(data[8*i:])
+	}
+	f.lookups = int(lookups)
+	f.count = count
+	return nil
+}
+
 // Union returns a new Bloom filter that consists of all elements
 // that belong to either f1 or f2. The two filters must be of
 // the same size n and have the same false-positives rate p.
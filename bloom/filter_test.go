@@ -1,6 +1,7 @@
 package bloom
 
 import (
+	"encoding/binary"
 	"testing"
 )
 
@@ -190,3 +191,43 @@ func BenchmarkUnion(b *testing.B) {
 		_ = f1.Union(f2)
 	}
 }
+
+func TestMarshal(t *testing.T) {
+	f1 := New(100, 200)
+	for i := 0; i < 100; i++ {
+		f1.Add(string(rune('a' + i)))
+	}
+	data, err := f1.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f2 := &Filter{}
+	if err = f2.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if f2.Count() != f1.Count() || f2.lookups != f1.lookups || len(f2.data) != len(f1.data) {
+		t.Errorf("UnmarshalBinary() = %v; want %v\n", f2, f1)
+	}
+	for i := 0; i < 100; i++ {
+		if s := string(rune('a' + i)); !f2.Test(s) {
+			t.Errorf("Test(%q) = false; want true\n", s)
+		}
+	}
+
+	if err = f2.UnmarshalBinary(data[:len(data)-1]); err != ErrInvalidEncoding {
+		t.Errorf("UnmarshalBinary(truncated) = %v; want ErrInvalidEncoding\n", err)
+	}
+	data[0] = 99
+	if err = f2.UnmarshalBinary(data); err != ErrInvalidEncoding {
+		t.Errorf("UnmarshalBinary(version 99) = %v; want ErrInvalidEncoding\n", err)
+	}
+
+	// A word count so large that its size in bytes overflows to zero
+	huge := make([]byte, 3+binary.MaxVarintLen64)
+	huge[0], huge[1], huge[2] = encodingVersion, 1, 0
+	huge = huge[:3+binary.PutUvarint(huge[3:], 1<<61)]
+	if err = f2.UnmarshalBinary(huge); err != ErrInvalidEncoding {
+		t.Errorf("UnmarshalBinary(huge word count) = %v; want ErrInvalidEncoding\n", err)
+	}
+}
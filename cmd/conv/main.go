@@ -1,7 +1,10 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"github.com/justinethier/keyva/lsm/sst"
+	"log"
 	"os"
 	"strings"
 )
@@ -9,15 +12,32 @@ import (
 func main() {
 	//util.OpenSyslog()
 
-	// TODO: need args to:
-	//
-	// print index
-	// print bin
-	// usage
-	filename := os.Args[1]
-	if strings.HasSuffix(filename, ".index") {
-		sst.DumpIndex(filename)
+	repair := flag.Bool("repair", false, "rewrite the file without any corrupt data blocks")
+	index := flag.Bool("index", false, "print the header and index instead of the entries")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: conv [-index | -repair] filename")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	filename := flag.Arg(0)
+	var err error
+	if *repair {
+		var dropped int
+		dropped, err = sst.Repair(filename)
+		if err == nil {
+			log.Println("Repaired", filename, "dropped", dropped, "corrupt blocks")
+		}
+	} else if *index || strings.HasSuffix(filename, ".index") {
+		err = sst.DumpIndex(os.Stdout, filename)
 	} else {
-		sst.DumpBin(filename)
+		err = sst.DumpBin(os.Stdout, filename)
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
 }
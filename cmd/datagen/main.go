@@ -4,7 +4,7 @@ import (
 	//"bytes"
 	"fmt"
 	//"io/ioutil"
-	//"log"
+	"log"
 	//"net/http"
 	"github.com/justinethier/keyva/lsm"
 	"github.com/justinethier/keyva/util"
@@ -17,10 +17,15 @@ import (
 
 func main() {
 	util.OpenSyslog()
-	tbl := lsm.New("data", 1024)
+	tbl, err := lsm.New("data", 1024)
+	if err != nil {
+		log.Fatal(err)
+	}
 	// May need to merge separately; data will fill faster than merge job can keep up
 	tbl.SetMergeSettings(lsm.MergeSettings{Immediate: true, MaxLevels: 10, NumberOfSstFiles: 10})
-	tbl.ResetDB()
+	if err := tbl.ResetDB(); err != nil {
+		log.Fatal(err)
+	}
 
 	for i := 0; i < 1000*150; i++ {
 		//TODO: merge every N? Try to do multiple levels here?
@@ -30,9 +35,15 @@ func main() {
 		key := fmt.Sprintf("%d", i) //rand.Intn(100))
 		doc := fmt.Sprintf("%d", i) //time.Now().UnixNano())
 		//set(key, "text/plain", []byte(doc))
-		tbl.Set(key, []byte(doc))
+		if err := tbl.Set(key, []byte(doc)); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	// Explicitly merge out of level 0 after creating data.
 	//lsm.Merge(0)
+
+	if err := tbl.Close(); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -13,7 +14,7 @@ import (
 	"github.com/justinethier/keyva/lsm"
 )
 
-var db = lsm.New("data", 5)
+var db *lsm.LsmTree
 
 func printRepl() {
 	fmt.Print("keyva> ")
@@ -42,6 +43,8 @@ func printInvalidCmd(text string, reader *bufio.Reader) {
 	} else if len(t) > 6 && t[:6] == "merge " {
 		level := t[6:]
 		dbMerge(level)
+	} else if len(t) > 8 && t[:8] == "compact " {
+		dbCompactRange(t[8:])
 	} else if t != "" {
 		fmt.Println("Unknown command", t)
 	}
@@ -67,6 +70,7 @@ func help() {
 	fmt.Println("set    - Set value of the given key")
 	fmt.Println("del    - Delete value of the given key")
 	fmt.Println("merge  - Merge data in level l of the DB")
+	fmt.Println("compact - Compact keys from start to end through all levels")
 	fmt.Println("help   - Display usage information")
 	fmt.Println("cls    - Clear the terminal screen ")
 	fmt.Println("time   - Prints current date / time ")
@@ -85,22 +89,28 @@ func now() {
 }
 
 func dbGet(key string) {
-	val, found := db.Get(key)
-	if found {
+	val, err := db.Get(key)
+	if err == nil {
 		fmt.Println(string(val))
-	} else {
+	} else if errors.Is(err, lsm.ErrNotFound) {
 		fmt.Println("Key not found")
+	} else {
+		fmt.Println("Error: ", err)
 	}
 }
 
 func dbSet(key string, reader *bufio.Reader) {
 	fmt.Println("Value to set: ")
 	value := get(reader)
-	db.Set(key, []byte(value))
+	if err := db.Set(key, []byte(value)); err != nil {
+		fmt.Println("Error: ", err)
+	}
 }
 
 func dbDelete(key string) {
-	db.Delete(key)
+	if err := db.Delete(key); err != nil {
+		fmt.Println("Error: ", err)
+	}
 }
 
 func dbMerge(level string) {
@@ -109,10 +119,29 @@ func dbMerge(level string) {
 		fmt.Println("Error: ", err)
 		return
 	}
-	db.Merge(l)
+	if err := db.Merge(l); err != nil {
+		fmt.Println("Error: ", err)
+	}
+}
+
+func dbCompactRange(args string) {
+	keys := strings.Fields(args)
+	if len(keys) != 2 {
+		fmt.Println("Usage: compact <start> <end>")
+		return
+	}
+	if err := db.CompactRange(keys[0], keys[1]); err != nil {
+		fmt.Println("Error: ", err)
+	}
 }
 
 func main() {
+	var err error
+	db, err = lsm.New("data", 5)
+	if err != nil {
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
 	db.SetMergeSettings(lsm.MergeSettings{MaxLevels: 5, NumberOfSstFiles: 2, Interval: 120 * time.Second})
 	commands := map[string]interface{}{
 		"help": help,
@@ -131,6 +160,9 @@ func main() {
 		}
 		printRepl()
 	}
+	if err := db.Close(); err != nil {
+		fmt.Println("Error: ", err)
+	}
 	fmt.Println("Bye!")
 
 }
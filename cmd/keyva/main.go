@@ -1,7 +1,6 @@
 // TODO: some interesting ideas from:
 //
 // https://dgraph.io/docs/badger/get-started/
-// - allow specifying a duration for a key, so it will be GC'd after time is up
 // - some form of persistence would be nice, so store can be restored if the service is restarted
 //   - ultimately this also ties in to having a more efficient backing store other than maps
 //   - Consider using LSM, see: https://learndb.net/key-value-store/filesystem/
@@ -15,13 +14,16 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/justinethier/keyva/lsm"
 	"github.com/justinethier/keyva/util"
 	"log"
 	"net/http"
 	"os"
-	//"sort"
+	"os/signal"
+	"syscall"
 )
 
 func ArgServer(w http.ResponseWriter, req *http.Request) {
@@ -31,8 +33,10 @@ func ArgServer(w http.ResponseWriter, req *http.Request) {
 func main() {
 	util.OpenSyslog()
 	mux := http.NewServeMux()
-	m := lsm.New("data", 5000) // TODO: optionally, make these parameters configurable
-	// TODO: use a larger default (5000?). This is small for testing purposes
+	m, err := lsm.Open("data", lsm.Options{}) // TODO: optionally, make the options configurable
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Background on http handlers -
 	// https://stackoverflow.com/questions/6564558/wildcards-in-the-pattern-for-http-handlefunc
@@ -42,40 +46,94 @@ func main() {
 	//	m.CacheGC()
 	//	fmt.Fprintln(w, "Cleared old entries from cache")
 	//})
-	//  mux.HandleFunc("/api/stats", func(w http.ResponseWriter, req *http.Request) {
-	//    (*m).Lock.RLock()
-	//    fmt.Fprintln(w, "Number of key/value pairs = ", len(m.Data))
-	//    fmt.Fprintln(w, "Keys:")
-	//    keys := make([]string, len(m.Data))
-	//    i := 0
-	//    for k := range m.Data {
-	//      keys[i] = k
-	//      i++
-	//      //fmt.Fprintln(w, k)
-	//    }
-	//    sort.Strings(keys)
-	//    for _, k := range keys {
-	//      fmt.Fprintln(w, k)
-	//    }
-	//    (*m).Lock.RUnlock()
-	//  })
+	mux.HandleFunc("/api/stats", func(w http.ResponseWriter, req *http.Request) {
+		stats, err := m.Stats()
+		if err != nil {
+			log.Println("Error reading stats", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		stats, err := m.Stats()
+		if err != nil {
+			log.Println("Error reading stats", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		stats.WritePrometheus(w)
+	})
 	// mux.Handle("/seq/", s)
 	mux.HandleFunc("/seq/", func(w http.ResponseWriter, req *http.Request) {
 		switch req.Method {
 		case "GET":
-			result := m.Increment(req.URL.Path)
+			result, err := m.Increment(req.URL.Path)
+			if err != nil {
+				log.Println("Error incrementing sequence", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
 			fmt.Fprintln(w, result)
 		case "DELETE":
-			m.Delete(req.URL.Path)
+			if err := m.Delete(req.URL.Path); err != nil {
+				log.Println("Error deleting sequence", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
 			fmt.Fprintln(w, "Deleted sequence")
 		}
 	})
 	mux.Handle("/kv/", m)
 
+	// Admin endpoints
+	mux.HandleFunc("/admin/compact", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		// Keys are stored under their full path, EG: /kv/key
+		start, end := req.FormValue("start"), req.FormValue("end")
+		if start == "" || end == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "Parameters start and end are required")
+			return
+		}
+		if err := m.CompactRange(start, end); err != nil {
+			log.Println("Error compacting range", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "Compacted range")
+	})
+
 	// TODO: allow optionally running an HTTPS server based on command-line flag(s):
 	// https://medium.com/rungo/secure-https-servers-in-go-a783008b36da
 	//
 	// TODO: longer-term ties into potentially having authentication and user-based logins / permissions
 
-	log.Fatal(http.ListenAndServe(":8080", mux))
+	srv := &http.Server{Addr: ":8080", Handler: mux}
+
+	// Shut down cleanly so buffered writes are not lost
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Println("Shutting down")
+		if err := srv.Shutdown(context.Background()); err != nil {
+			log.Println("Error stopping HTTP server", err)
+		}
+		if err := m.Close(); err != nil {
+			log.Println("Error closing database", err)
+		}
+		close(done)
+	}()
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
 }
@@ -0,0 +1,125 @@
+package lsm
+
+import (
+	"github.com/justinethier/keyva/lsm/sst"
+	"github.com/justinethier/keyva/lsm/wal"
+	"time"
+)
+
+// WriteBatch holds a group of updates that are applied to the tree
+// atomically. Either every update in the batch is visible or none of them
+// are, including after a crash.
+type WriteBatch struct {
+	entries []sst.SstEntry
+}
+
+// Put adds an update to the batch that sets the value of the given key.
+func (b *WriteBatch) Put(k string, value []byte) {
+	b.entries = append(b.entries, sst.SstEntry{Key: k, Value: value})
+}
+
+// PutWithTTL adds an update to the batch that sets the value of the given
+// key. The key expires once ttl has passed, after which it is treated as if
+// it had been deleted.
+func (b *WriteBatch) PutWithTTL(k string, value []byte, ttl time.Duration) {
+	expires := time.Now().Add(ttl).UnixNano()
+	b.entries = append(b.entries, sst.SstEntry{Key: k, Value: value, Expires: expires})
+}
+
+// Delete adds an update to the batch that removes the given key.
+func (b *WriteBatch) Delete(k string) {
+	b.entries = append(b.entries, sst.SstEntry{Key: k, Deleted: true})
+}
+
+// Clear removes all updates from the batch so it may be reused.
+func (b *WriteBatch) Clear() {
+	b.entries = b.entries[:0]
+}
+
+// Len returns the number of updates in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
+
+// writeRequest is sent to walJob to log and apply a batch.
+type writeRequest struct {
+	batch *WriteBatch
+	// prepare is an optional function called with tree.lock held before the
+	// batch is logged, EG: to add updates based on the latest data. If it
+	// returns an error the batch is not applied. It may wait on
+	// tree.flushCond, which releases the lock.
+	prepare func(b *WriteBatch) error
+	// Sync the Wal after the batch is applied, regardless of the sync mode
+	sync bool
+	err  error
+	done chan struct{}
+}
+
+// Write applies all of the updates in the batch to the tree atomically.
+// Updates are applied in order, so if a key is updated more than once the
+// last update wins.
+func (tree *LsmTree) Write(b *WriteBatch) error {
+	return tree.write(b, nil)
+}
+
+// write hands the batch to walJob and waits until it has been applied, and
+// synced to disk if required by the sync mode.
+func (tree *LsmTree) write(b *WriteBatch, prepare func(b *WriteBatch) error) error {
+	tree.closeLock.RLock()
+	defer tree.closeLock.RUnlock()
+	if tree.isClosed() {
+		return ErrClosed
+	}
+
+	req := writeRequest{batch: b, prepare: prepare, done: make(chan struct{})}
+	tree.walChan <- &req
+	<-req.done
+	return req.err
+}
+
+// applyBatch assigns sequence numbers to the entries in a batch, logs them
+// to the Wal as a single record and adds them to the memtable. This is only
+// ever called from walJob, so batches are applied one at a time.
+func (tree *LsmTree) applyBatch(req *writeRequest) {
+	tree.lock.Lock()
+	req.err = tree.makeRoomForWrite()
+	if req.err == nil && req.prepare != nil {
+		req.err = req.prepare(req.batch)
+	}
+	tree.lock.Unlock()
+	if req.err != nil {
+		return
+	}
+
+	entries := req.batch.entries
+	if len(entries) == 0 {
+		return
+	}
+
+	// Sequence numbers are not visible to readers until the whole batch
+	// has been added to the memtable
+	seq := tree.seq
+	records := make([]wal.Entry, len(entries))
+	for i := range entries {
+		seq++
+		if entries[i].Deleted {
+			entries[i].Value = nil
+			entries[i].Expires = 0
+		}
+		entries[i].Seq = seq
+		records[i] = wal.Entry{Id: seq, Key: entries[i].Key, Value: entries[i].Value,
+			Deleted: entries[i].Deleted, Expires: entries[i].Expires}
+	}
+	req.err = tree.wal.AppendBatch(records)
+	if req.err != nil {
+		return
+	}
+
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	for _, e := range entries {
+		tree.memtbl.set(e)
+		tree.filter.Add(e.Key)
+	}
+	tree.seq = seq
+}
@@ -0,0 +1,96 @@
+package lsm
+
+import (
+	"github.com/justinethier/keyva/lsm/wal"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tbl = newTree(t, dir, 25)
+	defer tbl.Close()
+	tbl.Set("c", []byte("old"))
+
+	var batch WriteBatch
+	batch.Put("a", []byte("1"))
+	batch.Put("b", []byte("2"))
+	batch.Delete("c")
+	batch.Put("b", []byte("3"))
+	if batch.Len() != 4 {
+		t.Error("Unexpected batch length", batch.Len())
+	}
+	tbl.Write(&batch)
+
+	if val, err := tbl.Get("a"); err != nil || string(val) != "1" {
+		t.Error("Unexpected value", string(val), "for key a")
+	}
+	if val, err := tbl.Get("b"); err != nil || string(val) != "3" {
+		t.Error("Unexpected value", string(val), "for key b")
+	}
+	if _, err := tbl.Get("c"); err != ErrNotFound {
+		t.Error("Found deleted key c")
+	}
+
+	// Reuse the batch
+	batch.Clear()
+	batch.Put("c", []byte("new"))
+	tbl.Write(&batch)
+	if val, err := tbl.Get("c"); err != nil || string(val) != "new" {
+		t.Error("Unexpected value", string(val), "for key c")
+	}
+}
+
+// Test that only complete batches are loaded from the WAL
+func TestWriteBatchRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, _, err := wal.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.AppendBatch([]wal.Entry{
+		{Id: 1, Key: "a", Value: []byte("1")},
+		{Id: 2, Key: "b", Value: []byte("2")},
+	})
+	w.Close()
+
+	// Simulate a crash partway through writing the next batch
+	f, err := os.OpenFile(dir+"/write-ahead-log-0000.log", os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Record header for a 100 byte payload, but only part of it is written
+	f.Write([]byte{0x12, 0x34, 0x56, 0x78, 100, 0, 0, 0, 2, 0, 0, 0, 3, 0})
+	f.Close()
+
+	var tbl = newTree(t, dir, 25)
+	if val, err := tbl.Get("a"); err != nil || string(val) != "1" {
+		t.Error("Unexpected value", string(val), "for key a")
+	}
+	if val, err := tbl.Get("b"); err != nil || string(val) != "2" {
+		t.Error("Unexpected value", string(val), "for key b")
+	}
+	if _, err := tbl.Get("c"); err != ErrNotFound {
+		t.Error("Found key c from an incomplete batch")
+	}
+
+	// New writes are recovered after the incomplete batch is discarded
+	tbl.Set("e", []byte("5"))
+	tbl.Close()
+	tbl = newTree(t, dir, 25)
+	defer tbl.Close()
+	if val, err := tbl.Get("e"); err != nil || string(val) != "5" {
+		t.Error("Unexpected value", string(val), "for key e")
+	}
+}
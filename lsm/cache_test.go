@@ -0,0 +1,56 @@
+package lsm
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestBlockCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tbl = newTree(t, dir, 100)
+	defer tbl.Close()
+	for i := 0; i < 100; i++ {
+		tbl.Set(strconv.Itoa(i), []byte(strconv.Itoa(i)))
+	}
+	if err := tbl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads that opt out of the cache do not fill it
+	if _, err := tbl.GetWithOptions("1", ReadOptions{NoCache: true}); err != nil {
+		t.Fatal(err)
+	}
+	it, err := tbl.NewIteratorWithOptions(ReadOptions{NoCache: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for it.First(); it.Valid(); it.Next() {
+	}
+	it.Close()
+	if stats := tbl.BlockCacheStats(); stats.Blocks != 0 || stats.Misses == 0 {
+		t.Error("Unexpected cache stats", stats)
+	}
+
+	// The second read of a block is served from the cache
+	tbl.Get("1")
+	tbl.Get("1")
+	stats := tbl.BlockCacheStats()
+	if stats.Blocks != 1 || stats.Hits != 1 || stats.Size == 0 {
+		t.Error("Unexpected cache stats", stats)
+	}
+
+	tbl.SetBlockCacheCapacity(0)
+	if stats := tbl.BlockCacheStats(); stats.Blocks != 0 || stats.Capacity != 0 {
+		t.Error("Unexpected cache stats", stats)
+	}
+	if val, err := tbl.Get("50"); err != nil || string(val) != "50" {
+		t.Error("Unexpected value", string(val), err, "for key 50")
+	}
+}
@@ -0,0 +1,80 @@
+package lsm
+
+import (
+	"sync/atomic"
+)
+
+// SetFlushOnClose determines whether Close writes the contents of the
+// memtable to a new SST file. Otherwise those entries are recovered from
+// the Wal the next time the tree is opened.
+func (tree *LsmTree) SetFlushOnClose(flush bool) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	tree.flushOnClose = flush
+}
+
+// Flush writes the contents of the memtable to a new SST file, even if the
+// memtable is not yet full, and waits until all data in memory is on disk.
+func (tree *LsmTree) Flush() error {
+	var batch WriteBatch
+	return tree.write(&batch, func(b *WriteBatch) error {
+		if err := tree.rotateMemtable(); err != nil {
+			return err
+		}
+		return tree.waitForFlush()
+	})
+}
+
+// Close waits for any writes in progress to finish, stops the background
+// jobs and syncs and closes the Wal. Any memtables that are already full
+// are written to SST first. Any further use of the tree returns ErrClosed.
+func (tree *LsmTree) Close() error {
+	tree.closeLock.Lock()
+	if tree.isClosed() {
+		tree.closeLock.Unlock()
+		return ErrClosed
+	}
+	atomic.StoreInt32(&tree.closed, 1)
+	tree.closeLock.Unlock()
+
+	// No more writes can be sent now, so stop the background jobs
+	close(tree.stop)
+	tree.walChan <- nil
+	tree.wg.Wait()
+
+	// Wait for flushJob to write out the remaining immutable memtables
+	tree.lock.Lock()
+	var err error
+	if tree.flushOnClose {
+		err = tree.rotateMemtable()
+	}
+	tree.stopFlush = true
+	tree.flushCond.Broadcast()
+	tree.lock.Unlock()
+	<-tree.flushDone
+
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	if len(tree.immutables) > 0 && err == nil {
+		err = tree.flushErr
+	}
+	if e := tree.wal.Sync(); e != nil && err == nil {
+		err = e
+	}
+	if e := tree.wal.Close(); e != nil && err == nil {
+		err = e
+	}
+	tree.manifestLock.Lock()
+	if e := tree.manifest.close(); e != nil && err == nil {
+		err = e
+	}
+	tree.manifestLock.Unlock()
+
+	tree.log.Info("closed lsm tree", "path", tree.path)
+	return err
+}
+
+// isClosed returns true if Close has been called.
+func (tree *LsmTree) isClosed() bool {
+	return atomic.LoadInt32(&tree.closed) != 0
+}
@@ -0,0 +1,108 @@
+package lsm
+
+import (
+	"github.com/justinethier/keyva/lsm/sst"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-close")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tbl = newTree(t, dir, 25)
+	tbl.Set("a", []byte("1"))
+	if err := tbl.Close(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	// Every operation fails once the tree is closed
+	if err := tbl.Set("b", []byte("2")); err != ErrClosed {
+		t.Error("Expected ErrClosed from Set but received", err)
+	}
+	if err := tbl.Delete("a"); err != ErrClosed {
+		t.Error("Expected ErrClosed from Delete but received", err)
+	}
+	if _, err := tbl.Get("a"); err != ErrClosed {
+		t.Error("Expected ErrClosed from Get but received", err)
+	}
+	if _, err := tbl.NewIterator(); err != ErrClosed {
+		t.Error("Expected ErrClosed from NewIterator but received", err)
+	}
+	if err := tbl.Flush(); err != ErrClosed {
+		t.Error("Expected ErrClosed from Flush but received", err)
+	}
+	if err := tbl.Merge(0); err != ErrClosed {
+		t.Error("Expected ErrClosed from Merge but received", err)
+	}
+	if _, err := tbl.Snapshot(); err != ErrClosed {
+		t.Error("Expected ErrClosed from Snapshot but received", err)
+	}
+	if _, err := tbl.Begin(); err != ErrClosed {
+		t.Error("Expected ErrClosed from Begin but received", err)
+	}
+	if err := tbl.SetWalSync(WalSyncSettings{Mode: SyncAlways}); err != ErrClosed {
+		t.Error("Expected ErrClosed from SetWalSync but received", err)
+	}
+	if tbl.walSync.Mode == SyncAlways {
+		t.Error("Expected Wal sync settings to be unchanged")
+	}
+	if err := tbl.Close(); err != ErrClosed {
+		t.Error("Expected ErrClosed from Close but received", err)
+	}
+
+	// Data is recovered from the Wal
+	if len(sst.Filenames(dir)) != 0 {
+		t.Error("Unexpected SST files", sst.Filenames(dir))
+	}
+	tbl = newTree(t, dir, 25)
+	if val, err := tbl.Get("a"); err != nil || string(val) != "1" {
+		t.Error("Unexpected value", string(val), err, "for key a")
+	}
+
+	// Or from an SST file if flushed on close
+	tbl.SetFlushOnClose(true)
+	if err := tbl.Close(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(sst.Filenames(dir)) != 1 {
+		t.Error("Expected one SST file but found", sst.Filenames(dir))
+	}
+	tbl = newTree(t, dir, 25)
+	defer tbl.Close()
+	if val, err := tbl.Get("a"); err != nil || string(val) != "1" {
+		t.Error("Unexpected value", string(val), err, "for key a")
+	}
+}
+
+func TestFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-flush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tbl = newTree(t, dir, 25)
+	defer tbl.Close()
+	for _, k := range []string{"a", "b", "c"} {
+		tbl.Set(k, []byte(k))
+	}
+	if err := tbl.Flush(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(sst.Filenames(dir)) != 1 {
+		t.Error("Expected one SST file but found", sst.Filenames(dir))
+	}
+	if tbl.memtbl.len() != 0 {
+		t.Error("Memtable not empty after flush", tbl.memtbl.len())
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if val, err := tbl.Get(k); err != nil || string(val) != k {
+			t.Error("Unexpected value", string(val), err, "for key", k)
+		}
+	}
+}
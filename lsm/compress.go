@@ -0,0 +1,37 @@
+package lsm
+
+import (
+	"github.com/justinethier/keyva/lsm/sst"
+)
+
+// SetCompression sets the compressor used for data blocks of SST files
+// written to each level of the tree, starting with level 0. Levels past the
+// end of the list use the last compressor given, and a nil compressor stores
+// blocks uncompressed. For example:
+//
+//	tree.SetCompression([]sst.Compressor{nil, sst.Snappy, sst.Flate})
+//
+// leaves level 0 uncompressed so flushes are fast, uses Snappy for level 1
+// and Flate for every level below it.
+//
+// Existing files are not rewritten. They keep their current compression
+// until they are next merged.
+func (tree *LsmTree) SetCompression(perLevel []sst.Compressor) {
+	tree.compressionLock.Lock()
+	defer tree.compressionLock.Unlock()
+	tree.compression = append([]sst.Compressor(nil), perLevel...)
+}
+
+// compressor returns the compressor for SST files written to the given
+// level. It may be called with or without tree.lock held.
+func (tree *LsmTree) compressor(level int) sst.Compressor {
+	tree.compressionLock.Lock()
+	defer tree.compressionLock.Unlock()
+	if len(tree.compression) == 0 {
+		return nil
+	}
+	if level >= len(tree.compression) {
+		level = len(tree.compression) - 1
+	}
+	return tree.compression[level]
+}
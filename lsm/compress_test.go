@@ -0,0 +1,107 @@
+package lsm
+
+import (
+	"bytes"
+	"github.com/justinethier/keyva/lsm/sst"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// levelDiskSize returns the total size of the SST files in a level.
+func levelDiskSize(t *testing.T, path string, level int) int64 {
+	lPath := sst.PathForLevel(path, level)
+	var size int64
+	for _, filename := range sst.Filenames(lPath) {
+		fi, err := os.Stat(lPath + "/" + filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += fi.Size()
+	}
+	return size
+}
+
+func TestCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-compress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte("value "+strconv.Itoa(i)), 20)
+	}
+
+	var tbl = newTree(t, dir, 100)
+	tbl.SetCompression([]sst.Compressor{nil, sst.Flate})
+	for i := 0; i < 100; i++ {
+		tbl.Set(strconv.Itoa(i), value(i))
+	}
+	if err := tbl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	uncompressed := levelDiskSize(t, dir, 0)
+
+	// Data merged to level 1 is compressed
+	if err := tbl.Merge(0); err != nil {
+		t.Fatal(err)
+	}
+	if compressed := levelDiskSize(t, dir, 1); compressed == 0 || compressed > uncompressed/2 {
+		t.Error("Expected level 1 to be compressed, size", compressed, "level 0 size", uncompressed)
+	}
+	tbl.Close()
+
+	tbl = newTree(t, dir, 100)
+	defer tbl.Close()
+	for i := 0; i < 100; i++ {
+		val, err := tbl.Get(strconv.Itoa(i))
+		if err != nil || !bytes.Equal(val, value(i)) {
+			t.Error("Unexpected value", string(val), err, "for key", i)
+		}
+	}
+}
+
+// Test that compression may be changed while merges are running, including
+// those run by flushes in immediate mode. Run with -race.
+func TestChangeCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-compress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tbl = newTree(t, dir, 10)
+	defer tbl.Close()
+	tbl.SetMergeSettings(MergeSettings{Immediate: true, NumberOfSstFiles: 100})
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				tbl.SetCompression([]sst.Compressor{nil, sst.Flate})
+				tbl.SetCompression(nil)
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		tbl.Set(strconv.Itoa(i), []byte("value"))
+		if i%10 == 9 {
+			if err := tbl.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if err := tbl.Merge(0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	close(stop)
+	<-done
+	if val, err := tbl.Get("0"); err != nil || string(val) != "value" {
+		t.Error("Unexpected value", string(val), err)
+	}
+}
@@ -0,0 +1,24 @@
+package lsm
+
+import (
+	"errors"
+	"github.com/justinethier/keyva/lsm/sst"
+)
+
+// ErrNotFound is returned when a key does not exist in the tree.
+var ErrNotFound = errors.New("lsm: key not found")
+
+// ErrClosed is returned when the tree is used after it has been closed.
+var ErrClosed = errors.New("lsm: tree is closed")
+
+// ErrCorrupt is returned when data on disk cannot be read because it is
+// truncated or otherwise invalid.
+var ErrCorrupt = sst.ErrCorrupt
+
+// ErrConflict is returned when a transaction cannot be committed because
+// data it read was changed by another writer.
+var ErrConflict = errors.New("lsm: transaction conflict")
+
+// ErrTxnDone is returned when a transaction is used after it was already
+// committed or rolled back.
+var ErrTxnDone = errors.New("lsm: transaction has already been committed or rolled back")
@@ -0,0 +1,120 @@
+package lsm
+
+import (
+	"github.com/justinethier/keyva/lsm/sst"
+	"time"
+)
+
+// EventListener is notified of work done by the tree in the background, EG:
+// to record flush latencies or alert on a backlog of compactions. Set it
+// using Options.EventListener.
+//
+// Callbacks are made by the goroutine doing the work, which may hold locks
+// of the tree, so they must return quickly and must not call methods of the
+// tree. Embed BaseEventListener to implement only some of the callbacks.
+type EventListener interface {
+	// A memtable is about to be written to an SST file
+	OnFlushBegin(info FlushInfo)
+	// A flush finished, successfully or with info.Err set
+	OnFlushEnd(info FlushInfo)
+	// SST files are about to be merged, by Merge, Compact or the merge job
+	OnCompactionBegin(info CompactionInfo)
+	// A merge finished, successfully or with info.Err set
+	OnCompactionEnd(info CompactionInfo)
+	// A write was held back until a full memtable was flushed
+	OnWriteStall(info WriteStallInfo)
+	// The Wal moved on to a new log file when the memtable became full
+	OnWALRotate(info WALRotateInfo)
+	// Work done in the background failed. It will be tried again later.
+	OnBackgroundError(info BackgroundErrorInfo)
+	// An SST file was deleted from disk, successfully or with info.Err set
+	OnTableFileDeleted(info TableFileDeletedInfo)
+}
+
+// FlushInfo describes a memtable written to an SST file.
+type FlushInfo struct {
+	Seq     uint64 // Sequence number of the newest entry in the memtable
+	Entries int    // Number of entries in the memtable
+
+	// Set by OnFlushEnd. File is the path of the new SST file, and Size is
+	// its size in bytes.
+	File     string
+	Size     int64
+	Duration time.Duration
+	Err      error
+}
+
+// CompactionInfo describes a merge of SST files.
+type CompactionInfo struct {
+	// Files are merged from Level into OutputLevel, which is either the
+	// same level or the next one
+	Level       int
+	OutputLevel int
+
+	// Paths of the files merged, including any overlapping files from
+	// OutputLevel, and their total size in bytes
+	Inputs     []string
+	InputBytes int64
+
+	// Set by OnCompactionEnd
+	Outputs     []string
+	OutputBytes int64
+	Duration    time.Duration
+	Err         error
+}
+
+// WriteStallInfo describes a write held back until a memtable was flushed.
+type WriteStallInfo struct {
+	Duration time.Duration
+}
+
+// WALRotateInfo describes a Wal moving on to a new log file.
+type WALRotateInfo struct {
+	// Log file that was closed. It is removed once the memtable holding
+	// its entries is written to an SST file.
+	Filename string
+	// Sequence number of the last entry in that log file
+	Seq uint64
+}
+
+// BackgroundErrorInfo describes work done in the background that failed.
+type BackgroundErrorInfo struct {
+	Job string // Either "flush", "merge" or "sync"
+	Err error
+}
+
+// TableFileDeletedInfo describes an SST file deleted from disk.
+type TableFileDeletedInfo struct {
+	File string
+	Err  error
+}
+
+// BaseEventListener implements EventListener with callbacks that do
+// nothing. It is used when no listener is set.
+type BaseEventListener struct{}
+
+func (BaseEventListener) OnFlushBegin(FlushInfo)                  {}
+func (BaseEventListener) OnFlushEnd(FlushInfo)                    {}
+func (BaseEventListener) OnCompactionBegin(CompactionInfo)        {}
+func (BaseEventListener) OnCompactionEnd(CompactionInfo)          {}
+func (BaseEventListener) OnWriteStall(WriteStallInfo)             {}
+func (BaseEventListener) OnWALRotate(WALRotateInfo)               {}
+func (BaseEventListener) OnBackgroundError(BackgroundErrorInfo)   {}
+func (BaseEventListener) OnTableFileDeleted(TableFileDeletedInfo) {}
+
+// removeTableFile deletes an SST file from disk and reports it to the
+// event listener.
+func (tree *LsmTree) removeTableFile(filename string) {
+	err := sst.Remove(filename)
+	if err != nil {
+		tree.log.Error("unable to remove sst file", "file", filename, "error", err)
+	}
+	tree.listener.OnTableFileDeleted(TableFileDeletedInfo{File: filename, Err: err})
+}
+
+// backgroundError logs an error from the given background job and reports
+// it to the event listener.
+func (tree *LsmTree) backgroundError(job string, err error) {
+	tree.log.Error("background job failed", "job", job, "error", err)
+	tree.listener.OnBackgroundError(BackgroundErrorInfo{Job: job, Err: err})
+}
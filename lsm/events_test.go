@@ -0,0 +1,156 @@
+package lsm
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testListener records the events it receives
+type testListener struct {
+	BaseEventListener
+	lock        sync.Mutex
+	events      []string
+	flushes     []FlushInfo
+	compactions []CompactionInfo
+	deleted     []string
+	errors      []BackgroundErrorInfo
+}
+
+func (l *testListener) record(event string) {
+	l.events = append(l.events, event)
+}
+
+func (l *testListener) OnFlushBegin(info FlushInfo) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.record("flush")
+}
+
+func (l *testListener) OnFlushEnd(info FlushInfo) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.record("flushed")
+	l.flushes = append(l.flushes, info)
+}
+
+func (l *testListener) OnCompactionBegin(info CompactionInfo) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.record("compaction")
+}
+
+func (l *testListener) OnCompactionEnd(info CompactionInfo) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.record("compacted")
+	l.compactions = append(l.compactions, info)
+}
+
+func (l *testListener) OnWALRotate(info WALRotateInfo) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.record("rotate")
+}
+
+func (l *testListener) OnBackgroundError(info BackgroundErrorInfo) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.errors = append(l.errors, info)
+}
+
+func (l *testListener) OnTableFileDeleted(info TableFileDeletedInfo) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if info.Err == nil {
+		l.deleted = append(l.deleted, info.File)
+	}
+}
+
+func TestEventListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := &testListener{}
+	tree, err := Open(dir, Options{MemtableSize: 10000, EventListener: l})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	value := []byte(strings.Repeat("v", 1000))
+	for i := 0; i < 25; i++ {
+		tree.Set(mergeTestKey(i), value)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Merge(0); err != nil {
+		t.Fatal(err)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	// Flushes run in the background while memtables are rotated
+	counts := make(map[string]int)
+	for _, e := range l.events {
+		counts[e]++
+	}
+	if counts["rotate"] != 3 || counts["flush"] != 3 || counts["flushed"] != 3 ||
+		!strings.HasSuffix(strings.Join(l.events, " "), "flushed compaction compacted") {
+		t.Error("Unexpected events", l.events)
+	}
+	for _, f := range l.flushes {
+		if f.Err != nil || f.Entries == 0 || f.Size == 0 || f.File == "" {
+			t.Error("Unexpected flush", f)
+		}
+	}
+
+	if len(l.compactions) != 1 {
+		t.Fatal("Expected 1 compaction but received", l.compactions)
+	}
+	c := l.compactions[0]
+	if c.Err != nil || c.Level != 0 || c.OutputLevel != 1 || len(c.Inputs) != 3 ||
+		len(c.Outputs) == 0 || c.InputBytes == 0 || c.OutputBytes == 0 {
+		t.Error("Unexpected compaction", c)
+	}
+	// The files merged are deleted once they are no longer in use
+	if strings.Join(l.deleted, " ") != strings.Join(c.Inputs, " ") {
+		t.Error("Expected", c.Inputs, "to be deleted but received", l.deleted)
+	}
+}
+
+// Test that a merge stopped by Close is not reported as an error
+func TestEventListenerClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := &testListener{}
+	tree, err := Open(dir, Options{EventListener: l, Merge: MergeSettings{Immediate: true, NumberOfSstFiles: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.SetFlushOnClose(true)
+	tree.Set("a", []byte("1"))
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Flushed by Close, after which level 0 needs to be merged
+	tree.Set("b", []byte("2"))
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.errors) != 0 {
+		t.Error("Unexpected background errors", l.errors)
+	}
+}
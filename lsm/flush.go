@@ -0,0 +1,207 @@
+package lsm
+
+import (
+	"fmt"
+	"github.com/justinethier/keyva/lsm/sst"
+	"time"
+)
+
+// defaultMaxImmutables is the number of full memtables that may be waiting
+// to be flushed before writers are held back.
+const defaultMaxImmutables = 2
+
+// SetMaxImmutableMemtables sets the number of full memtables that may be
+// waiting to be written to SST files. Once this limit is reached writes are
+// blocked until flushJob catches up.
+func (tree *LsmTree) SetMaxImmutableMemtables(n int) {
+	if n < 1 {
+		n = 1
+	}
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	tree.maxImmutables = n
+	tree.flushCond.Broadcast()
+}
+
+// MemtableStats returns the approximate memory used by the memtable and by
+// full memtables waiting to be written to SST files.
+func (tree *LsmTree) MemtableStats() MemtableStats {
+	tree.lock.RLock()
+	defer tree.lock.RUnlock()
+	stats := MemtableStats{
+		Entries:    tree.memtbl.len(),
+		Size:       tree.memtbl.size,
+		Limit:      tree.memtableSize,
+		Immutables: len(tree.immutables),
+	}
+	for _, imm := range tree.immutables {
+		stats.ImmutableSize += imm.mem.size
+	}
+	return stats
+}
+
+// makeRoomForWrite rotates the memtable once it is full. If the maximum
+// number of immutable memtables are already waiting to be flushed this
+// waits until one of them is written out, so writers cannot get too far
+// ahead of flushJob. Must be called with tree.lock held.
+func (tree *LsmTree) makeRoomForWrite() error {
+	if !tree.memtableFull() {
+		return nil
+	}
+	if len(tree.immutables) >= tree.maxImmutables {
+		defer tree.recordWriteStall(time.Now())
+	}
+	for len(tree.immutables) >= tree.maxImmutables {
+		if tree.flushErr != nil {
+			return fmt.Errorf("unable to flush memtable: %w", tree.flushErr)
+		}
+		tree.flushCond.Wait()
+	}
+	return tree.rotateMemtable()
+}
+
+// memtableFull returns true once the memtable has reached its size limit.
+// Must be called with tree.lock held.
+func (tree *LsmTree) memtableFull() bool {
+	if tree.bufferSize > 0 && tree.memtbl.len() >= tree.bufferSize {
+		return true
+	}
+	return tree.memtbl.size >= tree.memtableSize
+}
+
+// rotateMemtable makes the current memtable immutable and queues it to be
+// written to SST by flushJob. New writes go to a new memtable and Wal file.
+// Must be called with tree.lock held, and only when no writes are in
+// progress (EG: from walJob).
+func (tree *LsmTree) rotateMemtable() error {
+	if tree.memtbl.len() == 0 {
+		return nil
+	}
+
+	filename, err := tree.wal.Rotate()
+	if err != nil {
+		return err
+	}
+	tree.listener.OnWALRotate(WALRotateInfo{Filename: filename, Seq: tree.seq})
+	imm := &immutableMemtable{mem: tree.memtbl, seq: tree.seq, wal: filename}
+	tree.immutables = append(tree.immutables, imm)
+	tree.memtbl = newMemtable()
+	tree.flushCond.Broadcast()
+	return nil
+}
+
+// waitForFlush waits until every immutable memtable has been written to
+// SST. Must be called with tree.lock held.
+func (tree *LsmTree) waitForFlush() error {
+	for len(tree.immutables) > 0 {
+		if tree.flushErr != nil {
+			return tree.flushErr
+		}
+		tree.flushCond.Wait()
+	}
+	return nil
+}
+
+// flushJob runs as a background thread and writes immutable memtables to
+// SST files, oldest first. A Wal file is only removed once all of its
+// entries are safely stored in an SST file.
+func (tree *LsmTree) flushJob() {
+	defer close(tree.flushDone)
+
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	for {
+		for len(tree.immutables) == 0 && !tree.stopFlush {
+			tree.flushCond.Wait()
+		}
+		if len(tree.immutables) == 0 {
+			return // Stopped and nothing left to flush
+		}
+
+		imm := tree.immutables[0]
+		tree.flushing = true
+		c := tree.compressor(0)
+		tree.lock.Unlock()
+		err := tree.writeImmutable(imm, c)
+		if err != nil {
+			tree.backgroundError("flush", err)
+		}
+		tree.lock.Lock()
+		tree.flushing = false
+
+		if err != nil {
+			tree.flushErr = err
+			tree.flushCond.Broadcast()
+			if tree.stopFlush {
+				return // Entries are still in the Wal
+			}
+
+			// Try again later, EG: once disk space is freed up
+			tree.lock.Unlock()
+			time.Sleep(time.Second)
+			tree.lock.Lock()
+			continue
+		}
+
+		tree.immutables = tree.immutables[1:]
+		tree.flushErr = nil
+		if err := tree.wal.Retire(imm.wal); err != nil {
+			tree.log.Error("unable to remove wal file", "file", imm.wal, "error", err)
+		}
+
+		// Run merge job IF we are in immediate mode (mostly just used for debugging)
+		if tree.merge.Immediate {
+			tree.mergeJob(tree.merge)
+		}
+		tree.flushCond.Broadcast()
+	}
+}
+
+// writeImmutable writes the contents of an immutable memtable to a new SST
+// file, compressed using c, and adds it to level 0. Readers may find the
+// same entries in the file and the memtable until flushJob removes the
+// memtable, which is harmless. The flush is reported to the event listener.
+func (tree *LsmTree) writeImmutable(imm *immutableMemtable, c sst.Compressor) (err error) {
+	start := time.Now()
+	info := FlushInfo{Seq: imm.seq, Entries: imm.mem.len()}
+	tree.listener.OnFlushBegin(info)
+	defer func() {
+		info.Duration, info.Err = time.Since(start), err
+		tree.listener.OnFlushEnd(info)
+	}()
+
+	// Remove older versions of each key unless a snapshot still needs them
+	snapshots := tree.liveSnapshots()
+	var entries, versions []sst.SstEntry
+	for _, e := range imm.mem.entries(maxSeq) {
+		if len(versions) > 0 && e.Key != versions[0].Key {
+			entries = append(entries, sst.RetainVersions(versions, snapshots, false)...)
+			versions = versions[:0]
+		}
+		versions = append(versions, e)
+	}
+	entries = append(entries, sst.RetainVersions(versions, snapshots, false)...)
+
+	// Flush memtbl to disk
+	filename := tree.nextSstFilename()
+	opts := tree.table
+	opts.Compressor = c
+	err = sst.CreateWithOptions(tree.path+"/"+filename, entries, imm.seq, opts)
+	if err != nil {
+		return err
+	}
+
+	sstfile, err := sst.NewSstFile(tree.path, filename)
+	if err == nil {
+		err = tree.applyEdit(0, []sst.SstFile{sstfile}, nil)
+	}
+	if err != nil {
+		sst.Remove(tree.path + "/" + filename)
+		return err
+	}
+	info.File, info.Size = tree.path+"/"+filename, sstfile.Size
+	tree.recordFlush(start, sstfile.Size)
+	tree.log.Debug("flushed memtable", "file", filename, "seq", imm.seq, "bytes", sstfile.Size)
+	return nil
+}
@@ -0,0 +1,150 @@
+package lsm
+
+import (
+	"fmt"
+	"github.com/justinethier/keyva/lsm/wal"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func walFiles(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		if len(f.Name()) > 16 && f.Name()[:16] == "write-ahead-log-" {
+			names = append(names, f.Name())
+		}
+	}
+	return names
+}
+
+func TestBackgroundFlush(t *testing.T) {
+	var N = 500
+	dir, err := ioutil.TempDir("", "keyva-flush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tbl = newTree(t, dir, 25)
+	defer tbl.Close()
+	tbl.SetMaxImmutableMemtables(1)
+
+	// Concurrent writers are held back while memtables are flushed
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < N; i += 4 {
+				key := fmt.Sprintf("key-%03d", i)
+				if err := tbl.Set(key, []byte(key)); err != nil {
+					t.Error("Unexpected error", err)
+				}
+				if val, err := tbl.Get(key); err != nil || string(val) != key {
+					t.Error("Unexpected value", string(val), err, "for key", key)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if err := tbl.Flush(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(tbl.immutables) != 0 {
+		t.Error("Immutable memtables remain after flush", len(tbl.immutables))
+	}
+
+	// Wal files are removed once their data is in SST files
+	if files := walFiles(t, dir); len(files) != 1 {
+		t.Error("Expected a single wal file but found", files)
+	}
+	for i := 0; i < N; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		if val, err := tbl.Get(key); err != nil || string(val) != key {
+			t.Error("Unexpected value", string(val), err, "for key", key)
+		}
+	}
+}
+
+// Test that entries from every wal file are recovered, not just the newest
+func TestRecoverWalFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-flush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, _, err := wal.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Append("a", []byte("1"), false)
+	w.Append("b", []byte("2"), false)
+	if _, err := w.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	w.Append("a", []byte("3"), false)
+	w.Append("c", []byte("4"), false)
+	w.Close()
+
+	var tbl = newTree(t, dir, 25)
+	defer tbl.Close()
+	expected := map[string]string{"a": "3", "b": "2", "c": "4"}
+	for k, v := range expected {
+		if val, err := tbl.Get(k); err != nil || string(val) != v {
+			t.Error("Unexpected value", string(val), err, "for key", k)
+		}
+	}
+}
+
+// Test that the memtable is flushed once it uses too much memory, no matter
+// how many entries it holds
+func TestMemtableSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-flush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tbl, err := Open(dir, Options{MemtableSize: 64 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Close()
+
+	// Many small entries fit in a single memtable
+	for i := 0; i < 100; i++ {
+		tbl.Set(fmt.Sprintf("counter-%03d", i), []byte("0123456789"))
+	}
+	stats := tbl.MemtableStats()
+	expected := 100 * (11 + 10 + memtableEntryOverhead)
+	if stats.Entries != 100 || stats.Size != expected || stats.Limit != 64<<10 {
+		t.Error("Unexpected memtable stats", stats, "expected size", expected)
+	}
+
+	// A few large values fill it up
+	value := make([]byte, 16<<10)
+	for i := 0; i < 3; i++ {
+		tbl.Set(fmt.Sprintf("image-%d", i), value)
+	}
+	if stats := tbl.MemtableStats(); stats.Entries != 103 {
+		t.Error("Unexpected memtable stats", stats)
+	}
+	tbl.Set("image-3", value)
+	if err := tbl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(tbl.levelFiles(0)); n != 2 {
+		t.Error("Expected 2 SST files but found", n)
+	}
+	if stats := tbl.MemtableStats(); stats.Size != 0 || stats.Immutables != 0 {
+		t.Error("Unexpected memtable stats after flush", stats)
+	}
+}
@@ -1,10 +1,12 @@
 package lsm
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 // TODO:
@@ -19,29 +21,80 @@ import (
 // 	}
 // }
 
+// TTLHeader may be sent with a PUT or POST request to make the key expire
+// after the given time. The value is a duration such as "90s" or "1h30m",
+// or a whole number of seconds.
+const TTLHeader = "X-Keyva-TTL"
+
 func (m *LsmTree) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case "GET":
-		if val, ok := m.Get(req.URL.Path); ok {
+		val, err := m.Get(req.URL.Path)
+		if err == nil {
 			// TODO: w.Header().Set("Content-Type", val.ContentType)
 			w.Write(val)
-		} else {
+		} else if errors.Is(err, ErrNotFound) {
 			w.WriteHeader(http.StatusNotFound)
 			fmt.Fprintln(w, "Resource not found")
+		} else {
+			m.serverError(w, err)
 		}
 	case "POST", "PUT":
 		b, err := ioutil.ReadAll(req.Body)
 		if err != nil {
-			log.Fatalln(err)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "Unable to read request body")
+			return
 		}
 		var val []byte
 		// TODO: val.ContentType = req.Header.Get("Content-Type")
 		val = b //string(b)
 
-		m.Set(req.URL.Path, val)
+		if h := req.Header.Get(TTLHeader); h != "" {
+			ttl, err := parseTTL(h)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, "Invalid", TTLHeader, "header")
+				return
+			}
+			err = m.SetWithTTL(req.URL.Path, val, ttl)
+		} else {
+			err = m.Set(req.URL.Path, val)
+		}
+		if err != nil {
+			m.serverError(w, err)
+			return
+		}
 		fmt.Fprintln(w, "Stored value")
 	case "DELETE":
-		m.Delete(req.URL.Path)
+		if err := m.Delete(req.URL.Path); err != nil {
+			m.serverError(w, err)
+			return
+		}
 		fmt.Fprintln(w, "Deleted value")
 	}
 }
+
+// parseTTL parses the value of a TTLHeader.
+func parseTTL(s string) (time.Duration, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		s = strconv.FormatInt(n, 10) + "s"
+	}
+	ttl, err := time.ParseDuration(s)
+	if err == nil && ttl <= 0 {
+		err = errors.New("TTL must be positive")
+	}
+	return ttl, err
+}
+
+// serverError logs err and reports it to the client. A closed tree is
+// reported as temporarily unavailable since the server is shutting down.
+func (m *LsmTree) serverError(w http.ResponseWriter, err error) {
+	m.log.Error("unable to process request", "error", err)
+	code := http.StatusInternalServerError
+	if errors.Is(err, ErrClosed) {
+		code = http.StatusServiceUnavailable
+	}
+	w.WriteHeader(code)
+	fmt.Fprintln(w, http.StatusText(code))
+}
@@ -0,0 +1,421 @@
+package lsm
+
+import (
+	"github.com/justinethier/keyva/lsm/sst"
+	"time"
+)
+
+// entryIterator is implemented by each source of data that can be merged
+// into an Iterator, EG: the memtable or a single SST file.
+type entryIterator interface {
+	First()
+	Last()
+	Seek(key string)
+	Next()
+	Prev()
+	Valid() bool
+	Entry() *sst.SstEntry
+	Err() error
+	Close() error
+}
+
+// sliceIterator iterates over a sorted slice of entries. It is used to
+// iterate over a copy of the memtable.
+type sliceIterator struct {
+	entries []sst.SstEntry
+	pos     int
+}
+
+func (it *sliceIterator) First() { it.pos = 0 }
+func (it *sliceIterator) Last()  { it.pos = len(it.entries) - 1 }
+func (it *sliceIterator) Next()  { it.pos++ }
+func (it *sliceIterator) Prev()  { it.pos-- }
+
+func (it *sliceIterator) Seek(key string) {
+	// Binary search for the first entry >= key, which is also the newest
+	left, right := 0, len(it.entries)
+	for left < right {
+		mid := left + (right-left)/2
+		if it.entries[mid].Key < key {
+			left = mid + 1
+		} else {
+			right = mid
+		}
+	}
+	it.pos = left
+}
+
+func (it *sliceIterator) Valid() bool {
+	return it.pos >= 0 && it.pos < len(it.entries)
+}
+
+func (it *sliceIterator) Entry() *sst.SstEntry {
+	return &it.entries[it.pos]
+}
+
+func (it *sliceIterator) Err() error {
+	return nil
+}
+
+func (it *sliceIterator) Close() error {
+	it.entries = nil
+	return nil
+}
+
+// mergingIterator combines several sorted sources into a single sorted
+// stream of entries. Sources are given in order of recency, newest first.
+// Duplicate keys are all returned; when keys are equal the entry with the
+// largest sequence number sorts first, followed by the newest source.
+type mergingIterator struct {
+	children []entryIterator
+	current  int
+	forward  bool
+}
+
+func newMergingIterator(children []entryIterator) *mergingIterator {
+	return &mergingIterator{children: children, current: -1, forward: true}
+}
+
+// less determines if the entry from child i sorts before the one from child j.
+func (it *mergingIterator) less(i, j int) bool {
+	a, b := it.children[i].Entry(), it.children[j].Entry()
+	if a.Key != b.Key {
+		return a.Key < b.Key
+	}
+	if a.Seq != b.Seq {
+		return a.Seq > b.Seq
+	}
+	return i < j
+}
+
+func (it *mergingIterator) findSmallest() {
+	it.current = -1
+	for i, child := range it.children {
+		if child.Valid() && (it.current < 0 || it.less(i, it.current)) {
+			it.current = i
+		}
+	}
+}
+
+func (it *mergingIterator) findLargest() {
+	it.current = -1
+	for i, child := range it.children {
+		if child.Valid() && (it.current < 0 || it.less(it.current, i)) {
+			it.current = i
+		}
+	}
+}
+
+func (it *mergingIterator) First() {
+	for _, child := range it.children {
+		child.First()
+	}
+	it.forward = true
+	it.findSmallest()
+}
+
+func (it *mergingIterator) Last() {
+	for _, child := range it.children {
+		child.Last()
+	}
+	it.forward = false
+	it.findLargest()
+}
+
+func (it *mergingIterator) Seek(key string) {
+	for _, child := range it.children {
+		child.Seek(key)
+	}
+	it.forward = true
+	it.findSmallest()
+}
+
+func (it *mergingIterator) Valid() bool {
+	return it.current >= 0
+}
+
+func (it *mergingIterator) Entry() *sst.SstEntry {
+	return it.children[it.current].Entry()
+}
+
+func (it *mergingIterator) Next() {
+	// Ensure all other children are positioned after the current entry
+	if !it.forward {
+		for i, child := range it.children {
+			if i == it.current {
+				continue
+			}
+			child.Seek(it.Entry().Key)
+			for child.Valid() && it.less(i, it.current) {
+				child.Next()
+			}
+		}
+		it.forward = true
+	}
+
+	it.children[it.current].Next()
+	it.findSmallest()
+}
+
+func (it *mergingIterator) Prev() {
+	// Ensure all other children are positioned before the current entry
+	if it.forward {
+		for i, child := range it.children {
+			if i == it.current {
+				continue
+			}
+			child.Seek(it.Entry().Key)
+			for child.Valid() && it.less(i, it.current) {
+				child.Next()
+			}
+			if child.Valid() {
+				child.Prev()
+			} else {
+				child.Last() // All entries sort before the current one
+			}
+		}
+		it.forward = false
+	}
+
+	it.children[it.current].Prev()
+	it.findLargest()
+}
+
+// Err returns the first error encountered by any of the children.
+func (it *mergingIterator) Err() error {
+	for _, child := range it.children {
+		if err := child.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (it *mergingIterator) Close() error {
+	var err error
+	for _, child := range it.children {
+		if e := child.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Iterator provides ordered access to the keys in an LsmTree.
+//
+// Data from the memtable and every SST level is merged together in key
+// order. When a key has been written more than once only the most recent
+// value is returned, and deleted keys are skipped entirely.
+//
+// An iterator sees the contents of the tree at the time it was created, or
+// at the time its snapshot was taken. It must be closed when no longer needed.
+type Iterator struct {
+	iter    *mergingIterator
+	tree    *LsmTree
+	version *version // SST files being read, released by Close
+	seq     uint64
+	now     int64 // Entries that expired by this time are hidden
+	forward bool
+	valid   bool
+	key     string
+	value   []byte
+}
+
+// NewIterator returns a new iterator over the contents of the tree. The
+// iterator is not positioned until one of the First, Last or Seek methods
+// is called.
+func (tree *LsmTree) NewIterator() (*Iterator, error) {
+	return tree.NewIteratorWithOptions(ReadOptions{})
+}
+
+// NewIteratorWithOptions is the same as NewIterator but allows control over
+// how data is read from disk. EG: a large scan may set NoCache so it does
+// not evict more useful blocks from the block cache.
+func (tree *LsmTree) NewIteratorWithOptions(opts ReadOptions) (*Iterator, error) {
+	return tree.newIterator(maxSeq, opts)
+}
+
+// newIterator returns an iterator over the data visible at sequence number seq.
+func (tree *LsmTree) newIterator(seq uint64, opts ReadOptions) (*Iterator, error) {
+	if tree.isClosed() {
+		return nil, ErrClosed
+	}
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	if seq > tree.seq {
+		seq = tree.seq
+	}
+
+	var children []entryIterator
+
+	// Copy the memtable so writers are free to continue
+	mem := tree.memtbl.entries(seq)
+	children = append(children, &sliceIterator{entries: mem, pos: -1})
+	for i := len(tree.immutables) - 1; i >= 0; i-- {
+		mem = tree.immutables[i].mem.entries(seq)
+		children = append(children, &sliceIterator{entries: mem, pos: -1})
+	}
+
+	// Add SST files, newest to oldest, same order as sst.Find
+	v := tree.version()
+	for l := 0; l < len(v.levels); l++ {
+		for i := len(v.levels[l].Files) - 1; i >= 0; i-- {
+			sstf := v.levels[l].Files[i]
+			filename := sst.PathForLevel(tree.path, l) + "/" + sstf.Filename
+			it, err := sst.NewIterator(filename, &sstf, tree.blockCache, !opts.NoCache)
+			if err != nil {
+				for _, child := range children {
+					child.Close()
+				}
+				tree.unref(v)
+				return nil, err
+			}
+			children = append(children, it)
+		}
+	}
+
+	return &Iterator{iter: newMergingIterator(children), tree: tree, version: v, seq: seq, now: time.Now().UnixNano(), forward: true}, nil
+}
+
+// First moves the iterator to the first key in the tree.
+func (it *Iterator) First() {
+	it.iter.First()
+	it.findNextEntry("", false)
+}
+
+// Last moves the iterator to the last key in the tree.
+func (it *Iterator) Last() {
+	it.iter.Last()
+	it.findPrevEntry()
+}
+
+// Seek moves the iterator to the first key greater than or equal to the
+// given key. Use Seek followed by Next to page through a range of keys.
+func (it *Iterator) Seek(key string) {
+	it.iter.Seek(key)
+	it.findNextEntry("", false)
+}
+
+// Valid returns true if the iterator is positioned at a key.
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Next moves the iterator to the next key in the tree.
+func (it *Iterator) Next() {
+	if !it.valid {
+		return
+	}
+
+	if !it.forward {
+		// Underlying iterator is positioned before the current key,
+		// move it back onto the current key
+		if it.iter.Valid() {
+			it.iter.Next()
+		} else {
+			it.iter.First()
+		}
+	}
+
+	it.findNextEntry(it.key, true)
+}
+
+// Prev moves the iterator to the previous key in the tree.
+func (it *Iterator) Prev() {
+	if !it.valid {
+		return
+	}
+
+	if it.forward {
+		// Underlying iterator is positioned at the current key, move it
+		// before all entries for that key
+		for it.iter.Valid() && it.iter.Entry().Key >= it.key {
+			it.iter.Prev()
+		}
+	}
+
+	it.findPrevEntry()
+}
+
+// Key returns the key at the current position of the iterator.
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value returns the value at the current position of the iterator.
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Err returns the first error encountered while reading data, if any. An
+// iterator that runs into an error becomes invalid, so Err should be
+// checked once iteration stops to tell an error apart from the end of data.
+func (it *Iterator) Err() error {
+	return it.iter.Err()
+}
+
+// Close releases all resources held by the iterator.
+func (it *Iterator) Close() error {
+	it.valid = false
+	err := it.iter.Close()
+	if it.version != nil {
+		it.tree.unref(it.version)
+		it.version = nil
+	}
+	return err
+}
+
+// findNextEntry moves forward to the next live key. If skipping is true any
+// remaining entries for skipKey are ignored.
+func (it *Iterator) findNextEntry(skipKey string, skipping bool) {
+	it.forward = true
+	for ; it.iter.Valid(); it.iter.Next() {
+		e := it.iter.Entry()
+		if e.Seq > it.seq || (skipping && e.Key <= skipKey) {
+			continue
+		}
+
+		// First visible entry seen for a key is the most recent one
+		if e.Deleted || e.Expired(it.now) {
+			skipKey = e.Key
+			skipping = true
+			continue
+		}
+
+		it.valid = it.iter.Err() == nil
+		it.key = e.Key
+		it.value = e.Value
+		return
+	}
+	it.valid = false
+}
+
+// findPrevEntry moves backward to the previous live key. The underlying
+// iterator is left positioned before all entries for that key.
+func (it *Iterator) findPrevEntry() {
+	it.forward = false
+	deleted := true
+	for ; it.iter.Valid(); it.iter.Prev() {
+		e := it.iter.Entry()
+		if e.Seq > it.seq {
+			continue
+		}
+		if !deleted && e.Key < it.key {
+			// Found a live value and have moved on to the previous key
+			break
+		}
+
+		// Entries for a key are seen from oldest to newest, so keep the last one
+		deleted = e.Deleted || e.Expired(it.now)
+		it.key = e.Key
+		it.value = e.Value
+	}
+
+	if deleted || it.iter.Err() != nil {
+		it.valid = false
+		it.forward = true
+	} else {
+		it.valid = true
+	}
+}
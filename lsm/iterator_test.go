@@ -0,0 +1,110 @@
+package lsm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestIterator(t *testing.T) {
+	var N = 100
+	dir, err := ioutil.TempDir("", "keyva-iter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tbl = newTree(t, dir, 25)
+	defer tbl.Close()
+	for i := 0; i < N; i++ {
+		tbl.Set(fmt.Sprintf("key-%03d", i), []byte(fmt.Sprintf("%d", i)))
+	}
+	tbl.Merge(0)
+
+	// Overwrite and delete keys so they are found in more than one place
+	for i := 0; i < N; i += 10 {
+		tbl.Set(fmt.Sprintf("key-%03d", i), []byte("updated"))
+	}
+	for i := 5; i < N; i += 10 {
+		tbl.Delete(fmt.Sprintf("key-%03d", i))
+	}
+
+	expected := func(i int) string {
+		if i%10 == 0 {
+			return "updated"
+		}
+		return fmt.Sprintf("%d", i)
+	}
+
+	it, err := tbl.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	// Forward scan
+	i := 0
+	for it.First(); it.Valid(); it.Next() {
+		if i%10 == 5 {
+			i++
+		}
+		key := fmt.Sprintf("key-%03d", i)
+		if it.Key() != key {
+			t.Fatal("Expected key", key, "but received", it.Key())
+		}
+		if string(it.Value()) != expected(i) {
+			t.Error("Unexpected value", string(it.Value()), "for key", key)
+		}
+		i++
+	}
+	if i != N {
+		t.Error("Forward scan stopped at", i)
+	}
+
+	// Reverse scan
+	i = N - 1
+	for it.Last(); it.Valid(); it.Prev() {
+		if i%10 == 5 {
+			i--
+		}
+		key := fmt.Sprintf("key-%03d", i)
+		if it.Key() != key {
+			t.Fatal("Expected key", key, "but received", it.Key())
+		}
+		i--
+	}
+	if i != -1 {
+		t.Error("Reverse scan stopped at", i)
+	}
+
+	// Seek to a deleted key and change direction
+	it.Seek("key-045")
+	if !it.Valid() || it.Key() != "key-046" {
+		t.Error("Unexpected key after seek", it.Key())
+	}
+	it.Prev()
+	if !it.Valid() || it.Key() != "key-044" {
+		t.Error("Unexpected key after prev", it.Key())
+	}
+	it.Next()
+	if !it.Valid() || it.Key() != "key-046" {
+		t.Error("Unexpected key after next", it.Key())
+	}
+
+	// Page through a prefix
+	count := 0
+	for it.Seek("key-07"); it.Valid() && strings.HasPrefix(it.Key(), "key-07"); it.Next() {
+		count++
+	}
+	if count != 9 {
+		t.Error("Expected 9 keys with prefix but received", count)
+	}
+
+	// Seek past the end
+	it.Seek("zzz")
+	if it.Valid() {
+		t.Error("Unexpected key after seeking past the end", it.Key())
+	}
+}
@@ -0,0 +1,135 @@
+// Package logger defines the leveled, structured logger used by the lsm,
+// sst and wal packages, along with adapters for the standard log package.
+package logger
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger receives messages at four levels of severity. Each message may be
+// followed by alternating keys and values that describe it, EG:
+//
+//	l.Warn("unable to remove file", "file", name, "error", err)
+//
+// A *slog.Logger from the log/slog package satisfies this interface.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// Level is the severity of a message.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+type nop struct{}
+
+func (nop) Debug(string, ...interface{}) {}
+func (nop) Info(string, ...interface{})  {}
+func (nop) Warn(string, ...interface{})  {}
+func (nop) Error(string, ...interface{}) {}
+
+// Nop returns a Logger that discards every message.
+func Nop() Logger {
+	return nop{}
+}
+
+// std writes messages of at least a minimum level to a standard logger.
+type std struct {
+	l     *log.Logger
+	level Level
+}
+
+// New returns a Logger that writes messages of at least the given level to
+// l, one line per message in the form:
+//
+//	WARN unable to remove file file=000001.sst error="..."
+//
+// If l is nil messages are written using the log package's standard logger,
+// so they follow its output, EG: syslog once util.OpenSyslog is called.
+func New(l *log.Logger, level Level) Logger {
+	return &std{l, level}
+}
+
+// Default returns the Logger used when none is configured, which writes
+// warnings and errors using the log package's standard logger.
+func Default() Logger {
+	return New(nil, LevelWarn)
+}
+
+func (s *std) Debug(msg string, keysAndValues ...interface{}) {
+	s.log(LevelDebug, msg, keysAndValues)
+}
+
+func (s *std) Info(msg string, keysAndValues ...interface{}) {
+	s.log(LevelInfo, msg, keysAndValues)
+}
+
+func (s *std) Warn(msg string, keysAndValues ...interface{}) {
+	s.log(LevelWarn, msg, keysAndValues)
+}
+
+func (s *std) Error(msg string, keysAndValues ...interface{}) {
+	s.log(LevelError, msg, keysAndValues)
+}
+
+func (s *std) log(level Level, msg string, keysAndValues []interface{}) {
+	if level < s.level {
+		return
+	}
+	line := format(level, msg, keysAndValues)
+	if s.l == nil {
+		log.Output(3, line)
+	} else {
+		s.l.Output(3, line)
+	}
+}
+
+// format returns a message as a single line of text. A key without a value
+// is logged with the value "!MISSING".
+func format(level Level, msg string, keysAndValues []interface{}) string {
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		var value interface{} = "!MISSING"
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+		fmt.Fprintf(&b, " %v=%s", keysAndValues[i], quote(fmt.Sprint(value)))
+	}
+	return b.String()
+}
+
+// quote returns s quoted if it is empty or contains spaces, quotes or
+// control characters, so each key=value pair can be told apart.
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\r\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
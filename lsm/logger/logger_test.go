@@ -0,0 +1,27 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(log.New(&buf, "", 0), LevelInfo)
+	l.Debug("hidden", "key", 1)
+	l.Info("flushed memtable", "seq", 42, "file", "000001.sst")
+	l.Warn("unable to remove file", "error", errors.New("file not found"), "odd")
+	l.Error("")
+
+	expected := "INFO flushed memtable seq=42 file=000001.sst\n" +
+		"WARN unable to remove file error=\"file not found\" odd=!MISSING\n" +
+		"ERROR \n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q but received %q", expected, buf.String())
+	}
+
+	// Nothing to check, but must not panic
+	Nop().Error("discarded", "key", "value")
+}
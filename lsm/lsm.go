@@ -20,278 +20,439 @@ package lsm
 
 import (
 	"encoding/binary"
-	"github.com/huandu/skiplist"
+	"errors"
+	"fmt"
 	"github.com/justinethier/keyva/bloom"
+	"github.com/justinethier/keyva/lsm/logger"
 	"github.com/justinethier/keyva/lsm/sst"
 	"github.com/justinethier/keyva/lsm/wal"
-	"log"
+	"io/ioutil"
 	"os"
-	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // New creates a new LsmTree object.
-// Data for the tree will be stored at the given path.
-func New(path string, bufSize int) *LsmTree {
+// Data for the tree will be stored at the given path. The memtable is
+// flushed to an SST file once it holds bufSize entries, or sooner if it
+// uses more than the default Options.MemtableSize bytes of memory.
+func New(path string, bufSize int) (*LsmTree, error) {
+	return open(path, bufSize, nil)
+}
+
+// Open opens the tree stored at path, creating it if it does not exist.
+// ErrInvalidOptions is returned if the options are not valid.
+//
+// The options are recorded in an OPTIONS file in the data directory, and a
+// warning is logged if they are incompatible with the options the tree was
+// last opened with.
+func Open(path string, opts Options) (*LsmTree, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	return open(path, 0, &opts)
+}
+
+// open opens the tree for New or Open. If opts is nil the memtable is also
+// limited to bufSize entries, and everything else uses the defaults of New.
+func open(path string, bufSize int, opts *Options) (*LsmTree, error) {
 	// Create data directory if it does not exist
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		err := os.Mkdir(path, 0755)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
+		}
+	}
+	if opts != nil {
+		if err := saveOptions(path, opts); err != nil {
+			return nil, err
 		}
 	}
 
 	lock := sync.RWMutex{}
-	buf := skiplist.New(skiplist.String)
-	f := bloom.New(bufSize, 200)
-	wal, entries := wal.New(path)
-	log.Println("DEBUG wal seq =", wal.Sequence())
-	log.Println("DEBUG wal =", entries)
-	var files sst.SstLevel
-	var sstLevels []sst.SstLevel
-	sstLevels = append(sstLevels, files)
-	chn := make(chan *sst.SstEntry)
-	tree := LsmTree{path: path, memtbl: buf, bufferSize: bufSize,
-		filter: f, sst: sstLevels, lock: lock, wal: wal, walChan: chn}
-	seq := tree.load() // Read all SST files on disk and generate bloom filters
-
-	log.Println("loaded LSM tree seq =", seq)
+	buf := newMemtable()
+	cacheSize := int64(defaultBlockCacheSize)
+	memtableSize, filterKeys, filterRate := defaultMemtableSize, bufSize, 200
+	if opts != nil {
+		cacheSize = opts.CacheSize
+		// Most entries that fit in the memtable
+		memtableSize = opts.MemtableSize
+		filterKeys, filterRate = memtableSize/memtableEntryOverhead, opts.filterRate()
+	}
+	var listener EventListener = BaseEventListener{}
+	l := logger.Default()
+	if opts != nil {
+		l, listener = opts.Logger, opts.EventListener
+	}
+	f := bloom.New(filterKeys, filterRate)
+	wal, entries, err := wal.NewWithLogger(path, l)
+	if err != nil {
+		return nil, err
+	}
+	l.Debug("read wal", "path", path, "seq", wal.Sequence(), "entries", len(entries))
+	chn := make(chan *writeRequest)
+	tree := LsmTree{path: path, memtbl: buf, bufferSize: bufSize, memtableSize: memtableSize,
+		blockCache: sst.NewBlockCache(cacheSize), filterStats: &sst.FilterStats{},
+		log: l, listener: listener,
+		filter: f, versions: make(map[*version]bool), lock: lock, wal: wal, walChan: chn,
+		snapshots: make(map[uint64]int), stop: make(chan struct{}),
+		syncUpdate:    make(chan WalSyncSettings),
+		maxImmutables: defaultMaxImmutables, flushDone: make(chan struct{})}
+	if opts != nil {
+		tree.table = sst.TableOptions{IndexInterval: opts.IndexInterval,
+			BlockSize: opts.BlockSize, FilterRate: filterRate}
+		tree.merge = opts.Merge
+		tree.maxImmutables = opts.MaxImmutableMemtables
+		tree.flushOnClose = opts.FlushOnClose
+	}
+	tree.flushCond = sync.NewCond(&tree.lock)
+	seq, err := tree.load() // Read all SST files on disk and generate bloom filters
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+
+	l.Info("loaded lsm tree", "path", path, "seq", seq)
 
 	if wal.Sequence() < seq {
 		wal.SetSequence(seq + 1)
 	}
+	tree.seq = wal.Sequence()
 
 	// if there are entries in wal that are not in SST files,
 	// load them into memory
 	if entries != nil {
 		for _, e := range entries {
 			if e.Id > seq {
-				log.Println("DEBUG loading wal id", e.Id, "entry", e.Key)
-				tree.setInMemtbl(e.Key, e.Value, e.Deleted)
+				tree.setInMemtbl(sst.SstEntry{Key: e.Key, Value: e.Value, Deleted: e.Deleted, Seq: e.Id, Expires: e.Expires})
 			}
 		}
 	}
 
+	tree.wg.Add(3)
+	go tree.flushJob()
 	go tree.walJob()
-	go tree.MergeJob()
-	return &tree
+	go tree.syncJob()
+	go func() {
+		defer tree.wg.Done()
+		tree.MergeJob()
+	}()
+	if opts != nil {
+		if err := tree.SetWalSync(opts.WalSync); err != nil {
+			tree.Close()
+			return nil, err
+		}
+	}
+	return &tree, nil
 }
 
-// ResetDB removes all data from disk
-func (tree *LsmTree) ResetDB() {
-	tree.lock.Lock()
-	defer tree.lock.Unlock()
-
-	tree.sst = make([]sst.SstLevel, 1) // Clear from memory
-	sst.RemoveAll(tree.path)           // And delete from disk
+// ResetDB removes all data from memory and disk
+func (tree *LsmTree) ResetDB() error {
+	// Reset from walJob so there are no writes in progress
+	var batch WriteBatch
+	return tree.write(&batch, func(b *WriteBatch) error {
+		// Wait for any SST file being written by flushJob
+		for tree.flushing {
+			tree.flushCond.Wait()
+		}
+		// Clear from memory, then delete from disk
+		if err := tree.resetVersion(); err != nil {
+			return err
+		}
+		tree.memtbl = newMemtable()
+		tree.immutables = nil
+		err := sst.RemoveAll(tree.path)
+		if err != nil {
+			return err
+		}
+		return tree.wal.Reset()
+	})
 }
 
 // Set will add (or update) an entry in the tree with the corresponding key/value.
-func (tree *LsmTree) Set(k string, value []byte) {
-	tree.set(k, value, false)
+func (tree *LsmTree) Set(k string, value []byte) error {
+	return tree.set(k, value, false)
+}
+
+// SetWithTTL is the same as Set but the key expires once ttl has passed.
+// An expired key is no longer returned by Get or iterators, and is removed
+// from disk by a later merge.
+func (tree *LsmTree) SetWithTTL(k string, value []byte, ttl time.Duration) error {
+	var batch WriteBatch
+	batch.PutWithTTL(k, value, ttl)
+	return tree.Write(&batch)
 }
 
 // Delete will remove the corresponding key from the tree.
 // Note the actual key/value may not be removed from memory or disk immediately.
 // One or more merge/compact must run before data is removed from disk.
-func (tree *LsmTree) Delete(k string) {
+func (tree *LsmTree) Delete(k string) error {
 	var val []byte
-	tree.set(k, val, true)
+	return tree.set(k, val, true)
 }
 
 // Increment will add one to the integer counter specified by the given key,
 // and the most recent value will be returned.
 // New counters return a value of 0.
-func (tree *LsmTree) Increment(k string) uint32 {
+func (tree *LsmTree) Increment(k string) (uint32, error) {
 	var result uint32
+	var batch WriteBatch
 
-	// get/set operations are synchronized to guarantee the next number is always returned
-	tree.lock.Lock()
-	var entry sst.SstEntry
-	val, ok := tree.get(k)
-	if ok {
-		n := binary.LittleEndian.Uint32(val)
-		n++
-		binary.LittleEndian.PutUint32(val, n)
-		tree.setInMemtbl(k, val, false)
-		entry = sst.SstEntry{k, val, false}
-		result = n
-	} else {
+	// get/set operations are synchronized by walJob to guarantee the next number is always returned
+	err := tree.write(&batch, func(b *WriteBatch) error {
 		bs := make([]byte, 4)
-		binary.LittleEndian.PutUint32(bs, 0)
-		tree.setInMemtbl(k, bs, false)
-		entry = sst.SstEntry{k, bs, false}
-		result = 0
-	}
-	// Add entry to Wal, flush SST if ready
-	tree.walChan <- &entry
-	tree.lock.Unlock()
+		val, err := tree.get(k, maxSeq, ReadOptions{})
+		if err == nil {
+			n := binary.LittleEndian.Uint32(val)
+			n++
+			binary.LittleEndian.PutUint32(bs, n)
+			result = n
+		} else if err == ErrNotFound {
+			binary.LittleEndian.PutUint32(bs, 0)
+			result = 0
+		} else {
+			return err
+		}
+		b.Put(k, bs)
+		return nil
+	})
+
+	return result, err
+}
 
-	return result
+// Get looks up the given key and returns the corresponding value as a byte
+// array. ErrNotFound is returned if the key does not exist.
+func (tree *LsmTree) Get(k string) ([]byte, error) {
+	return tree.GetWithOptions(k, ReadOptions{})
 }
 
-// Get looks up the given key and returns a boolean indicating if a value was
-// found and (if found) the corresponding value as a byte array.
-func (tree *LsmTree) Get(k string) ([]byte, bool) {
+// GetWithOptions is the same as Get but allows control over how data is
+// read from disk.
+func (tree *LsmTree) GetWithOptions(k string, opts ReadOptions) ([]byte, error) {
+	if tree.isClosed() {
+		return nil, ErrClosed
+	}
 	tree.lock.Lock()
 	defer tree.lock.Unlock()
-	val, ok := tree.get(k)
-	return val, ok
+	return tree.get(k, maxSeq, opts)
 }
 
 // Exists returns a boolean value indicating whether the given key exists within the tree.
-func (tree *LsmTree) Exists(k string) bool {
+func (tree *LsmTree) Exists(k string) (bool, error) {
 	// FUTURE: instead of calling get() and discarding the value it would be more
 	// efficient if existence could be determined without necessarily reading the
 	// value. On the other hand multiple Exists() may be more efficient if we do
 	// a full read and cache the result, so there is a trade-off.
+	if tree.isClosed() {
+		return false, ErrClosed
+	}
 	tree.lock.Lock()
 	defer tree.lock.Unlock()
-	_, found := tree.get(k)
-	return found
+	_, err := tree.get(k, maxSeq, ReadOptions{})
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
 }
 
 // Only set in memory do not update WAL or SST, useful for loading data at startup
-func (tree *LsmTree) setInMemtbl(k string, value []byte, deleted bool) {
-	entry := sst.SstEntry{k, value, deleted}
-	tree.memtbl.Set(k, entry)
-	tree.filter.Add(k)
+func (tree *LsmTree) setInMemtbl(entry sst.SstEntry) {
+	tree.memtbl.set(entry)
+	tree.filter.Add(entry.Key)
 }
 
-func (tree *LsmTree) set(k string, value []byte, deleted bool) {
-	var empty []byte
+func (tree *LsmTree) set(k string, value []byte, deleted bool) error {
+	var batch WriteBatch
 	if deleted {
-		value = empty
+		batch.Delete(k)
+	} else {
+		batch.Put(k, value)
 	}
-	entry := sst.SstEntry{k, value, deleted}
-
-	tree.lock.Lock()
-	// Add entry to Wal, flush SST if ready
-	tree.walChan <- &entry
-	tree.memtbl.Set(k, entry)
-	tree.filter.Add(k)
-	tree.lock.Unlock()
+	return tree.Write(&batch)
 }
 
-func (tree *LsmTree) load() uint64 {
+// load finds the SST files of the tree using its manifest and reads their
+// index and bloom filter. Returns the largest sequence number stored in the
+// files. Files that are not part of the tree, EG: the output of a merge
+// that did not finish, are removed.
+func (tree *LsmTree) load() (uint64, error) {
+	names, nextFile, num, err := readManifest(tree.path, tree.log)
+	if os.IsNotExist(err) {
+		// Trees created before the manifest was added are found by
+		// listing their directories
+		names, err = scanLevels(tree.path)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(names) == 0 {
+		names = make([][]string, 1)
+	}
+	tree.nextFile = nextFile
+
 	var seq uint64
-	seq = tree.loadLevel(tree.path, 0)
-	level := 0
-
-	for _, dir := range sst.Levels(tree.path) {
-		var files sst.SstLevel
-		level = level + 1
-		tree.sst = append(tree.sst, files)
-		levelSeq := tree.loadLevel(tree.path+"/"+dir, level)
-		if levelSeq > seq {
-			seq = levelSeq
+	levels := make([]sst.SstLevel, len(names))
+	for level := range names {
+		path := sst.PathForLevel(tree.path, level)
+		for _, filename := range names[level] {
+			sstfile, err := sst.NewSstFile(path, filename)
+			if errors.Is(err, os.ErrNotExist) {
+				return 0, fmt.Errorf("%w: %s/%s is missing", ErrCorruptManifest, path, filename)
+			} else if err != nil {
+				return 0, err
+			}
+			tree.log.Debug("loaded sst file", "file", path+"/"+filename, "level", level, "seq", sstfile.Header.Seq)
+			if sstfile.Header.Seq > seq {
+				seq = sstfile.Header.Seq
+			}
+			// File numbers are unique across all levels
+			if n := int64(sst.FileNumber(filename)); n >= tree.nextFile {
+				tree.nextFile = n + 1
+			}
+			levels[level].Files = append(levels[level].Files, sstfile)
 		}
-		log.Println("DEBUG: loaded data from SST level", level)
+		sortLevel(level, levels[level].Files)
 	}
+	tree.removeOrphans(names)
 
-	return seq
+	// Start a new manifest so it does not grow without bound
+	tree.manifest, err = createManifest(tree.path, num+1, names, tree.nextFile, tree.log)
+	if err != nil {
+		return 0, err
+	}
+	tree.versionLock.Lock()
+	tree.setCurrent(&version{levels: levels})
+	tree.versionLock.Unlock()
+	return seq, nil
 }
 
-func (tree *LsmTree) loadLevel(path string, level int) uint64 {
-	var seq uint64
-	sstFilenames := sst.Filenames(path)
-	for _, filename := range sstFilenames {
-		log.Println("DEBUG: loading bloom filter from file", filename)
-		entries, header := sst.Load(path + "/" + filename)
-		log.Println("DEBUG: sst", path, level, header)
-		if header.Seq > seq {
-			seq = header.Seq
+// scanLevels returns the names of the SST files in each level directory
+// under path.
+func scanLevels(path string) ([][]string, error) {
+	names := [][]string{sst.Filenames(path)}
+	dirs, err := sst.Levels(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		level, err := strconv.Atoi(strings.TrimPrefix(dir, "level-"))
+		if err != nil || level < 1 {
+			continue
 		}
-		filter := bloom.New(tree.bufferSize, 200)
-		for _, entry := range entries {
-			filter.Add(entry.Key)
+		for len(names) <= level {
+			names = append(names, nil)
 		}
-		var sstfile = sst.NewSstFile(path, filename, filter)
-		tree.sst[level].Files = append(tree.sst[level].Files, sstfile)
+		names[level] = sst.Filenames(path + "/" + dir)
 	}
-
-	return seq
+	return names, nil
 }
 
-func (tree *LsmTree) flush(seqNum uint64) {
-	if tree.memtbl.Len() == 0 || tree.memtbl.Len() < tree.bufferSize {
-		return
+// removeOrphans deletes SST files that are not part of the tree along with
+// any temporary files left behind by a merge or flush that did not finish.
+func (tree *LsmTree) removeOrphans(names [][]string) {
+	dirs, err := sst.Levels(tree.path)
+	if err != nil {
+		tree.log.Error("unable to list sst levels", "path", tree.path, "error", err)
 	}
-
-	log.Println("DEBUG called flush()")
-
-	// Remove duplicate entries
-	m := make(map[string]sst.SstEntry)
-	for elem := tree.memtbl.Front(); elem != nil; elem = elem.Next() {
-		e := elem.Value
-		m[elem.Key().(string)] = e.(sst.SstEntry)
+	paths := []string{tree.path}
+	for _, dir := range dirs {
+		paths = append(paths, tree.path+"/"+dir)
 	}
 
-	// sort list of keys and setup bloom filter
-	filter := bloom.New(tree.bufferSize, 200)
-	keys := make([]string, 0, len(m))
-	for k := range m {
-		filter.Add(k)
-		keys = append(keys, k)
+	live := make(map[string]bool)
+	for level := range names {
+		for _, filename := range names[level] {
+			live[sst.PathForLevel(tree.path, level)+"/"+filename] = true
+		}
+	}
+	for _, path := range paths {
+		for _, filename := range sst.Filenames(path) {
+			if !live[path+"/"+filename] {
+				tree.log.Warn("removing orphaned sst file", "file", path+"/"+filename)
+				tree.removeTableFile(path + "/" + filename)
+			}
+		}
 	}
-	sort.Strings(keys)
-
-	// Flush memtbl to disk
-	var filename = tree.nextSstFilename()
-	sst.Create(tree.path+"/"+filename, keys, m, seqNum)
-
-	//log.Println("DEBUG wrote new sst file", filename)
-
-	// Add information to memory
-	var sstfile = sst.NewSstFile(tree.path, filename, filter)
-	tree.sst[0].Files = append(tree.sst[0].Files, sstfile)
-
-	// Clear memtbl
-	tree.memtbl = skiplist.New(skiplist.String)
-
-	// Switch to new wal
-	tree.wal.Next()
 
-	// Run merge job IF we are in immediate mode (mostly just used for debugging)
-	if tree.merge.Immediate {
-		log.Println("Immediate mode calling mergeJob from flush")
-		tree.mergeJob()
+	for _, path := range paths {
+		files, _ := ioutil.ReadDir(path)
+		for _, file := range files {
+			if isTemporaryFile(file.Name()) {
+				tree.log.Info("removing temporary file", "file", path+"/"+file.Name())
+				if err := os.RemoveAll(path + "/" + file.Name()); err != nil {
+					tree.log.Error("unable to remove temporary file", "file", path+"/"+file.Name(), "error", err)
+				}
+			}
+		}
 	}
 }
 
+// isTemporaryFile returns true if filename is a file written by a merge,
+// flush or update of the CURRENT or OPTIONS file, which is only left
+// behind if it did not finish.
+func isTemporaryFile(filename string) bool {
+	return strings.HasPrefix(filename, "merged-sst") || strings.HasSuffix(filename, ".sst.tmp") ||
+		filename == currentFilename+".tmp" || filename == optionsFilename+".tmp"
+}
+
+// walJob receives batches of writes and applies them to the tree in order.
+// When every write must be synced, writers that are already waiting are
+// applied as a group so they can share a single sync of the Wal.
 func (tree *LsmTree) walJob() {
+	defer tree.wg.Done()
 	for {
-		v := <-tree.walChan
-
-		//log.Println("walJob received", v)
+		req := <-tree.walChan
+		if req == nil {
+			return
+		}
 
-		if v == nil {
-			tree.wg.Done()
-			break
+		tree.lock.RLock()
+		syncAll := tree.walSync.Mode == SyncAlways
+		tree.lock.RUnlock()
+
+		group := []*writeRequest{req}
+		stop := false
+		if syncAll {
+		collect:
+			for len(group) < maxWriteGroup {
+				select {
+				case req := <-tree.walChan:
+					if req == nil {
+						stop = true
+						break collect
+					}
+					group = append(group, req)
+				default:
+					break collect
+				}
+			}
 		}
 
-		tree.wal.Append(v.Key, v.Value, v.Deleted)
-		//if len(tree.walChan) == 0 {
-		//	tree.wal.Sync()
-		//}
-
-		// Flush SST to disk if ready
-		// TODO: "right" way to do this is to make it immutable now and fire a goroutine
-		//       or have a background job that does the actual flushing
-		//tree.lock.Lock()
-		if tree.memtbl.Len() > tree.bufferSize {
-			log.Println("flushing memtable to SST", tree.wal.Sequence())
-			tree.flush(tree.wal.Sequence())
+		tree.applyGroup(group, syncAll)
+		if stop {
+			return
 		}
-		//tree.lock.Unlock()
 	}
 }
 
+// nextSstFilename returns the name of a new SST file. Names are never
+// reused, so a new file never replaces one that a reader may still be using.
 func (tree *LsmTree) nextSstFilename() string {
-	return sst.NextFilename(tree.path)
+	n := atomic.AddInt64(&tree.nextFile, 1) - 1
+	return sst.NumberedFilename(int(n))
 }
 
 func (tree *LsmTree) findLatestBufferEntryValue(key string) (sst.SstEntry, bool) {
+	return tree.findBufferEntry(key, maxSeq)
+}
+
+// findBufferEntry finds the most recent entry for key in the memtable, or
+// any immutable memtables waiting to be flushed, that is visible at sequence
+// number seq.
+func (tree *LsmTree) findBufferEntry(key string, seq uint64) (sst.SstEntry, bool) {
 	var empty sst.SstEntry
 
 	// Early exit if we have never seen this key
@@ -299,34 +460,45 @@ func (tree *LsmTree) findLatestBufferEntryValue(key string) (sst.SstEntry, bool)
 		return empty, false
 	}
 
-	elem := tree.memtbl.Get(key)
-	if elem != nil {
-		return elem.Value.(sst.SstEntry), true
+	if e, ok := tree.memtbl.get(key, seq); ok {
+		return e, true
+	}
+	for i := len(tree.immutables) - 1; i >= 0; i-- {
+		if e, ok := tree.immutables[i].mem.get(key, seq); ok {
+			return e, true
+		}
 	}
-
 	return empty, false
 }
 
-func (tree *LsmTree) loadEntriesFromSstFile(filename string) ([]sst.SstEntry, sst.SstFileHeader) {
+func (tree *LsmTree) loadEntriesFromSstFile(filename string) ([]sst.SstEntry, sst.SstFileHeader, error) {
 	return sst.Load(tree.path + "/" + filename)
 }
 
-func (tree *LsmTree) get(k string) ([]byte, bool) {
-	// Check in-memory buffer
-	if latestBufEntry, ok := tree.findLatestBufferEntryValue(k); ok {
-		if latestBufEntry.Deleted {
-			return latestBufEntry.Value, false
-		} else {
-			return latestBufEntry.Value, true
-		}
+// get returns the most recent value of k that is visible at sequence number seq.
+func (tree *LsmTree) get(k string, seq uint64, opts ReadOptions) ([]byte, error) {
+	entry, found, err := tree.getEntry(k, seq, opts)
+	if err != nil {
+		return nil, err
 	}
-
-	// Not found, search the sst files
-	val, found := sst.Find(k, tree.sst, tree.path)
-	if found {
-		return val, true
+	if found && !entry.Deleted && !entry.Expired(time.Now().UnixNano()) {
+		return entry.Value, nil
 	}
 
 	// Key not found
-	return val, false
+	return nil, ErrNotFound
+}
+
+// getEntry returns the most recent entry for k that is visible at sequence
+// number seq, including tombstones.
+func (tree *LsmTree) getEntry(k string, seq uint64, opts ReadOptions) (sst.SstEntry, bool, error) {
+	// Check in-memory buffer
+	if latestBufEntry, ok := tree.findBufferEntry(k, seq); ok {
+		return latestBufEntry, true, nil
+	}
+
+	// Not found, search the sst files
+	v := tree.version()
+	defer tree.unref(v)
+	return sst.FindEntry(k, seq, v.levels, tree.path, tree.blockCache, !opts.NoCache, tree.filterStats)
 }
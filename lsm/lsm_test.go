@@ -2,10 +2,12 @@ package lsm
 
 import (
 	"bytes"
+	"errors"
 	"github.com/justinethier/keyva/lsm/sst"
 	"github.com/justinethier/keyva/lsm/wal"
+	"io/ioutil"
 	"math/rand"
-	//"os"
+	"os"
 	"strconv"
 	"testing"
 )
@@ -14,7 +16,20 @@ var tbl *LsmTree
 
 func init() {
 	//os.Remove("wal.log")
-	tbl = New("testdb", 5000)
+	var err error
+	tbl, err = New("testdb", 5000)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// newTree opens the tree at path, failing the test if it cannot be opened.
+func newTree(t *testing.T, path string, bufSize int) *LsmTree {
+	tree, err := New(path, bufSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
 }
 
 func BenchmarkSstKeyValueSet(b *testing.B) {
@@ -47,7 +62,10 @@ func BenchmarkSstKeyValueDelete(b *testing.B) {
 // Test loading data from the WAL
 func TestWal(t *testing.T) {
 	//os.Remove("wal.log")
-	w, _ := wal.New("testdb")
+	w, _, err := wal.New("testdb")
+	if err != nil {
+		t.Fatal(err)
+	}
 	w.Append("a", []byte("1"), false)
 	w.Append("b", []byte("2"), false)
 	w.Append("c", []byte("3"), false)
@@ -57,9 +75,9 @@ func TestWal(t *testing.T) {
 	w.Append("g", []byte("7"), false)
 	w.Close()
 
-	var tbl = New("testdb", 25)
+	var tbl = newTree(t, "testdb", 25)
 	tbl.Set("h", []byte("8"))
-	if v, found := tbl.Get("a"); found {
+	if v, err := tbl.Get("a"); err == nil {
 		if bytes.Compare(v, []byte("1")) != 0 {
 			t.Error("Unexpected value", v, "for key", "a")
 		}
@@ -73,7 +91,7 @@ func TestWal(t *testing.T) {
 // sst files
 
 func TestSstInternals(t *testing.T) {
-	var tbl = New("testdb", 25)
+	var tbl = newTree(t, "testdb", 25)
 
 	tbl.ResetDB()
 
@@ -87,7 +105,7 @@ func TestSstInternals(t *testing.T) {
 
 func TestSstKeyValue(t *testing.T) {
 	var N = 100
-	var tbl = New("testdb", 25)
+	var tbl = newTree(t, "testdb", 25)
 
 	tbl.ResetDB()
 
@@ -101,7 +119,7 @@ func TestSstKeyValue(t *testing.T) {
 
 	// verify i contains expected value
 	for i := 0; i < N; i++ {
-		if v, found := tbl.Get(strconv.Itoa(i)); found {
+		if v, err := tbl.Get(strconv.Itoa(i)); err == nil {
 			if bytes.Compare(v, []byte(strconv.Itoa(i))) != 0 {
 				t.Error("Unexpected value", v, "for key", i)
 			}
@@ -116,10 +134,10 @@ func TestSstKeyValue(t *testing.T) {
 
 	// verify key does not exist for i
 	for i := 0; i < N; i++ {
-		if val, found := tbl.Get(strconv.Itoa(i)); found {
+		if val, err := tbl.Get(strconv.Itoa(i)); err != ErrNotFound {
 			t.Error("Unexpected value", val, "for deleted key", i)
 		}
-		if found := tbl.Exists(strconv.Itoa(i)); found {
+		if found, err := tbl.Exists(strconv.Itoa(i)); found || err != nil {
 			t.Error("Unexpected value for deleted key", i)
 		}
 	}
@@ -128,7 +146,7 @@ func TestSstKeyValue(t *testing.T) {
 	tbl.Set("abcd", []byte("test"))
 
 	// verify that key exists now
-	if val, found := tbl.Get("abcd"); found {
+	if val, err := tbl.Get("abcd"); err == nil {
 		if string(val) != "test" {
 			t.Error("Unexpected value", val, "for key", "abcd")
 		}
@@ -141,7 +159,7 @@ func TestSstKeyValue(t *testing.T) {
 
 func TestSstKeyValueWithMerge(t *testing.T) {
 	var N = 100
-	var tbl = New("testdb", 25)
+	var tbl = newTree(t, "testdb", 25)
 
 	tbl.ResetDB()
 
@@ -153,7 +171,7 @@ func TestSstKeyValueWithMerge(t *testing.T) {
 	tbl.Delete(strconv.Itoa(100))
 	//tbl.Flush()
 
-	levels := sst.Levels("testdb")
+	levels, _ := sst.Levels("testdb")
 	if len(levels) != 0 {
 		t.Error("Found SST levels prior to merge", levels)
 	}
@@ -161,14 +179,14 @@ func TestSstKeyValueWithMerge(t *testing.T) {
 	// Explicitly merge L0 to L1
 	tbl.Merge(0)
 
-	levels = sst.Levels("testdb")
+	levels, _ = sst.Levels("testdb")
 	if len(levels) != 1 {
 		t.Error("Did not find SST levels after merge", levels)
 	}
 
 	// verify i contains expected value
 	for i := 0; i < N; i++ {
-		if v, found := tbl.Get(strconv.Itoa(i)); found {
+		if v, err := tbl.Get(strconv.Itoa(i)); err == nil {
 			if bytes.Compare(v, []byte(strconv.Itoa(i))) != 0 {
 				t.Error("Unexpected value", v, "for key", i)
 			}
@@ -183,7 +201,7 @@ func TestSstKeyValueWithMerge(t *testing.T) {
 
 	// verify key does not exist for i
 	for i := 0; i < N; i++ {
-		if val, found := tbl.Get(strconv.Itoa(i)); found {
+		if val, err := tbl.Get(strconv.Itoa(i)); err != ErrNotFound {
 			t.Error("Unexpected value", val, "for deleted key", i)
 		}
 	}
@@ -192,7 +210,7 @@ func TestSstKeyValueWithMerge(t *testing.T) {
 	tbl.Set("abcd", []byte("test"))
 
 	// verify that key exists now
-	if val, found := tbl.Get("abcd"); found {
+	if val, err := tbl.Get("abcd"); err == nil {
 		if string(val) != "test" {
 			t.Error("Unexpected value", val, "for key", "abcd")
 		}
@@ -205,7 +223,7 @@ func TestSstKeyValueWithMerge(t *testing.T) {
 
 func TestSstMerge(t *testing.T) {
 	var N = 100
-	var tbl = New("testdb", 25)
+	var tbl = newTree(t, "testdb", 25)
 
 	tbl.ResetDB()
 
@@ -217,7 +235,7 @@ func TestSstMerge(t *testing.T) {
 	tbl.Delete(strconv.Itoa(100))
 	//tbl.Flush()
 
-	levels := sst.Levels("testdb")
+	levels, _ := sst.Levels("testdb")
 	if len(levels) != 0 {
 		t.Error("Found SST levels prior to merge", levels)
 	}
@@ -229,7 +247,7 @@ func TestSstMerge(t *testing.T) {
 		// Explicitly merge L0 to L1
 		tbl.Merge(i)
 
-		levels = sst.Levels("testdb")
+		levels, _ = sst.Levels("testdb")
 		if len(levels) != i+1 {
 			t.Error("Did not find correct number of SST levels", i+1, "after merge", levels)
 		}
@@ -245,7 +263,7 @@ func TestSstMerge(t *testing.T) {
 
 	// verify i contains expected value
 	for i := 0; i < N; i++ {
-		if v, found := tbl.Get(strconv.Itoa(i)); found {
+		if v, err := tbl.Get(strconv.Itoa(i)); err == nil {
 			if bytes.Compare(v, []byte(strconv.Itoa(i))) != 0 {
 				t.Error("Unexpected value", v, "for key", i)
 			}
@@ -260,7 +278,7 @@ func TestSstMerge(t *testing.T) {
 
 	// verify key does not exist for i
 	for i := 0; i < N; i++ {
-		if val, found := tbl.Get(strconv.Itoa(i)); found {
+		if val, err := tbl.Get(strconv.Itoa(i)); err != ErrNotFound {
 			t.Error("Unexpected value", val, "for deleted key", i)
 		}
 	}
@@ -269,7 +287,7 @@ func TestSstMerge(t *testing.T) {
 	tbl.Set("abcd", []byte("test"))
 
 	// verify that key exists now
-	if val, found := tbl.Get("abcd"); found {
+	if val, err := tbl.Get("abcd"); err == nil {
 		if string(val) != "test" {
 			t.Error("Unexpected value", val, "for key", "abcd")
 		}
@@ -277,9 +295,104 @@ func TestSstMerge(t *testing.T) {
 		t.Error("Value not found for key", "abcd")
 	}
 
-	if found := tbl.Exists("abcd"); !found {
+	if found, err := tbl.Exists("abcd"); !found || err != nil {
 		t.Error("Value not found for key", "abcd")
 	}
 
 	tbl.ResetDB()
 }
+
+// Test that a damaged SST file is reported instead of crashing the process
+func TestCorruptSst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-corrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tbl = newTree(t, dir, 25)
+	defer tbl.Close()
+	for i := 0; i < 30; i++ {
+		tbl.Set(strconv.Itoa(i), []byte(strconv.Itoa(i)))
+	}
+	if _, err := tbl.Get("missing"); err != ErrNotFound {
+		t.Error("Expected ErrNotFound but received", err)
+	}
+
+	if err := tbl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	filenames := sst.Filenames(dir)
+	if len(filenames) != 1 {
+		t.Fatal("Expected one SST file but found", filenames)
+	}
+	fi, err := os.Stat(dir + "/" + filenames[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(dir+"/"+filenames[0], fi.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := New(dir, 25); !errors.Is(err, ErrCorrupt) {
+		t.Error("Expected ErrCorrupt but received", err)
+	}
+}
+
+// Test that SST files written in the legacy format can still be read
+func TestLegacySst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, f := range []string{"sst-0000.bin", "sst-0000.index", "sst-0001.bin", "sst-0001.index"} {
+		data, err := ioutil.ReadFile("sst/test-data/" + f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(dir+"/"+f, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tbl = newTree(t, dir, 25)
+	defer tbl.Close()
+	for _, k := range []string{"1", "6", "10"} {
+		if val, err := tbl.Get(k); err != nil || string(val) != k {
+			t.Error("Unexpected value", string(val), err, "for key", k)
+		}
+	}
+
+	// New data is written in the block format
+	tbl.Set("new", []byte("value"))
+	if err := tbl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	filenames := sst.Filenames(dir)
+	if len(filenames) != 3 || filenames[2] != "sst-0002.sst" {
+		t.Error("Unexpected SST files", filenames)
+	}
+	if val, err := tbl.Get("new"); err != nil || string(val) != "value" {
+		t.Error("Unexpected value", string(val), err, "for key new")
+	}
+	tbl.Close()
+
+	// Repair cannot rename a legacy file listed in the manifest, but may
+	// rewrite a file in the block format in place
+	if _, err := sst.Repair(dir + "/sst-0000.bin"); !errors.Is(err, sst.ErrInTree) {
+		t.Error("Expected ErrInTree but received", err)
+	}
+	if _, err := sst.Repair(dir + "/sst-0002.sst"); err != nil {
+		t.Error("Unexpected error", err)
+	}
+	tbl = newTree(t, dir, 25)
+	defer tbl.Close()
+	for _, k := range []string{"1", "new"} {
+		if _, err := tbl.Get(k); err != nil {
+			t.Error("Unexpected error", err, "for key", k)
+		}
+	}
+}
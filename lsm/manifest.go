@@ -0,0 +1,357 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/justinethier/keyva/lsm/logger"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The MANIFEST records which SST files make up each level of the tree, so
+// the tree can be rebuilt after a crash without trusting the contents of
+// its directories. The CURRENT file holds the name of the manifest in use
+// and is replaced atomically whenever a new manifest is written.
+//
+// A manifest begins with a header:
+//
+//   magic   [8]byte   "KEYVAMAN"
+//   version uint32
+//
+// Followed by any number of records, each describing a change to the set
+// of files:
+//
+//   checksum uint32   CRC-32C of the length and payload
+//   length   uint32   Size of the payload in bytes
+//   payload  []byte
+//
+// The payload of a record is:
+//
+//   nextFile uvarint  Number of the next SST file
+//   count    uvarint  Number of files removed, followed by each file
+//   count    uvarint  Number of files added, followed by each file
+//
+// Where each file is its level as a uvarint, followed by the uvarint length
+// of its name and the name itself. All fixed size integers are little
+// endian. A record that is cut short or fails its checksum marks the end of
+// the manifest, as it was never completely written and the change it
+// describes never took effect.
+
+var manifestMagic = [8]byte{'K', 'E', 'Y', 'V', 'A', 'M', 'A', 'N'}
+
+const (
+	manifestVersion    uint32 = 1
+	manifestHeaderSize        = 12
+	recordHeaderSize          = 8
+	currentFilename           = "CURRENT"
+)
+
+var manifestPattern = regexp.MustCompile(`^MANIFEST-([0-9]{6})$`)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruptManifest is returned when the tree cannot be opened because its
+// manifest is damaged or refers to SST files that do not exist.
+var ErrCorruptManifest = errors.New("lsm: corrupt manifest")
+
+// levelFile identifies an SST file in a level of the tree.
+type levelFile struct {
+	level    int
+	filename string
+}
+
+// manifestEdit is a single record of the manifest.
+type manifestEdit struct {
+	nextFile int64
+	removed  []levelFile
+	added    []levelFile
+}
+
+// manifest is the open manifest file that changes are appended to. It is
+// guarded by tree.manifestLock.
+type manifest struct {
+	path string
+	num  int
+	file *os.File
+	size int64 // Bytes of complete records
+	err  error // Set if a failed record could not be undone
+}
+
+func manifestFilename(num int) string {
+	return fmt.Sprintf("MANIFEST-%06d", num)
+}
+
+// encodeEdit encodes an edit as a single record.
+func encodeEdit(e *manifestEdit) []byte {
+	buf := make([]byte, recordHeaderSize, 64)
+	buf = appendUvarint(buf, uint64(e.nextFile))
+	for _, files := range [][]levelFile{e.removed, e.added} {
+		buf = appendUvarint(buf, uint64(len(files)))
+		for _, f := range files {
+			buf = appendUvarint(buf, uint64(f.level))
+			buf = appendUvarint(buf, uint64(len(f.filename)))
+			buf = append(buf, f.filename...)
+		}
+	}
+
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(buf)-recordHeaderSize))
+	binary.LittleEndian.PutUint32(buf[0:], crc32.Checksum(buf[4:], crcTable))
+	return buf
+}
+
+// decodeEdit decodes an edit from the payload of a record.
+func decodeEdit(payload []byte) (*manifestEdit, error) {
+	var e manifestEdit
+	nextFile, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return nil, ErrCorruptManifest
+	}
+	e.nextFile = int64(nextFile)
+	payload = payload[n:]
+
+	for _, files := range []*[]levelFile{&e.removed, &e.added} {
+		count, n := binary.Uvarint(payload)
+		if n <= 0 || count > uint64(len(payload)) {
+			return nil, ErrCorruptManifest
+		}
+		payload = payload[n:]
+		for i := uint64(0); i < count; i++ {
+			level, n := binary.Uvarint(payload)
+			if n <= 0 || level > 1<<16 {
+				return nil, ErrCorruptManifest
+			}
+			payload = payload[n:]
+			length, n := binary.Uvarint(payload)
+			if n <= 0 || length > uint64(len(payload)-n) {
+				return nil, ErrCorruptManifest
+			}
+			name := string(payload[n : n+int(length)])
+			payload = payload[n+int(length):]
+			*files = append(*files, levelFile{level: int(level), filename: name})
+		}
+	}
+	if len(payload) != 0 {
+		return nil, ErrCorruptManifest
+	}
+	return &e, nil
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+// readManifest replays the manifest named by the CURRENT file under path.
+// It returns the files in each level, the number of the next SST file and
+// the number of the manifest. An error satisfying os.IsNotExist is returned if the tree
+// does not have a manifest yet.
+func readManifest(path string, l logger.Logger) ([][]string, int64, int, error) {
+	current, err := ioutil.ReadFile(path + "/" + currentFilename)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	name := strings.TrimSuffix(string(current), "\n")
+	m := manifestPattern.FindStringSubmatch(name)
+	if m == nil {
+		return nil, 0, 0, fmt.Errorf("%w: CURRENT refers to %q", ErrCorruptManifest, name)
+	}
+	num, _ := strconv.Atoi(m[1])
+
+	data, err := ioutil.ReadFile(path + "/" + name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, 0, fmt.Errorf("%w: %s is missing", ErrCorruptManifest, name)
+		}
+		return nil, 0, 0, err
+	}
+	header := manifestHeader()
+	if len(data) < manifestHeaderSize || !bytes.Equal(data[:manifestHeaderSize], header) {
+		return nil, 0, 0, fmt.Errorf("%w: %s has an invalid header", ErrCorruptManifest, name)
+	}
+
+	var levels [][]string
+	var nextFile int64
+	offset := manifestHeaderSize
+	for offset < len(data) {
+		e, n := nextEdit(data[offset:])
+		if e == nil {
+			// Never completely written, so the change did not take effect
+			l.Warn("ignoring incomplete manifest record", "file", name, "offset", offset)
+			break
+		}
+		offset += n
+
+		nextFile = e.nextFile
+		for _, f := range e.removed {
+			if f.level < len(levels) {
+				levels[f.level] = removeString(levels[f.level], f.filename)
+			}
+		}
+		for _, f := range e.added {
+			for len(levels) <= f.level {
+				levels = append(levels, nil)
+			}
+			levels[f.level] = append(levels[f.level], f.filename)
+		}
+	}
+	return levels, nextFile, num, nil
+}
+
+// nextEdit decodes the record at the start of data. It returns the edit and
+// the size of the record, or nil if the record is incomplete or corrupt.
+func nextEdit(data []byte) (*manifestEdit, int) {
+	if len(data) < recordHeaderSize {
+		return nil, 0
+	}
+	length := binary.LittleEndian.Uint32(data[4:])
+	if uint64(length) > uint64(len(data)-recordHeaderSize) {
+		return nil, 0
+	}
+	end := recordHeaderSize + int(length)
+	if crc32.Checksum(data[4:end], crcTable) != binary.LittleEndian.Uint32(data) {
+		return nil, 0
+	}
+	e, err := decodeEdit(data[recordHeaderSize:end])
+	if err != nil {
+		return nil, 0
+	}
+	return e, end
+}
+
+func removeString(list []string, s string) []string {
+	for i := range list {
+		if list[i] == s {
+			return append(list[:i:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+func manifestHeader() []byte {
+	buf := make([]byte, manifestHeaderSize)
+	copy(buf, manifestMagic[:])
+	binary.LittleEndian.PutUint32(buf[8:], manifestVersion)
+	return buf
+}
+
+// createManifest writes a new manifest under path containing a single
+// record that adds the given files, then points the CURRENT file at it.
+// Older manifests are removed once the new one is in use.
+func createManifest(path string, num int, levels [][]string, nextFile int64, l logger.Logger) (*manifest, error) {
+	name := manifestFilename(num)
+	e := manifestEdit{nextFile: nextFile}
+	for l := range levels {
+		for _, filename := range levels[l] {
+			e.added = append(e.added, levelFile{level: l, filename: filename})
+		}
+	}
+
+	f, err := os.OpenFile(path+"/"+name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	buf := append(manifestHeader(), encodeEdit(&e)...)
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = writeCurrent(path, name)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(path + "/" + name)
+		return nil, err
+	}
+
+	// Only the current manifest is needed from now on
+	files, _ := ioutil.ReadDir(path)
+	for _, file := range files {
+		if manifestPattern.MatchString(file.Name()) && file.Name() != name {
+			if err := os.Remove(path + "/" + file.Name()); err != nil {
+				l.Error("unable to remove old manifest", "file", file.Name(), "error", err)
+			}
+		}
+	}
+	return &manifest{path: path, num: num, file: f, size: int64(len(buf))}, nil
+}
+
+// writeCurrent atomically replaces the CURRENT file so it refers to the
+// given manifest.
+func writeCurrent(path, name string) error {
+	return replaceFile(path, currentFilename, []byte(name+"\n"))
+}
+
+// replaceFile atomically replaces the contents of the named file under path.
+func replaceFile(path, name string, data []byte) error {
+	tmp := path + "/" + name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+"/"+name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(path)
+}
+
+// syncDir makes sure changes to the entries of a directory, EG: a rename,
+// are on disk.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// Not supported on every platform, and the rename itself is atomic
+	d.Sync()
+	return nil
+}
+
+// append writes an edit to the manifest and syncs it to disk. The change
+// takes effect once this returns successfully.
+func (m *manifest) append(e *manifestEdit) error {
+	if m.err != nil {
+		return m.err
+	}
+	buf := encodeEdit(e)
+	_, err := m.file.Write(buf)
+	if err == nil {
+		err = m.file.Sync()
+	}
+	if err != nil {
+		// Remove any part of the record that was written, so records
+		// appended later can still be read
+		if e := m.file.Truncate(m.size); e != nil {
+			m.err = fmt.Errorf("unable to undo manifest record: %w", e)
+		} else if _, e := m.file.Seek(m.size, io.SeekStart); e != nil {
+			m.err = fmt.Errorf("unable to undo manifest record: %w", e)
+		}
+		return err
+	}
+	m.size += int64(len(buf))
+	return nil
+}
+
+func (m *manifest) close() error {
+	return m.file.Close()
+}
@@ -0,0 +1,110 @@
+package lsm
+
+import (
+	"errors"
+	"github.com/justinethier/keyva/lsm/logger"
+	"github.com/justinethier/keyva/lsm/sst"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tbl = newTree(t, dir, 10)
+	for i := 0; i < 30; i++ {
+		tbl.Set(mergeTestKey(i), []byte("a"))
+	}
+	tbl.Flush()
+	if err := tbl.Merge(0); err != nil {
+		t.Fatal(err)
+	}
+	tbl.Set("new", []byte("b"))
+	tbl.Flush()
+	tbl.Close()
+
+	names, _, num, err := readManifest(dir, logger.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || len(names[0]) != 1 || len(names[1]) == 0 {
+		t.Error("Unexpected files in manifest", names)
+	}
+
+	// Leave behind the output of a merge that did not finish, and a
+	// record that was only partly written
+	level1 := sst.PathForLevel(dir, 1)
+	data, err := ioutil.ReadFile(level1 + "/" + names[1][0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan := level1 + "/" + sst.NumberedFilename(9999)
+	ioutil.WriteFile(orphan, data, 0644)
+	os.Mkdir(dir+"/merged-sst123", 0755)
+	// SST files that were being written by a flush and a merge
+	tmpFiles := []string{dir + "/" + sst.NumberedFilename(9998) + ".tmp", orphan + ".tmp"}
+	for _, tmp := range tmpFiles {
+		ioutil.WriteFile(tmp, data[:10], 0644)
+	}
+	f, _ := os.OpenFile(dir+"/"+manifestFilename(num), os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write(encodeEdit(&manifestEdit{nextFile: 1})[:5])
+	f.Close()
+
+	tbl = newTree(t, dir, 10)
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Error("Expected orphaned SST file to be removed", err)
+	}
+	if _, err := os.Stat(dir + "/merged-sst123"); !os.IsNotExist(err) {
+		t.Error("Expected temporary directory to be removed", err)
+	}
+	for _, tmp := range tmpFiles {
+		if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+			t.Error("Expected temporary file", tmp, "to be removed", err)
+		}
+	}
+	if _, err := os.Stat(dir + "/" + manifestFilename(num)); !os.IsNotExist(err) {
+		t.Error("Expected old manifest to be removed", err)
+	}
+	for i := 0; i < 30; i++ {
+		if val, err := tbl.Get(mergeTestKey(i)); err != nil || string(val) != "a" {
+			t.Error("Unexpected value", string(val), err, "for key", i)
+		}
+	}
+	if val, err := tbl.Get("new"); err != nil || string(val) != "b" {
+		t.Error("Unexpected value", string(val), err)
+	}
+	tbl.Close()
+
+	// A file that the manifest refers to is missing
+	sst.Remove(level1 + "/" + names[1][0])
+	if _, err := New(dir, 10); !errors.Is(err, ErrCorruptManifest) {
+		t.Error("Expected corrupt manifest", err)
+	}
+}
+
+func TestManifestEdit(t *testing.T) {
+	e := manifestEdit{
+		nextFile: 42,
+		removed:  []levelFile{{0, "sst-0001.sst"}, {1, "sst-0002.sst"}},
+		added:    []levelFile{{1, "sst-0041.sst"}},
+	}
+	buf := encodeEdit(&e)
+	decoded, n := nextEdit(buf)
+	if decoded == nil || n != len(buf) {
+		t.Fatal("Unable to decode edit")
+	}
+	if decoded.nextFile != 42 || len(decoded.removed) != 2 || decoded.removed[1] != e.removed[1] ||
+		len(decoded.added) != 1 || decoded.added[0] != e.added[0] {
+		t.Error("Unexpected edit", decoded)
+	}
+
+	buf[len(buf)-1]++
+	if decoded, _ := nextEdit(buf); decoded != nil {
+		t.Error("Expected checksum to fail")
+	}
+}
@@ -0,0 +1,92 @@
+package lsm
+
+import (
+	"github.com/huandu/skiplist"
+	"github.com/justinethier/keyva/lsm/sst"
+	"math"
+)
+
+// maxSeq is used to read the most recent data in the tree.
+const maxSeq = math.MaxUint64
+
+// memtableEntryOverhead is the approximate memory in bytes used by each
+// entry of the memtable in addition to its key and value: the skip list
+// element and its level pointers, plus the boxed memtableKey and SstEntry.
+const memtableEntryOverhead = 208
+
+// memtableKey identifies a single version of a key within the memtable.
+type memtableKey struct {
+	key string
+	seq uint64
+}
+
+// memtable holds recently written entries in memory. Every write is kept
+// as a separate version of its key so snapshots are able to read older
+// values. Versions of a key are ordered from newest to oldest.
+type memtable struct {
+	list *skiplist.SkipList
+	size int // Approximate bytes of memory used
+}
+
+// immutableMemtable is a full memtable waiting to be written to an SST file.
+// It is never modified once created, so it may be read without a lock.
+type immutableMemtable struct {
+	mem *memtable
+	seq uint64 // Sequence number of the most recent entry
+	wal string // Newest Wal file containing entries from this memtable
+}
+
+func newMemtable() *memtable {
+	list := skiplist.New(skiplist.GreaterThanFunc(func(lhs, rhs interface{}) int {
+		a, b := lhs.(memtableKey), rhs.(memtableKey)
+		if a.key < b.key {
+			return -1
+		} else if a.key > b.key {
+			return 1
+		} else if a.seq > b.seq {
+			return -1
+		} else if a.seq < b.seq {
+			return 1
+		}
+		return 0
+	}))
+	return &memtable{list: list}
+}
+
+func (m *memtable) set(e sst.SstEntry) {
+	m.list.Set(memtableKey{e.Key, e.Seq}, e)
+	m.size += len(e.Key) + len(e.Value) + memtableEntryOverhead
+}
+
+// get returns the most recent entry for key that is visible at sequence
+// number seq.
+func (m *memtable) get(key string, seq uint64) (sst.SstEntry, bool) {
+	elem := m.list.Find(memtableKey{key, seq})
+	if elem != nil {
+		e := elem.Value.(sst.SstEntry)
+		if e.Key == key {
+			return e, true
+		}
+	}
+
+	var empty sst.SstEntry
+	return empty, false
+}
+
+// len returns the number of entries in the memtable, including older
+// versions of each key.
+func (m *memtable) len() int {
+	return m.list.Len()
+}
+
+// entries returns all entries visible at sequence number seq, in order.
+func (m *memtable) entries(seq uint64) []sst.SstEntry {
+	lis := make([]sst.SstEntry, 0, m.list.Len())
+	for elem := m.list.Front(); elem != nil; elem = elem.Next() {
+		e := elem.Value.(sst.SstEntry)
+		if e.Seq <= seq {
+			lis = append(lis, e)
+		}
+	}
+	return lis
+}
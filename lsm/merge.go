@@ -4,237 +4,468 @@ import (
 	"errors"
 	"fmt"
 	"github.com/justinethier/keyva/lsm/sst"
-	"log"
 	"os"
+	"sort"
 	"time"
 )
 
+// defaultLevelSizeMultiplier is used when MergeSettings.LevelSizeMultiplier
+// is not set.
+const defaultLevelSizeMultiplier = 10
+
+// maxMergesPerJob limits the number of merges run each time the merge job
+// wakes up, so it never spins on a strategy that cannot make progress.
+const maxMergesPerJob = 16
+
 func (tree *LsmTree) SetMergeSettings(s MergeSettings) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
 	tree.merge = s
 }
 
+// mergeSettings returns a copy of the merge settings, which may be changed
+// at any time by SetMergeSettings. Must not be called with tree.lock or
+// tree.compactLock held, since flushJob takes compactLock while holding
+// tree.lock.
+func (tree *LsmTree) mergeSettings() MergeSettings {
+	tree.lock.RLock()
+	defer tree.lock.RUnlock()
+	return tree.merge
+}
+
 // Merge takes all of the current SST files at level and merges them with the
-// SST files at the next level of the LSM tree. Data is compacted during this
-// process and any older key values or tombstones are permanently removed.
+// SST files at the next level of the LSM tree that contain the same range of
+// keys. Data is compacted during this process and any older key values or
+// tombstones are permanently removed. Files in the next level that do not
+// overlap are left as they are.
 func (tree *LsmTree) Merge(level int) error {
-	// Overall algorithm
-	//
-	// - find path for level, get all sst files
-	// - find path for level+1, get all sst files
-	// - load file contents into heap (future: stream them)
-	// - write files back out to new temp directory
-	// - acquire tree lock
-	// - swap level+1 with new directory
-	// - delete all old files
-	// - clear all in-memory data for files
-	// - release locks, merge is done
-	// - log to syslog, consider WAL
-
-	// TODO: if level == tree.merge.MaxLevels, then compact that level instead of merging into l+1
-
-	highestTreeLevel := len(tree.sst) - 1
+	if tree.isClosed() {
+		return ErrClosed
+	}
+	maxLevels := tree.mergeSettings().MaxLevels
+	tree.compactLock.Lock()
+	defer tree.compactLock.Unlock()
+
+	highestTreeLevel := len(tree.levels()) - 1
 
 	if level > highestTreeLevel {
-		desc := fmt.Sprintf("Merge cannot process level %d because the tree only has %d levels", level, highestTreeLevel)
-		log.Println(desc)
-		return errors.New(desc)
-	} else if level > 0 && level == tree.merge.MaxLevels {
+		return fmt.Errorf("Merge cannot process level %d because the tree only has %d levels", level, highestTreeLevel)
+	} else if level > 0 && level == maxLevels {
 		// Cannot merge above highest level so compact it instead
-		tree.Compact(level)
-		return nil
+		return tree.rewriteFiles(level, tree.levelFiles(level))
 	}
 
-	lPath := sst.PathForLevel(tree.path, level)
-	lNextPath := sst.PathForLevel(tree.path, level+1)
-
-	log.Println("Debug load files from", lPath, lNextPath)
+	// Only merge files that are part of the tree. flushJob may be writing
+	// a new file to level 0 at the same time.
+	return tree.mergeFiles(level, tree.levelFiles(level))
+}
 
-	files := sst.Filenames(lPath)
-	for i, _ := range files {
-		files[i] = lPath + "/" + files[i]
+// runCompaction merges the files chosen by a CompactionStrategy. Must be
+// called with tree.compactLock held.
+func (tree *LsmTree) runCompaction(c *Compaction) error {
+	if tree.isClosed() {
+		return ErrClosed
 	}
-	nextLvlFiles := sst.Filenames(lNextPath)
-	for i, _ := range nextLvlFiles {
-		nextLvlFiles[i] = lNextPath + "/" + nextLvlFiles[i]
+	if err := tree.checkCompaction(c); err != nil {
+		return err
 	}
-
-	files = append(files, nextLvlFiles...)
-	log.Println("Files", files)
-
-	removeDeleted := false
-	if level == highestTreeLevel {
-		log.Println("Merging highest level of tree", level, "deleted keys will be permanently removed")
-		removeDeleted = true
+	if c.NextLevel {
+		return tree.mergeFiles(c.Level, c.Files)
 	}
+	return tree.rewriteFiles(c.Level, c.Files)
+}
 
-	tmpDir, err := sst.Compact(files, tree.path, tree.bufferSize, tree.bufferSize/10, removeDeleted)
-	log.Println("Files in", tmpDir, err)
-
-	if !tree.merge.Immediate {
-		tree.lock.Lock()
-		defer tree.lock.Unlock()
+// checkCompaction verifies the files of a compaction are in the tree, and
+// that files from level 0 may be merged without returning older values of
+// a key.
+func (tree *LsmTree) checkCompaction(c *Compaction) error {
+	levels := tree.levels()
+	if c.Level < 0 || c.Level >= len(levels) || len(c.Files) == 0 {
+		return fmt.Errorf("invalid compaction of %d files from level %d", len(c.Files), c.Level)
 	}
 
-	for _, filename := range files {
-		sst.Remove(filename)
+	pos := make(map[string]int)
+	for i, f := range levels[c.Level].Files {
+		pos[f.Filename] = i
 	}
-
-	err = os.RemoveAll(lNextPath)
-	if err != nil {
-		log.Fatal(err)
+	start := pos[c.Files[0].Filename]
+	for i, f := range c.Files {
+		j, ok := pos[f.Filename]
+		if !ok {
+			return fmt.Errorf("invalid compaction, %s is not in level %d", f.Filename, c.Level)
+		}
+		if c.Level == 0 && j != start+i {
+			return errors.New("invalid compaction, files from level 0 must be consecutive")
+		}
 	}
-
-	err = os.Rename(tmpDir, lNextPath)
-	if err != nil {
-		log.Fatal(err)
+	if c.Level == 0 && c.NextLevel && start != 0 {
+		return errors.New("invalid compaction, merging level 0 must include its oldest file")
 	}
+	return nil
+}
 
-	log.Println(tree.sst)
-
-	// Drop and reload cache for all files from l/l+1
-	// TODO: more efficient solution?
-	var a, b sst.SstLevel
-	tree.sst[level] = a
-	tree.loadLevel(lPath, level)
+// mergeFiles merges the given files from level with the files of level+1
+// that overlap them. All of those files are replaced by the merged files,
+// which are added to level+1. Must be called with tree.compactLock held.
+func (tree *LsmTree) mergeFiles(level int, inputs []sst.SstFile) error {
+	lPath := sst.PathForLevel(tree.path, level)
+	lNextPath := sst.PathForLevel(tree.path, level+1)
+	if err := os.MkdirAll(lNextPath, 0755); err != nil {
+		return err
+	}
+	if len(inputs) == 0 {
+		return nil
+	}
 
-	log.Println(tree.sst, len(tree.sst), level)
+	smallest, largest := keyRange(inputs)
+	overlapping, bottom := tree.overlappingFiles(level+1, smallest, largest)
+	tree.log.Debug("merging sst files", "level", level, "files", len(inputs), "overlapping", len(overlapping))
 
-	if len(tree.sst) <= (level + 1) {
-		log.Println("Add new level", b, "to tree")
-		tree.sst = append(tree.sst, b)
-	} else {
-		log.Println("Update tree at level", b)
-		tree.sst[level+1] = b
+	var files []string
+	var removed []levelFile
+	for _, f := range inputs {
+		files = append(files, lPath+"/"+f.Filename)
+		removed = append(removed, levelFile{level, f.Filename})
 	}
-	tree.loadLevel(lNextPath, level+1)
-	log.Println("Done with merge")
-	return nil
+	for _, f := range overlapping {
+		files = append(files, lNextPath+"/"+f.Filename)
+		removed = append(removed, levelFile{level + 1, f.Filename})
+	}
+
+	info := CompactionInfo{Level: level, OutputLevel: level + 1, Inputs: files,
+		InputBytes: levelSize(inputs) + levelSize(overlapping)}
+	// Deleted keys are permanently removed when merging into the bottom
+	// level of the tree
+	return tree.compactFiles(info, removed, tree.compactOptions(level+1, bottom, true))
 }
 
 // Compact is similar to Merge but will only merge files within the same level. This is
 // intended to be done at the highest level of the tree so that any tombstones can be
 // permanently deleted.
-func (tree *LsmTree) Compact(level int) {
-	highestTreeLevel := len(tree.sst) - 1
+func (tree *LsmTree) Compact(level int) error {
+	if tree.isClosed() {
+		return ErrClosed
+	}
+	tree.compactLock.Lock()
+	defer tree.compactLock.Unlock()
+
+	highestTreeLevel := len(tree.levels()) - 1
 
 	if level == 0 {
-		log.Println("Cannot compact files in level 0 of the SST")
-		return
+		return errors.New("Cannot compact files in level 0 of the SST")
 	} else if level > highestTreeLevel {
-		log.Println("Compact cannot process level", level, "because the tree only has", highestTreeLevel, "levels")
-		return
+		return fmt.Errorf("Compact cannot process level %d because the tree only has %d levels", level, highestTreeLevel)
 	}
 
-	lPath := sst.PathForLevel(tree.path, level)
+	return tree.rewriteFiles(level, tree.levelFiles(level))
+}
 
-	log.Println("Debug load files from", lPath)
+// CompactRange compacts the data for keys from start to end, inclusive,
+// down through every level of the tree. Only files that contain keys in the
+// range are merged. The data ends up in the bottom level, where older
+// values and tombstones are permanently removed, so the disk space used by
+// a range of deleted keys can be reclaimed without waiting for the merge job.
+//
+// The memtable is flushed first so recent writes are included.
+func (tree *LsmTree) CompactRange(start, end string) error {
+	if start > end {
+		return fmt.Errorf("invalid key range %q to %q", start, end)
+	}
+	if err := tree.Flush(); err != nil {
+		return err
+	}
+	maxLevels := tree.mergeSettings().MaxLevels
+	tree.compactLock.Lock()
+	defer tree.compactLock.Unlock()
 
-	files := sst.Filenames(lPath)
-	for i, _ := range files {
-		files[i] = lPath + "/" + files[i]
+	for level := 0; level < len(tree.levels()); level++ {
+		if tree.isClosed() {
+			return ErrClosed
+		}
+		inputs, bottom := tree.overlappingFiles(level, start, end)
+		if len(inputs) == 0 {
+			continue
+		}
+
+		if level > 0 && (bottom || level == maxLevels) {
+			tree.log.Debug("compacting sst files in range", "level", level, "files", len(inputs))
+			return tree.rewriteFiles(level, inputs)
+		}
+
+		if level == 0 {
+			// Files in level 0 overlap, so every file older than the
+			// newest one in the range is merged as well
+			files := tree.levelFiles(0)
+			last := inputs[len(inputs)-1].Filename
+			for i := range files {
+				if files[i].Filename == last {
+					inputs = files[:i+1]
+					break
+				}
+			}
+		}
+		_, nextBottom := tree.overlappingFiles(level+1, start, end)
+		tree.log.Debug("merging sst files in range", "level", level, "files", len(inputs))
+		if err := tree.mergeFiles(level, inputs); err != nil {
+			return err
+		}
+		if nextBottom {
+			// Tombstones were removed when merging into the bottom level
+			return nil
+		}
 	}
-	log.Println("Files", files)
+	return nil
+}
 
-	removeDeleted := false
-	if level == highestTreeLevel {
-		log.Println("Compacting highest level of tree", level, "deleted keys will be permanently removed")
-		removeDeleted = true
+// rewriteFiles merges the given files from level into new files that replace
+// them in the same level. Must be called with tree.compactLock held.
+func (tree *LsmTree) rewriteFiles(level int, inputs []sst.SstFile) error {
+	if len(inputs) == 0 {
+		return nil
+	}
+	lPath := sst.PathForLevel(tree.path, level)
+	var files []string
+	var removed []levelFile
+	for _, f := range inputs {
+		files = append(files, lPath+"/"+f.Filename)
+		removed = append(removed, levelFile{level, f.Filename})
 	}
 
-	tmpDir, err := sst.Compact(files, tree.path, tree.bufferSize, tree.bufferSize/10, removeDeleted)
-	log.Println("Files in", tmpDir, err)
+	// Older values of a key may be in older files of level 0, which must
+	// be merged as well before deleted keys can be removed
+	levelFiles := tree.levelFiles(level)
+	_, bottom := tree.overlappingFiles(level, "", "")
+	removeDeleted := bottom && (level > 0 || levelFiles[0].Filename == inputs[0].Filename)
 
-	if !tree.merge.Immediate {
-		tree.lock.Lock()
-		defer tree.lock.Unlock()
-	}
+	// Level 0 files may overlap, so each run of files is merged into a
+	// single file that takes their place
+	info := CompactionInfo{Level: level, OutputLevel: level, Inputs: files, InputBytes: levelSize(inputs)}
+	return tree.compactFiles(info, removed, tree.compactOptions(level, removeDeleted, level > 0))
+}
 
-	for _, filename := range files {
-		sst.Remove(filename)
+// compactFiles merges the files described by info into new files that are
+// added to info.OutputLevel, replacing the removed files. The compaction is
+// reported to the event listener. Must be called with tree.compactLock held.
+func (tree *LsmTree) compactFiles(info CompactionInfo, removed []levelFile, opts sst.CompactOptions) error {
+	start := time.Now()
+	tree.listener.OnCompactionBegin(info)
+	merged, err := tree.compactTo(info.Inputs, removed, info.OutputLevel, opts)
+	info.Duration, info.Err = time.Since(start), err
+
+	lPath := sst.PathForLevel(tree.path, info.OutputLevel)
+	for _, f := range merged {
+		info.Outputs = append(info.Outputs, lPath+"/"+f.Filename)
 	}
+	info.OutputBytes = levelSize(merged)
+	tree.listener.OnCompactionEnd(info)
+	if err != nil {
+		return err
+	}
+	tree.recordCompaction(start, info.InputBytes, merged)
+	tree.log.Info("merged sst files", "level", info.Level, "outputLevel", info.OutputLevel,
+		"files", len(info.Inputs), "newFiles", len(merged), "removeDeleted", opts.RemoveDeleted,
+		"duration", info.Duration)
+	return nil
+}
 
-	err = os.RemoveAll(lPath)
+// compactTo merges the given files into new files that replace the removed
+// files, and returns the new files.
+func (tree *LsmTree) compactTo(files []string, removed []levelFile, level int, opts sst.CompactOptions) ([]sst.SstFile, error) {
+	tmpDir, err := sst.CompactWithOptions(files, tree.path, opts)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	defer os.RemoveAll(tmpDir)
+	return tree.replaceFiles(removed, tmpDir, level)
+}
+
+// levelFiles returns the SST files in the given level of the tree.
+func (tree *LsmTree) levelFiles(level int) []sst.SstFile {
+	levels := tree.levels()
+	if level >= len(levels) {
+		return nil
+	}
+	return levels[level].Files
+}
+
+// levels returns the SST files in every level of the current version of the
+// tree. The levels must not be modified.
+func (tree *LsmTree) levels() []sst.SstLevel {
+	tree.versionLock.Lock()
+	defer tree.versionLock.Unlock()
+	return tree.current.levels
+}
 
-	err = os.Rename(tmpDir, lPath)
+// overlappingFiles returns the files in level that overlap the keys from
+// smallest to largest. Also returns true if no level below this one
+// contains any files.
+func (tree *LsmTree) overlappingFiles(level int, smallest, largest string) ([]sst.SstFile, bool) {
+	levels := tree.levels()
+	var files []sst.SstFile
+	if level < len(levels) {
+		for _, f := range levels[level].Files {
+			if f.Overlaps(smallest, largest) {
+				files = append(files, f)
+			}
+		}
+	}
+	for l := level + 1; l < len(levels); l++ {
+		if len(levels[l].Files) > 0 {
+			return files, false
+		}
+	}
+	return files, true
+}
+
+// replaceFiles replaces the removed SST files with the merged files in
+// tmpDir, which are added to level. The merged files are in place before
+// the manifest records the change, and the old files are only removed once
+// no reader is using them, so a crash part way through never loses data.
+// Files left behind by a crash are removed when the tree is next opened.
+// Returns the merged files.
+func (tree *LsmTree) replaceFiles(removed []levelFile, tmpDir string, level int) ([]sst.SstFile, error) {
+	merged, err := tree.installFiles(tmpDir, level)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	if err := tree.applyEdit(level, merged, removed); err != nil {
+		tree.removeNewFiles(level, merged)
+		return nil, err
+	}
+	return merged, nil
+}
 
-	log.Println(tree.sst)
+// installFiles moves the SST files in tmpDir to the given level, giving each
+// the next available filename, and returns the moved files. The files are
+// not yet part of the tree.
+func (tree *LsmTree) installFiles(tmpDir string, level int) ([]sst.SstFile, error) {
+	lPath := sst.PathForLevel(tree.path, level)
+	var files []sst.SstFile
+	for _, filename := range sst.Filenames(tmpDir) {
+		newFilename := tree.nextSstFilename()
+		if err := os.Rename(tmpDir+"/"+filename, lPath+"/"+newFilename); err != nil {
+			tree.removeNewFiles(level, files)
+			return nil, err
+		}
+		sstfile, err := sst.NewSstFile(lPath, newFilename)
+		if err != nil {
+			sst.Remove(lPath + "/" + newFilename)
+			tree.removeNewFiles(level, files)
+			return nil, err
+		}
+		files = append(files, sstfile)
+	}
+	return files, nil
+}
 
-	// Drop and reload cache for all files from this level
-	// TODO: more efficient solution?
-	var a sst.SstLevel
-	tree.sst[level] = a
-	tree.loadLevel(lPath, level)
+// removeNewFiles deletes merged files that were never added to the tree.
+func (tree *LsmTree) removeNewFiles(level int, files []sst.SstFile) {
+	lPath := sst.PathForLevel(tree.path, level)
+	for _, f := range files {
+		tree.removeTableFile(lPath + "/" + f.Filename)
+	}
+}
+
+// keyRange returns the smallest and largest keys in the given files.
+func keyRange(files []sst.SstFile) (string, string) {
+	var smallest, largest string
+	first := true
+	for _, f := range files {
+		if f.Header.Entries == 0 {
+			continue
+		}
+		if first || f.Smallest < smallest {
+			smallest = f.Smallest
+		}
+		if first || f.Largest > largest {
+			largest = f.Largest
+		}
+		first = false
+	}
+	return smallest, largest
+}
+
+// sortLevel orders the files of a level. Files in level 0 may overlap so
+// they are ordered from oldest to newest, using the sequence number of the
+// latest entry in each file. Files in the levels below do not overlap and
+// are ordered by key.
+func sortLevel(level int, files []sst.SstFile) {
+	if level == 0 {
+		sort.SliceStable(files, func(i, j int) bool {
+			return files[i].Header.Seq < files[j].Header.Seq
+		})
+		return
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Smallest < files[j].Smallest
+	})
+}
 
-	log.Println("Done with compact")
+// compactOptions returns the options used to merge files into level. If
+// split is true the merged data is split into files of about the size of a
+// flushed memtable, otherwise it is written to a single file.
+func (tree *LsmTree) compactOptions(level int, removeDeleted bool, split bool) sst.CompactOptions {
+	opts := sst.CompactOptions{
+		RemoveDeleted: removeDeleted,
+		Snapshots:     tree.liveSnapshots(),
+		Table:         tree.table,
+		Logger:        tree.log,
+	}
+	opts.Table.Compressor = tree.compressor(level)
+	if opts.Table.IndexInterval == 0 {
+		opts.Table.IndexInterval = tree.bufferSize / 10
+	}
+	if split {
+		opts.RecordsPerSst = tree.bufferSize
+		opts.FileSize = int64(tree.memtableSize)
+	}
+	return opts
 }
 
 // MergeJob runs as a background thread and coordinates when to check SST levels for merging.
+// It runs until the tree is closed.
 func (tree *LsmTree) MergeJob() {
-	if tree.merge.Interval == 0 {
-		log.Println("MergeJob interval not set, stopping goroutine")
+	interval := tree.mergeSettings().Interval
+	if interval == 0 {
+		tree.log.Debug("merge interval not set, merge job stopped")
 		return
 	}
 
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
-		// sleep for interval
-		// TODO: use time.NewTicker instead?
-		time.Sleep(tree.merge.Interval)
-		log.Println("LSM merge job woke up")
-
-		tree.mergeJob()
-	}
-}
-
-// mergeJob determines if a level needs to be merged and runs Merge() as needed.
-func (tree *LsmTree) mergeJob() { // TODO: any state to receive?
-	// find SST levels
-	levels := sst.Levels(tree.path)
-
-	// Don't forget level 0
-	levels = append([]string{"."}, levels...)
-
-	//log.Println("mergeJob path", tree.path, "levels", levels)
-
-	// for each level
-	for i, dir := range levels {
-		// has a threshold been exceeded?
-		lPath := tree.path + "/" + dir
-		files := sst.Filenames(lPath)
-
-		//log.Println("mergJob lPath", lPath, "files", files)
-		merge := false
-
-		// TODO: need to multiply num files by level #?
-		//       what prevents a cascade? EG: merge l0, then immediately merge l1, l2, etc
-		//       This is why we allow (num_files * level) files below here -
-		if tree.merge.NumberOfSstFiles > 0 &&
-			len(files) > tree.merge.NumberOfSstFiles*(i+1) {
-			log.Println("Merge level", i, " - Number of files", len(files), "exceeded merge threshold", tree.merge.NumberOfSstFiles)
-			merge = true
-
-			if i == len(levels) {
-				// last level is maxed out, need to even-out merges to avoid constantly merging
-				// that last level, which will absolutely kill performance
-				if tree.cooldown == 0 {
-					tree.cooldown = tree.merge.NumberOfSstFiles * (i + 1)
-				} else {
-					merge = false
-					tree.cooldown--
-				}
-			}
-
+		select {
+		case <-tree.stop:
+			tree.log.Debug("merge job stopped")
+			return
+		case <-ticker.C:
+			tree.mergeJob(tree.mergeSettings())
 		}
-		// TODO: DataSize
-		// TODO: TimeWindow
+	}
+}
 
-		if merge {
-			tree.Merge(i)
+// mergeJob asks the compaction strategy which files need to be merged and
+// merges them, until no more merges are needed. The settings are a copy
+// taken when the job started.
+func (tree *LsmTree) mergeJob(s MergeSettings) {
+	strategy := s.Strategy
+	if strategy == nil {
+		strategy = &tree.leveled
+	}
+
+	tree.compactLock.Lock()
+	defer tree.compactLock.Unlock()
+	for i := 0; i < maxMergesPerJob; i++ {
+		c := strategy.Pick(tree.levels(), s)
+		if c == nil {
+			return
+		}
+		tree.log.Debug("merge job picked sst files", "level", c.Level, "nextLevel", c.NextLevel, "files", len(c.Files))
+		if err := tree.runCompaction(c); errors.Is(err, ErrClosed) {
+			return // The tree is closing, which is not a failure
+		} else if err != nil {
+			tree.backgroundError("merge", err)
+			return
 		}
 	}
 }
@@ -0,0 +1,299 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/justinethier/keyva/lsm/sst"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func mergeTestKey(i int) string {
+	return fmt.Sprintf("key-%03d", i)
+}
+
+// checkLevels verifies files below level 0 are sorted and do not overlap.
+func checkLevels(t *testing.T, tbl *LsmTree) {
+	for l := 1; l < len(tbl.levels()); l++ {
+		files := tbl.levels()[l].Files
+		for i := 1; i < len(files); i++ {
+			if files[i-1].Largest >= files[i].Smallest {
+				t.Error("Files overlap in level", l, files[i-1].Largest, files[i].Smallest)
+			}
+		}
+	}
+}
+
+func TestPartialMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tbl = newTree(t, dir, 10)
+	defer tbl.Close()
+	for i := 0; i < 100; i++ {
+		tbl.Set(mergeTestKey(i), []byte("a"))
+	}
+	if err := tbl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Merge(0); err != nil {
+		t.Fatal(err)
+	}
+	before := make(map[string]bool)
+	for _, f := range tbl.levels()[1].Files {
+		before[f.Filename] = true
+	}
+	if len(before) < 5 {
+		t.Fatal("Expected level 1 to be split into several files", len(before))
+	}
+
+	// Only the files that overlap the new data are rewritten
+	for i := 50; i < 53; i++ {
+		tbl.Set(mergeTestKey(i), []byte("b"))
+	}
+	if err := tbl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Merge(0); err != nil {
+		t.Fatal(err)
+	}
+	kept := 0
+	for _, f := range tbl.levels()[1].Files {
+		if before[f.Filename] {
+			kept++
+		}
+	}
+	if kept < len(before)-2 {
+		t.Error("Expected untouched files to be kept, only", kept, "of", len(before), "remain")
+	}
+	checkLevels(t, tbl)
+
+	for i := 0; i < 100; i++ {
+		expected := "a"
+		if i >= 50 && i < 53 {
+			expected = "b"
+		}
+		if val, err := tbl.Get(mergeTestKey(i)); err != nil || string(val) != expected {
+			t.Error("Unexpected value", string(val), err, "for key", i)
+		}
+	}
+}
+
+func TestLeveledMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tbl = newTree(t, dir, 10)
+	defer tbl.Close()
+	for i := 0; i < 100; i++ {
+		tbl.Set(mergeTestKey(i), []byte(mergeTestKey(i)))
+	}
+	if err := tbl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Merge(0); err != nil {
+		t.Fatal(err)
+	}
+	files := len(tbl.levels()[1].Files)
+
+	// Level 1 is larger than its target, so a single file is moved down
+	size := levelSize(tbl.levels()[1].Files)
+	tbl.SetMergeSettings(MergeSettings{DataSize: uint32(size - 1), LevelSizeMultiplier: 2})
+	if target := levelTarget(2, tbl.merge); target != 2*(size-1) {
+		t.Error("Unexpected target size for level 2", target)
+	}
+	tbl.mergeJob(tbl.mergeSettings())
+	if len(tbl.levels()) != 3 || len(tbl.levels()[1].Files) != files-1 || len(tbl.levels()[2].Files) != 1 {
+		t.Fatal("Expected one file to be merged to level 2", len(tbl.levels()))
+	}
+	first := tbl.levels()[2].Files[0]
+	if first.Smallest != mergeTestKey(0) {
+		t.Error("Expected first file of level 1 to be merged", first.Smallest)
+	}
+
+	// The next merge picks up where the last one left off
+	size = levelSize(tbl.levels()[1].Files)
+	tbl.SetMergeSettings(MergeSettings{DataSize: uint32(size - 1), LevelSizeMultiplier: 1000})
+	tbl.mergeJob(tbl.mergeSettings())
+	if len(tbl.levels()[2].Files) != 2 || tbl.levels()[2].Files[1].Smallest <= first.Largest {
+		t.Error("Expected next file of level 1 to be merged", len(tbl.levels()[2].Files))
+	}
+	checkLevels(t, tbl)
+
+	for i := 0; i < 100; i++ {
+		if val, err := tbl.Get(mergeTestKey(i)); err != nil || string(val) != mergeTestKey(i) {
+			t.Error("Unexpected value", string(val), err, "for key", i)
+		}
+	}
+
+	// Files are found again when the tree is reopened
+	tbl.Close()
+	tbl = newTree(t, dir, 10)
+	checkLevels(t, tbl)
+	if len(tbl.levels()[2].Files) != 2 || tbl.levels()[2].Files[0].Size == 0 {
+		t.Error("Unexpected files in level 2", tbl.levels()[2].Files)
+	}
+	if val, err := tbl.Get(mergeTestKey(0)); err != nil || string(val) != mergeTestKey(0) {
+		t.Error("Unexpected value", string(val), err, "for key", 0)
+	}
+}
+
+func TestCompactRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tbl = newTree(t, dir, 10)
+	defer tbl.Close()
+	for i := 0; i < 100; i++ {
+		tbl.Set(mergeTestKey(i), []byte("a"))
+	}
+	tbl.Flush()
+	tbl.Merge(0)
+	tbl.Merge(1)
+	for i := 0; i < 100; i++ {
+		tbl.Set(mergeTestKey(i), []byte("b"))
+	}
+	tbl.Flush()
+	tbl.Merge(0)
+	for i := 20; i < 40; i++ {
+		tbl.Delete(mergeTestKey(i))
+	}
+	untouched := tbl.levels()[1].Files[len(tbl.levels()[1].Files)-1]
+
+	if err := tbl.CompactRange(mergeTestKey(20), mergeTestKey(39)); err != nil {
+		t.Fatal(err)
+	}
+	if len(tbl.levels()[0].Files) != 0 {
+		t.Error("Expected level 0 to be merged", len(tbl.levels()[0].Files))
+	}
+	if f := tbl.levels()[1].Files; len(f) == 0 || f[len(f)-1].Filename != untouched.Filename {
+		t.Error("Expected files outside the range to be left in level 1")
+	}
+	checkLevels(t, tbl)
+
+	// Tombstones and older values in the range are gone from disk
+	for l := range tbl.levels() {
+		for _, f := range tbl.levels()[l].Files {
+			entries, _, err := sst.Load(sst.PathForLevel(dir, l) + "/" + f.Filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if e.Key >= mergeTestKey(20) && e.Key <= mergeTestKey(39) {
+					t.Error("Unexpected entry in level", l, e.Key, e.Deleted)
+				}
+			}
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		val, err := tbl.Get(mergeTestKey(i))
+		if i >= 20 && i < 40 {
+			if !errors.Is(err, ErrNotFound) {
+				t.Error("Expected key to be deleted", i, err)
+			}
+		} else if err != nil || string(val) != "b" {
+			t.Error("Unexpected value", string(val), err, "for key", i)
+		}
+	}
+
+	if err := tbl.CompactRange("b", "a"); err == nil {
+		t.Error("Expected error for invalid range")
+	}
+}
+
+func TestMergeWithReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tbl = newTree(t, dir, 100)
+	defer tbl.Close()
+	for i := 0; i < 50; i++ {
+		tbl.Set(mergeTestKey(i), []byte("a"))
+	}
+	if err := tbl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	old := dir + "/" + tbl.levelFiles(0)[0].Filename
+
+	// The iterator keeps reading the files it started with
+	it, err := tbl.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Merge(0); err != nil {
+		t.Fatal(err)
+	}
+	if len(tbl.levelFiles(0)) != 0 || len(tbl.levelFiles(1)) == 0 {
+		t.Fatal("Expected level 0 to be merged")
+	}
+	if _, err := os.Stat(old); err != nil {
+		t.Error("Expected merged file to be kept while in use", err)
+	}
+	n := 0
+	for it.First(); it.Valid(); it.Next() {
+		n++
+	}
+	if n != 50 {
+		t.Error("Unexpected number of keys", n)
+	}
+
+	// Once the reader is done the file is removed
+	it.Close()
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error("Expected merged file to be removed", err)
+	}
+	if val, err := tbl.Get(mergeTestKey(0)); err != nil || string(val) != "a" {
+		t.Error("Unexpected value", string(val), err)
+	}
+}
+
+// Test that merge settings may be changed while merges are running. Run
+// with -race to check the settings are not read without a lock.
+func TestChangeMergeSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tbl = newTree(t, dir, 10)
+	defer tbl.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			tbl.SetMergeSettings(MergeSettings{MaxLevels: 1 + i%3, Immediate: i%2 == 0})
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		tbl.Set(mergeTestKey(i), []byte("a"))
+		if i%10 == 9 {
+			if err := tbl.Merge(0); err != nil {
+				t.Fatal(err)
+			}
+			if err := tbl.CompactRange(mergeTestKey(0), mergeTestKey(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	<-done
+	for i := 0; i < 50; i++ {
+		if val, err := tbl.Get(mergeTestKey(i)); err != nil || string(val) != "a" {
+			t.Error("Unexpected value", string(val), err, "for key", i)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/justinethier/keyva/lsm/logger"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options control the behaviour of a tree opened with Open. Fields left at
+// their zero value use a default.
+type Options struct {
+	// Approximate memory in bytes used by the memtable, including its keys,
+	// values and the overhead of each entry, before it is written to an SST
+	// file. Defaults to 4MB. Files created by a merge are split at about
+	// the same size.
+	MemtableSize int
+
+	// Rate of false positives of the bloom filters used to skip SST files
+	// that do not contain a key, less than 0.5. Defaults to 0.005.
+	BloomFalsePositiveRate float64
+
+	// Number of keys stored in each data block of an SST file, and so the
+	// number of keys between entries of its sparse index. Defaults to 128.
+	IndexInterval int
+
+	// A data block is finished once it holds this many bytes, even if it has
+	// fewer than IndexInterval keys. Defaults to 4KB.
+	BlockSize int
+
+	// Capacity in bytes of the block cache, defaults to 8MB. A negative
+	// size disables the cache.
+	CacheSize int64
+
+	// Number of full memtables that may be waiting to be written to SST
+	// files before writes are blocked, see SetMaxImmutableMemtables.
+	// Defaults to 2.
+	MaxImmutableMemtables int
+
+	// Whether Close writes the memtable to a new SST file, see
+	// SetFlushOnClose
+	FlushOnClose bool
+
+	// When writes to the Wal are synced to disk
+	WalSync WalSyncSettings
+
+	// When and how SST files are merged. The merge job only runs if
+	// Merge.Interval is set.
+	Merge MergeSettings
+
+	// Receives messages about the work done by the tree. Defaults to
+	// logger.Default, which only logs warnings and errors. A *slog.Logger
+	// may be used, as may logger.Nop to discard everything.
+	Logger logger.Logger
+
+	// Notified of flushes, merges and other work done in the background
+	EventListener EventListener
+}
+
+const (
+	defaultMemtableSize           = 4 << 20
+	defaultBloomFalsePositiveRate = 0.005
+	defaultIndexInterval          = 128
+	defaultBlockSize              = 4 << 10
+)
+
+// optionsFilename is the file in the data directory that records the
+// options a tree was last opened with.
+const optionsFilename = "OPTIONS"
+
+// ErrInvalidOptions is returned by Open when the given options are not valid.
+var ErrInvalidOptions = errors.New("lsm: invalid options")
+
+// validate checks the options and fills in defaults for those not set.
+func (o *Options) validate() error {
+	invalid := func(name string, value interface{}) error {
+		return fmt.Errorf("%w: %s of %v", ErrInvalidOptions, name, value)
+	}
+	switch {
+	case o.MemtableSize < 0:
+		return invalid("MemtableSize", o.MemtableSize)
+	case o.BloomFalsePositiveRate < 0 || o.BloomFalsePositiveRate >= 0.5:
+		return invalid("BloomFalsePositiveRate", o.BloomFalsePositiveRate)
+	case o.IndexInterval < 0:
+		return invalid("IndexInterval", o.IndexInterval)
+	case o.BlockSize < 0:
+		return invalid("BlockSize", o.BlockSize)
+	case o.MaxImmutableMemtables < 0:
+		return invalid("MaxImmutableMemtables", o.MaxImmutableMemtables)
+	case o.WalSync.Mode < SyncNone || o.WalSync.Mode > SyncAlways:
+		return invalid("WalSync.Mode", o.WalSync.Mode)
+	case o.WalSync.Interval < 0:
+		return invalid("WalSync.Interval", o.WalSync.Interval)
+	case o.Merge.MaxLevels < 0:
+		return invalid("Merge.MaxLevels", o.Merge.MaxLevels)
+	case o.Merge.Interval < 0:
+		return invalid("Merge.Interval", o.Merge.Interval)
+	case o.Merge.LevelSizeMultiplier < 0 || o.Merge.LevelSizeMultiplier == 1:
+		return invalid("Merge.LevelSizeMultiplier", o.Merge.LevelSizeMultiplier)
+	case o.Merge.NumberOfSstFiles < 0:
+		return invalid("Merge.NumberOfSstFiles", o.Merge.NumberOfSstFiles)
+	}
+
+	o.MemtableSize = defaultInt(o.MemtableSize, defaultMemtableSize)
+	if o.BloomFalsePositiveRate == 0 {
+		o.BloomFalsePositiveRate = defaultBloomFalsePositiveRate
+	}
+	o.IndexInterval = defaultInt(o.IndexInterval, defaultIndexInterval)
+	o.BlockSize = defaultInt(o.BlockSize, defaultBlockSize)
+	o.MaxImmutableMemtables = defaultInt(o.MaxImmutableMemtables, defaultMaxImmutables)
+	if o.CacheSize == 0 {
+		o.CacheSize = defaultBlockCacheSize
+	} else if o.CacheSize < 0 {
+		o.CacheSize = 0
+	}
+	if o.Logger == nil {
+		o.Logger = logger.Default()
+	}
+	if o.EventListener == nil {
+		o.EventListener = BaseEventListener{}
+	}
+	return nil
+}
+
+// filterRate converts the false positive rate to the form used by bloom.New.
+func (o *Options) filterRate() int {
+	return int(math.Round(1 / o.BloomFalsePositiveRate))
+}
+
+// encode returns the options as they are stored in the OPTIONS file, one
+// name=value pair per line.
+func (o *Options) encode() []byte {
+	var buf bytes.Buffer
+	for _, opt := range o.fields() {
+		fmt.Fprintf(&buf, "%s=%s\n", opt[0], opt[1])
+	}
+	return buf.Bytes()
+}
+
+func (o *Options) fields() [][2]string {
+	m := &o.Merge
+	return [][2]string{
+		{"memtable_size", strconv.Itoa(o.MemtableSize)},
+		{"bloom_false_positive_rate", strconv.FormatFloat(o.BloomFalsePositiveRate, 'g', -1, 64)},
+		{"index_interval", strconv.Itoa(o.IndexInterval)},
+		{"block_size", strconv.Itoa(o.BlockSize)},
+		{"cache_size", strconv.FormatInt(o.CacheSize, 10)},
+		{"max_immutable_memtables", strconv.Itoa(o.MaxImmutableMemtables)},
+		{"flush_on_close", strconv.FormatBool(o.FlushOnClose)},
+		{"wal_sync.mode", strconv.Itoa(int(o.WalSync.Mode))},
+		{"wal_sync.interval", o.WalSync.Interval.String()},
+		{"merge.strategy", strategyName(m.Strategy)},
+		{"merge.max_levels", strconv.Itoa(m.MaxLevels)},
+		{"merge.interval", m.Interval.String()},
+		{"merge.data_size", strconv.FormatUint(uint64(m.DataSize), 10)},
+		{"merge.level_size_multiplier", strconv.Itoa(m.LevelSizeMultiplier)},
+		{"merge.number_of_sst_files", strconv.Itoa(m.NumberOfSstFiles)},
+		{"merge.time_window", strconv.FormatUint(uint64(m.TimeWindow), 10)},
+	}
+}
+
+// strategyName returns the name a compaction strategy is recorded under in
+// the OPTIONS file.
+func strategyName(s CompactionStrategy) string {
+	switch s.(type) {
+	case nil, *LeveledStrategy:
+		return "leveled"
+	case *SizeTieredStrategy:
+		return "size-tiered"
+	case *TimeWindowStrategy:
+		return "time-window"
+	}
+	return fmt.Sprintf("%T", s)
+}
+
+// parseOptions parses the contents of an OPTIONS file.
+func parseOptions(data []byte) map[string]string {
+	opts := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexByte(line, '='); i > 0 {
+			opts[line[:i]] = line[i+1:]
+		}
+	}
+	return opts
+}
+
+// incompatibleOptions compares the options a tree was last opened with to
+// the new ones, and describes each change that may cause problems with the
+// data already on disk.
+func incompatibleOptions(prev map[string]string, o *Options) []string {
+	var problems []string
+	cur := make(map[string]string)
+	for _, opt := range o.fields() {
+		cur[opt[0]] = opt[1]
+	}
+
+	if s, ok := prev["merge.strategy"]; ok && s != cur["merge.strategy"] {
+		problems = append(problems, fmt.Sprintf(
+			"compaction strategy changed from %s to %s, existing levels may not be merged as expected",
+			s, cur["merge.strategy"]))
+	}
+	if n, err := strconv.Atoi(prev["merge.max_levels"]); err == nil {
+		if o.Merge.MaxLevels > 0 && (n == 0 || o.Merge.MaxLevels < n) {
+			problems = append(problems, fmt.Sprintf(
+				"MaxLevels reduced from %d to %d, data below the last level is no longer merged",
+				n, o.Merge.MaxLevels))
+		}
+	}
+	if d, err := time.ParseDuration(prev["merge.interval"]); err == nil && d > 0 && o.Merge.Interval == 0 {
+		problems = append(problems, "merge interval is no longer set, SST files will not be merged")
+	}
+	return problems
+}
+
+// saveOptions records the options the tree at path is opened with, first
+// warning about any changes from the options it was last opened with that
+// are incompatible with the data on disk.
+func saveOptions(path string, o *Options) error {
+	data, err := ioutil.ReadFile(path + "/" + optionsFilename)
+	if err == nil {
+		for _, problem := range incompatibleOptions(parseOptions(data), o) {
+			o.Logger.Warn("incompatible options", "path", path, "problem", problem)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return replaceFile(path, optionsFilename, o.encode())
+}
@@ -0,0 +1,140 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"github.com/justinethier/keyva/lsm/logger"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-options")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, opts := range []Options{
+		{MemtableSize: -1},
+		{BloomFalsePositiveRate: 0.5},
+		{WalSync: WalSyncSettings{Mode: SyncAlways + 1}},
+		{Merge: MergeSettings{LevelSizeMultiplier: 1}},
+		{MaxImmutableMemtables: -1},
+	} {
+		if _, err := Open(dir, opts); !errors.Is(err, ErrInvalidOptions) {
+			t.Error("Expected ErrInvalidOptions for", opts, "but received", err)
+		}
+	}
+
+	tree, err := Open(dir, Options{MemtableSize: 10000, IndexInterval: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The memtable is full after 9 entries
+	value := []byte(strings.Repeat("v", 1000))
+	for i := 0; i < 25; i++ {
+		if err := tree.Set(mergeTestKey(i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tree.Flush()
+	if n := len(tree.levelFiles(0)); n != 3 {
+		t.Error("Expected 3 SST files but found", n)
+	}
+	if n := len(tree.levelFiles(0)[0].Index); n != 3 {
+		t.Error("Expected index of length 3 but received one of length", n)
+	}
+	tree.Close()
+
+	data, err := ioutil.ReadFile(dir + "/" + optionsFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := parseOptions(data)
+	if saved["memtable_size"] != "10000" || saved["block_size"] != "4096" || saved["merge.strategy"] != "leveled" {
+		t.Error("Unexpected options saved", saved)
+	}
+
+	// Data can be read back when opened with different options
+	tree, err = Open(dir, Options{Merge: MergeSettings{Strategy: &SizeTieredStrategy{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if val, err := tree.Get(mergeTestKey(24)); err != nil || string(val) != string(value) {
+		t.Error("Unexpected value", string(val), err)
+	}
+}
+
+func TestFlushOnCloseOption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-options")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tree, err := Open(dir, Options{FlushOnClose: true, MaxImmutableMemtables: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.maxImmutables != 3 {
+		t.Error("Unexpected maximum immutable memtables", tree.maxImmutables)
+	}
+	tree.Set("a", []byte("1"))
+	tree.Close()
+
+	tree, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if n := len(tree.levelFiles(0)); n != 1 {
+		t.Error("Expected memtable to be flushed on close but found", n, "SST files")
+	}
+	if tree.maxImmutables != defaultMaxImmutables {
+		t.Error("Unexpected maximum immutable memtables", tree.maxImmutables)
+	}
+}
+
+func TestIncompatibleOptions(t *testing.T) {
+	prev := Options{Merge: MergeSettings{MaxLevels: 5, Interval: time.Minute}}
+	prev.validate()
+	saved := parseOptions(prev.encode())
+
+	opts := Options{MemtableSize: 1 << 20, Merge: MergeSettings{MaxLevels: 6, Interval: time.Second}}
+	if problems := incompatibleOptions(saved, &opts); len(problems) != 0 {
+		t.Error("Unexpected problems", problems)
+	}
+	opts = Options{Merge: MergeSettings{Strategy: &TimeWindowStrategy{}, MaxLevels: 3}}
+	if problems := incompatibleOptions(saved, &opts); len(problems) != 3 {
+		t.Error("Expected 3 problems but found", problems)
+	}
+}
+
+func TestOptionsLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-options")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	tree, err := Open(dir, Options{Logger: logger.New(log.New(&buf, "", 0), logger.LevelInfo)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Set("a", []byte("value"))
+	tree.Flush()
+	tree.Close()
+
+	// Debug messages are not logged at the info level
+	out := buf.String()
+	if !strings.Contains(out, "INFO closed lsm tree path="+dir+"\n") || strings.Contains(out, "DEBUG") {
+		t.Error("Unexpected log output", out)
+	}
+}
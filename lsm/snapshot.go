@@ -0,0 +1,80 @@
+package lsm
+
+import (
+	"sort"
+)
+
+// Snapshot provides a consistent, read-only view of an LsmTree as of the
+// moment the snapshot was taken. Writes made afterwards are not visible to
+// the snapshot.
+//
+// Older versions of data are kept in memory and on disk for as long as a
+// snapshot may need them, so a snapshot should be released once it is no
+// longer needed.
+type Snapshot struct {
+	tree     *LsmTree
+	seq      uint64
+	released bool
+}
+
+// Snapshot returns a new snapshot of the current state of the tree.
+func (tree *LsmTree) Snapshot() (*Snapshot, error) {
+	if tree.isClosed() {
+		return nil, ErrClosed
+	}
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	snap := &Snapshot{tree: tree, seq: tree.seq}
+	tree.snapLock.Lock()
+	tree.snapshots[snap.seq]++
+	tree.snapLock.Unlock()
+	return snap, nil
+}
+
+// Get looks up the given key as of the time the snapshot was taken.
+// ErrNotFound is returned if the key did not exist at that time.
+func (snap *Snapshot) Get(k string) ([]byte, error) {
+	if snap.tree.isClosed() {
+		return nil, ErrClosed
+	}
+	snap.tree.lock.Lock()
+	defer snap.tree.lock.Unlock()
+	return snap.tree.get(k, snap.seq, ReadOptions{})
+}
+
+// NewIterator returns an iterator over the contents of the tree as of the
+// time the snapshot was taken.
+func (snap *Snapshot) NewIterator() (*Iterator, error) {
+	return snap.tree.newIterator(snap.seq, ReadOptions{})
+}
+
+// Release frees the snapshot, allowing older versions of data that are no
+// longer needed to be removed by a merge.
+func (snap *Snapshot) Release() {
+	snap.tree.snapLock.Lock()
+	defer snap.tree.snapLock.Unlock()
+
+	if snap.released {
+		return
+	}
+	snap.released = true
+	snap.tree.snapshots[snap.seq]--
+	if snap.tree.snapshots[snap.seq] == 0 {
+		delete(snap.tree.snapshots, snap.seq)
+	}
+}
+
+// liveSnapshots returns the sequence numbers of all unreleased snapshots
+// in ascending order.
+func (tree *LsmTree) liveSnapshots() []uint64 {
+	tree.snapLock.Lock()
+	defer tree.snapLock.Unlock()
+
+	var seqs []uint64
+	for seq := range tree.snapshots {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
@@ -0,0 +1,81 @@
+package lsm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	var N = 100
+	dir, err := ioutil.TempDir("", "keyva-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tbl = newTree(t, dir, 25)
+	defer tbl.Close()
+	for i := 0; i < N; i++ {
+		tbl.Set(fmt.Sprintf("key-%03d", i), []byte("old"))
+	}
+
+	snap, err := tbl.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+
+	// Change every key after the snapshot and push the changes to disk
+	for i := 0; i < N; i++ {
+		if i%2 == 0 {
+			tbl.Set(fmt.Sprintf("key-%03d", i), []byte("new"))
+		} else {
+			tbl.Delete(fmt.Sprintf("key-%03d", i))
+		}
+	}
+	tbl.Set("key-new", []byte("new"))
+	tbl.Merge(0)
+
+	for i := 0; i < N; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		if val, err := snap.Get(key); err != nil || string(val) != "old" {
+			t.Error("Unexpected snapshot value", string(val), err, "for key", key)
+		}
+
+		val, err := tbl.Get(key)
+		if i%2 == 0 && (err != nil || string(val) != "new") {
+			t.Error("Unexpected value", string(val), err, "for key", key)
+		} else if i%2 == 1 && err != ErrNotFound {
+			t.Error("Unexpected value", string(val), "for deleted key", key)
+		}
+	}
+	if _, err := snap.Get("key-new"); err != ErrNotFound {
+		t.Error("Snapshot found key written after it was taken")
+	}
+
+	// Iterator sees the same data as the snapshot
+	it, err := snap.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	count := 0
+	for it.First(); it.Valid(); it.Next() {
+		if string(it.Value()) != "old" {
+			t.Error("Unexpected snapshot value", string(it.Value()), "for key", it.Key())
+		}
+		count++
+	}
+	if count != N {
+		t.Error("Expected", N, "keys in snapshot but found", count)
+	}
+	count = 0
+	for it.Last(); it.Valid(); it.Prev() {
+		count++
+	}
+	if count != N {
+		t.Error("Expected", N, "keys in reverse but found", count)
+	}
+}
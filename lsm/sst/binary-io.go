@@ -1,289 +1,205 @@
 package sst
 
 import (
-	"encoding/binary"
+	"fmt"
 	"github.com/justinethier/keyva/bloom"
 	"io"
-	"log"
 	"os"
-	"unicode/utf8"
+	"strings"
 )
 
-func DumpBin(filename string) {
-	f, err := os.Open(filename)
-	check(err)
-	defer f.Close()
-	entries := readEntries(f)
-	for _, e := range entries {
-		log.Println("Key", e.Key, "Val", e.Value, "Del", e.Deleted)
-	}
-}
+const (
+	// formatLegacy files only store a sequence number for the whole file
+	formatLegacy uint32 = 1
+	// formatEntrySeq files store a sequence number with every entry
+	formatEntrySeq uint32 = 2
+	// formatBlock files are a single file made up of checksummed blocks
+	formatBlock uint32 = 3
+	// formatPrefix files prefix compress the keys of each data block
+	formatPrefix uint32 = 4
+	// formatExpiry files may store an expiry time with each entry
+	formatExpiry uint32 = 5
+)
 
-func DumpIndex(filename string) {
-	f, err := os.Open(filename)
-	check(err)
-	defer f.Close()
-	index, header, err := readIndex(f)
-	log.Println("Header", header)
-	if err == nil {
-		for _, e := range index {
-			log.Println("Key", e.Key, "offset", e.offset)
+// DumpBin writes the contents of the given SST file to w, one entry per
+// line.
+func DumpBin(w io.Writer, filename string) error {
+	entries, _, err := Load(filename)
+	for _, e := range entries {
+		_, werr := fmt.Fprintln(w, "Key", e.Key, "Val", e.Value, "Del", e.Deleted, "Seq", e.Seq, "Expires", e.Expires)
+		if werr != nil {
+			return werr
 		}
 	}
+	return err
 }
 
-// readEntries reads all entries from the given SST file pointer and
-// returns them as an array
-func readEntries(f *os.File) []SstEntry {
-	var lis []SstEntry
-	var err error
-	var e SstEntry
-
-	for err == nil {
-		e, err = readEntry(f)
-		if err == nil {
-			lis = append(lis, e)
+// DumpIndex writes the header and index of the given SST file to w. Either
+// an SST file or a legacy index file may be given.
+func DumpIndex(w io.Writer, filename string) error {
+	if strings.HasSuffix(filename, ".index") {
+		filename = binFileForIndex(filename)
+	}
+	index, header, err := readIndexFile(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(w, "Header", header); err != nil {
+		return err
+	}
+	for _, e := range index {
+		if _, err := fmt.Fprintln(w, "Key", e.Key, "offset", e.offset, "size", e.size); err != nil {
+			return err
 		}
 	}
-	return lis
+	return nil
 }
 
-func readDataBlockEntries(f *os.File, _start int, _end int) []SstEntry {
-	var lis []SstEntry
-	var err error
-	var e SstEntry
-
-	var start, end int64 = int64(_start), int64(_end)
-	offset, err := f.Seek(start, 0)
-	check(err)
-
-	for err == nil {
-		e, err = readEntry(f)
-		if err == nil {
-			lis = append(lis, e)
-		} else if err == io.EOF {
-			break
-		}
-		// Read until we reach the end of the block
-		offset, err = f.Seek(0, 1) // Current position
-		if err == nil && end > 0 && offset >= end {
-			break
-		}
+// writeSst creates an SST file using the given data.
+// seqNum is the sequence number of the latest entry.
+// keysPerIndex is the number of keys that will be stored in each data block.
+func writeSst(filename string, keys []string, m map[string]SstEntry, seqNum uint64, keysPerIndex int) error {
+	entries := make([]SstEntry, 0, len(keys))
+	for _, k := range keys {
+		entries = append(entries, m[k])
 	}
-	return lis
+	return writeSstEntries(filename, entries, seqNum, TableOptions{IndexInterval: keysPerIndex})
 }
 
-// readEntry reads a single entry from the given SST file pointer
-func readEntry(f *os.File) (SstEntry, error) {
-	var length int32
-	var e SstEntry
-
-	err := binary.Read(f, binary.LittleEndian, &length)
+// writeSstEntries creates an SST file from a sorted list of entries. A key
+// may have more than one entry, in which case those entries must be ordered
+// from newest to oldest.
+//
+// All entries for a key are kept in the same data block so an index lookup
+// will always find every version of that key.
+//
+// If an error occurs no file is created.
+func writeSstEntries(filename string, entries []SstEntry, seqNum uint64, opts TableOptions) error {
+	w, err := newTableWriter(sstBaseFilename(filename)+".sst", seqNum, opts)
 	if err != nil {
-		if err != io.EOF {
-			log.Fatal(err)
+		return err
+	}
+	for i := range entries {
+		if err := w.add(&entries[i]); err != nil {
+			w.abort()
+			return err
 		}
-		return e, err
 	}
-	//log.Println("key length", length)
-
-	var keybuf = make([]byte, int(length))
-	_, err = io.ReadFull(f, keybuf)
-	e.Key = string(keybuf)
+	return w.finish()
+}
 
-	// read value length
-	err = binary.Read(f, binary.LittleEndian, &length)
+// syncDir commits the directory entries of the given path to stable
+// storage, so newly created files are not lost after a crash.
+func syncDir(path string) error {
+	d, err := os.Open(path)
 	if err != nil {
-		log.Fatal(err)
-		return e, err
-	}
-	//log.Println("value length", length)
-
-	// read value
-	var valbuf = make([]byte, int(length))
-	_, err = io.ReadFull(f, valbuf)
-	e.Value = valbuf
-
-	err = binary.Read(f, binary.LittleEndian, &e.Deleted)
-	if err != nil && err != io.EOF {
-		log.Fatal(err)
-		return e, err
+		return err
 	}
-	//log.Println("entry", e)
-	return e, nil
+	defer d.Close()
+	return d.Sync()
 }
 
-// writeSst creates an SST file and corresponding index file using the given data.
-// seqNum is the sequence number of the latest entry.
-// keysPerIndex is the number of keys that will be stored for each sparse index.
-func writeSst(filename string, keys []string, m map[string]SstEntry, seqNum uint64, keysPerIndex int) {
-	baseFilename := sstBaseFilename(filename)
-	f, err := os.Create(baseFilename + ".bin")
-	if err != nil {
-		log.Fatal(err)
+// readIndexFile reads the index and header of the given SST file, in
+// either the block format or the legacy format.
+func readIndexFile(filename string) ([]SstIndex, SstFileHeader, error) {
+	if isLegacy(filename) {
+		return readLegacyIndexFile(filename)
 	}
-	defer f.Close()
 
-	findex, err := os.Create(baseFilename + ".index")
+	fp, err := os.Open(filename)
 	if err != nil {
-		log.Fatal(err)
+		return nil, SstFileHeader{}, err
 	}
-	defer findex.Close()
-
-	// write seq header to index file
-	err = binary.Write(findex, binary.LittleEndian, seqNum)
+	defer fp.Close()
 
-	// write every nth entry to index file (sparse index)
-	var offset int = 0
-	for i, k := range keys {
-		var e SstEntry
-		e = m[k]
-		bytes, err := writeEntry(f, &e)
-		if err != nil {
-			log.Fatal(err)
-		}
-		if (i % keysPerIndex) == 0 {
-			writeKeyToIndex(findex, e.Key, offset)
-		}
-		offset += bytes
-	}
+	return readTable(fp)
 }
 
-func readIndexFile(filename string) ([]SstIndex, SstFileHeader, error) {
-	indexFilename := indexFileForBin(filename)
-	fp, err := os.Open(indexFilename)
+// NewSstFile reads the index and bloom filter of the given SST file so it
+// can be searched. Files that do not contain a filter, such as legacy
+// files, are read in full to build one.
+func NewSstFile(path string, filename string) (SstFile, error) {
+	index, header, err := readIndexFile(path + "/" + filename)
 	if err != nil {
-		log.Fatal(err)
+		return SstFile{}, err
 	}
-	defer fp.Close()
-
-	return readIndex(fp)
-}
-
-// readIndex reads and returns the contents of the given SST index file pointer.
-func readIndex(f *os.File) ([]SstIndex, SstFileHeader, error) {
-	var header SstFileHeader
-	var index []SstIndex
-	err := binary.Read(f, binary.LittleEndian, &header.Seq)
+	filter, err := readFilterFile(path + "/" + filename)
 	if err != nil {
-		log.Fatal(err)
-		return index, header, err
+		return SstFile{}, err
 	}
-
-	var length int32
-	for err == nil {
-		var entry SstIndex
-		// read key length
-		err = binary.Read(f, binary.LittleEndian, &length)
+	if filter == nil {
+		entries, _, err := Load(path + "/" + filename)
 		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				log.Fatal(err)
-			}
+			return SstFile{}, err
 		}
-		// read key
-		var keybuf = make([]byte, int(length))
-		_, err = io.ReadFull(f, keybuf)
-		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				log.Fatal(err)
-			}
+		filter = bloom.New(len(entries), filterRate)
+		for _, e := range entries {
+			filter.Add(e.Key)
 		}
-		entry.Key = string(keybuf)
-
-		//read offset
-		err = binary.Read(f, binary.LittleEndian, &length)
-		if err != nil {
-			if err != io.EOF {
-				log.Fatal(err)
-			}
+		if len(entries) > 0 && header.Version < formatBlock {
+			header.Entries = uint64(len(entries))
+			header.Smallest = entries[0].Key
+			header.Largest = entries[len(entries)-1].Key
 		}
-		entry.offset = int(length)
-
-		index = append(index, entry)
-	}
-
-	return index, header, nil
-}
-
-// writeKeyToIndex writes a sparse index to the given SST index file pointer.
-// key is the SST key that is being written as a sparse index.
-// offset is the byte offset of the key in the corresponding SST file.
-func writeKeyToIndex(f *os.File, key string, offset int) error {
-	// key length
-	var bytes int32 = int32(utf8.RuneCountInString(key))
-	err := binary.Write(f, binary.LittleEndian, bytes)
-	if err != nil {
-		log.Fatal(err)
-		return err
 	}
-	// key
-	_, err = f.WriteString(key)
+	size, err := fileSize(path + "/" + filename)
 	if err != nil {
-		log.Fatal(err)
-		return err
+		return SstFile{}, err
 	}
-	// offset
-	err = binary.Write(f, binary.LittleEndian, int32(offset))
-	if err != nil {
-		log.Fatal(err)
-		return err
+	if header.Time == 0 {
+		header.Time, err = modTime(path + "/" + filename)
+		if err != nil {
+			return SstFile{}, err
+		}
 	}
-	return nil
+	return SstFile{Filename: filename, Header: header, Filter: filter, Index: index,
+		Smallest: header.Smallest, Largest: header.Largest, Size: size,
+		id: newFileId()}, nil
 }
 
-// writeEntry writes data for a single key/value pair to file
-func writeEntry(f *os.File, data *SstEntry) (int, error) {
-	var bcount int = 0
-	var bytes int32 = int32(utf8.RuneCountInString(data.Key))
-
-	err := binary.Write(f, binary.LittleEndian, bytes)
+// modTime returns the time an SST file was last modified, for files that
+// do not record when their data was written.
+func modTime(filename string) (int64, error) {
+	fi, err := os.Stat(filename)
 	if err != nil {
-		log.Fatal(err)
-		return bcount, err
+		return 0, err
 	}
-	bcount += 4
+	return fi.ModTime().Unix(), nil
+}
 
-	numBytes, err := f.WriteString(data.Key)
+// fileSize returns the size of an SST file on disk, including the index
+// file of a legacy SST file.
+func fileSize(filename string) (int64, error) {
+	fi, err := os.Stat(filename)
 	if err != nil {
-		log.Fatal(err)
-		return bcount, err
+		return 0, err
 	}
-	bcount += numBytes
-	//log.Printf("bytes = %d, numBytes = %d", bytes, numBytes)
+	size := fi.Size()
+	if isLegacy(filename) {
+		fi, err = os.Stat(indexFileForBin(filename))
+		if err != nil {
+			return 0, err
+		}
+		size += fi.Size()
+	}
+	return size, nil
+}
 
-	bytes = int32(len(data.Value))
-	err = binary.Write(f, binary.LittleEndian, bytes)
-	if err != nil {
-		log.Fatal(err)
-		return bcount, err
+// readFilterFile reads the bloom filter of the given SST file, if it has one.
+func readFilterFile(filename string) (*bloom.Filter, error) {
+	if isLegacy(filename) {
+		return nil, nil
 	}
-	bcount += 4
 
-	numBytes, err = f.Write(data.Value)
+	fp, err := os.Open(filename)
 	if err != nil {
-		log.Fatal(err)
-		return bcount, err
+		return nil, err
 	}
-	bcount += numBytes
-	//log.Printf("bytes = %d, numBytes = %d", bytes, numBytes)
+	defer fp.Close()
 
-	err = binary.Write(f, binary.LittleEndian, data.Deleted)
+	filter, err := readFilter(fp)
 	if err != nil {
-		log.Fatal(err)
-		return bcount, err
+		return nil, fmt.Errorf("%s: %w", filename, err)
 	}
-	bcount += 1
-
-	return bcount, nil
-}
-
-func NewSstFile(path string, filename string, filter *bloom.Filter) SstFile {
-	index, _, err := readIndexFile(path + "/" + filename)
-	check(err)
-	cache := make([]SstIndexData, len(index))
-	return SstFile{filename, filter, index, cache}
+	return filter, nil
 }
@@ -2,11 +2,15 @@ package sst
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"strconv"
 	"testing"
+	"unicode/utf8"
 )
 
 func TestBinary(t *testing.T) {
@@ -16,49 +20,52 @@ func TestBinary(t *testing.T) {
 	for i := 0; i < 10; i++ {
 		key := "Key " + strconv.Itoa(i)
 		keys = append(keys, key)
-		m[key] = SstEntry{key, []byte("Test Value " + key), false}
+		m[key] = SstEntry{key, []byte("Test Value " + key), false, uint64(i), 0}
 	}
 
-	writeSst("mytest", keys, m, uint64(10), 3)
+	check(writeSst("mytest", keys, m, uint64(10), 3))
 }
 
 func TestBinaryRead(t *testing.T) {
-	f, err := os.Open("mytest.bin")
+	f, err := os.Open("mytest.sst")
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer f.Close()
 
-	findex, err := os.Open("mytest.index")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer findex.Close()
-
-	// validate index file contents
-	index, header, err := readIndex(findex)
+	// validate index and properties
+	index, header, err := readTable(f)
+	check(err)
 	if len(index) != 4 {
 		t.Error("Expected index of length 4 but received one of length", len(index))
 	}
-	if header.Seq != uint64(10) {
-		t.Error("Unexpected sequence number", header.Seq)
+	if header.Version != formatExpiry || header.Seq != uint64(10) || header.Entries != 10 {
+		t.Error("Unexpected header", header)
+	}
+	if header.Smallest != "Key 0" || header.Largest != "Key 9" {
+		t.Error("Unexpected key range", header.Smallest, header.Largest)
 	}
 
-	// Validate contents of index
+	// Validate contents of index, blocks are written back to back
+	offset := 0
 	for i, e := range index {
 		key := "Key " + strconv.Itoa(i*3)
 		if key != e.Key {
 			t.Error("Expected index key", key, "but received", e.Key)
 		}
-		offset := i * 90
 		if offset != e.offset {
 			t.Error("Expected index offset", offset, "but received", e.offset)
 		}
+		offset += e.size + blockTrailerSize
 	}
 
 	// Validate contents of SST
-	lis := readEntries(f)
+	lis, _, err := Load("mytest.sst")
+	check(err)
 	log.Println("read entries", len(lis))
+	if len(lis) != 10 {
+		t.Error("Expected 10 entries but received", len(lis))
+	}
 	for i, e := range lis {
 		key := "Key " + strconv.Itoa(i)
 		if key != e.Key {
@@ -70,10 +77,13 @@ func TestBinaryRead(t *testing.T) {
 		if e.Deleted != false {
 			t.Error("Unexpected deleted flag", e.Deleted)
 		}
+		if e.Seq != uint64(i) {
+			t.Error("Unexpected sequence number", e.Seq)
+		}
 	}
 
-	files := []string{"mytest.bin"}
-	tmpdir, _ := Compact(files, ".", 40, 2, false)
+	files := []string{"mytest.sst"}
+	tmpdir, _ := Compact(files, ".", 40, 2, false, nil, nil)
 	log.Println("Compacted to", tmpdir)
 }
 
@@ -84,16 +94,13 @@ func TestSparseIndex(t *testing.T) {
 	for i := 0; i < 100; i++ {
 		key := fmt.Sprintf("Key %03d", i) // Print such that alpha/numeric sorts are the same
 		keys = append(keys, key)
-		m[key] = SstEntry{key, []byte("Test Value " + key), false}
+		m[key] = SstEntry{key, []byte("Test Value " + key), false, uint64(i), 0}
 	}
 
-	writeSst("mytest2", keys, m, uint64(100), 5)
+	check(writeSst("mytest2", keys, m, uint64(100), 5))
 
-	findex, err := os.Open("mytest2.index")
+	index, header, err := readIndexFile("mytest2.sst")
 	check(err)
-	defer findex.Close()
-
-	index, header, err := readIndex(findex)
 	if len(index) != 20 {
 		t.Error("Expected index of length 20 but received one of length", len(index))
 	}
@@ -101,25 +108,330 @@ func TestSparseIndex(t *testing.T) {
 		t.Error("Unexpected sequence number", header.Seq)
 	}
 
-	thisIndex, nextIndex, idx, found := findBlock("Key 010", index)
+	thisIndex, nextIndex, idx, found := findBlock("Key 012", index)
 	if !found {
 		t.Error("Sparse key not found")
 	}
 	if idx != 2 {
 		t.Error("Unexpected sparse index block", idx)
 	}
-	if thisIndex.offset != 340 {
-		t.Error("Unexpected found index offset", thisIndex.offset, thisIndex.Key)
-	}
-	if nextIndex.offset != 510 {
-		t.Error("Unexpected next index offset", nextIndex.offset, nextIndex.Key)
+	if thisIndex.Key != "Key 010" || nextIndex.Key != "Key 015" {
+		t.Error("Unexpected index keys", thisIndex.Key, nextIndex.Key)
 	}
 
-	fbin, err := os.Open("mytest2.bin")
+	entries, err := LoadBlock("mytest2.sst", header, index, idx)
 	check(err)
-	defer fbin.Close()
-	entries := readDataBlockEntries(fbin, 340, 510)
 	if len(entries) != 5 {
 		t.Error("Expected", 5, "entries in data block but received", len(entries))
 	}
+	if entries[0].Key != "Key 010" {
+		t.Error("Unexpected first key in data block", entries[0].Key)
+	}
+}
+
+func TestCorruptEntry(t *testing.T) {
+	var keys []string
+	m := make(map[string]SstEntry)
+	for i := 0; i < 10; i++ {
+		key := "Key " + strconv.Itoa(i)
+		keys = append(keys, key)
+		m[key] = SstEntry{key, []byte("Test Value " + key), false, uint64(i), 0}
+	}
+	check(writeSst("mytest3", keys, m, uint64(10), 3))
+
+	// Cut the footer short
+	fi, err := os.Stat("mytest3.sst")
+	check(err)
+	check(os.Truncate("mytest3.sst", fi.Size()-3))
+
+	_, _, err = Load("mytest3.sst")
+	if !errors.Is(err, ErrCorrupt) {
+		t.Error("Expected ErrCorrupt but received", err)
+	}
+	if _, err = Repair("mytest3.sst"); !errors.Is(err, ErrCorrupt) {
+		t.Error("Expected ErrCorrupt from Repair but received", err)
+	}
+
+	_, _, err = Load("mytest-does-not-exist.sst")
+	if !os.IsNotExist(err) {
+		t.Error("Expected file not found error but received", err)
+	}
+}
+
+// Test that a corrupt data block is detected and can be removed by Repair
+func TestCorruptBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-sst")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	var keys []string
+	m := make(map[string]SstEntry)
+	for i := 0; i < 9; i++ {
+		key := "Key " + strconv.Itoa(i)
+		keys = append(keys, key)
+		m[key] = SstEntry{key, []byte("Test Value " + key), false, uint64(i), 0}
+	}
+	filename := dir + "/sst-0000.sst"
+	check(writeSst(filename, keys, m, uint64(9), 3))
+
+	// Flip a bit in the middle block
+	index, header, err := readIndexFile(filename)
+	check(err)
+	data, err := ioutil.ReadFile(filename)
+	check(err)
+	data[index[1].offset+index[1].size/2] ^= 1
+	check(ioutil.WriteFile(filename, data, 0644))
+
+	if _, err := LoadBlock(filename, header, index, 0); err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if _, err := LoadBlock(filename, header, index, 1); !errors.Is(err, ErrCorrupt) {
+		t.Error("Expected ErrCorrupt but received", err)
+	}
+	if _, _, err := Load(filename); !errors.Is(err, ErrCorrupt) {
+		t.Error("Expected ErrCorrupt but received", err)
+	}
+
+	dropped, err := Repair(filename)
+	check(err)
+	if dropped != 1 {
+		t.Error("Expected one block to be dropped but received", dropped)
+	}
+	entries, header, err := Load(filename)
+	check(err)
+	if len(entries) != 6 || header.Seq != 9 {
+		t.Error("Unexpected contents after repair", entries, header)
+	}
+	for _, e := range entries {
+		if e.Key == "Key 3" || e.Key == "Key 4" || e.Key == "Key 5" {
+			t.Error("Found key from corrupt block", e.Key)
+		}
+	}
+}
+
+func TestMultibyteKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-sst")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	keys := []string{"a", "café", "ключ", "鍵", "🔑"}
+	m := make(map[string]SstEntry)
+	for i, k := range keys {
+		m[k] = SstEntry{k, []byte(k), false, uint64(i), 0}
+	}
+	filename := dir + "/sst-0000.sst"
+	check(writeSst(filename, keys, m, uint64(5), 2))
+
+	entries, _, err := Load(filename)
+	check(err)
+	if len(entries) != len(keys) {
+		t.Fatal("Expected", len(keys), "entries but received", len(entries))
+	}
+	for i, e := range entries {
+		if e.Key != keys[i] || string(e.Value) != keys[i] {
+			t.Error("Expected key", keys[i], "but received", e.Key)
+		}
+	}
+}
+
+// writeLegacyKey encodes a key the way legacy files did, with the length
+// given as a number of runes.
+func writeLegacyKey(buf *bytes.Buffer, key string) {
+	binary.Write(buf, binary.LittleEndian, int32(utf8.RuneCountInString(key)))
+	buf.WriteString(key)
+}
+
+// Test that legacy files can still be read, including multibyte keys
+func TestLegacyFormat(t *testing.T) {
+	entries, header, err := Load("test-data/sst-0000.bin")
+	check(err)
+	if header.Version != formatLegacy || len(entries) != 6 {
+		t.Error("Unexpected contents of version 1 file", header, entries)
+	}
+	for _, e := range entries {
+		if e.Seq != header.Seq {
+			t.Error("Expected entry to have sequence number of file", e)
+		}
+	}
+	entries, header, err = Load("test-data/compacted.bin")
+	check(err)
+	if header.Version != formatEntrySeq || len(entries) != 12 {
+		t.Error("Unexpected contents of version 2 file", header, entries)
+	}
+
+	dir, err := ioutil.TempDir("", "keyva-sst")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	var bin, idx bytes.Buffer
+	idx.Write(indexMagic[:])
+	binary.Write(&idx, binary.LittleEndian, formatEntrySeq)
+	binary.Write(&idx, binary.LittleEndian, uint64(2))
+	for i, k := range []string{"ключ", "鍵"} {
+		writeLegacyKey(&idx, k)
+		binary.Write(&idx, binary.LittleEndian, int32(bin.Len()))
+		writeLegacyKey(&bin, k)
+		binary.Write(&bin, binary.LittleEndian, int32(len(k)))
+		bin.WriteString(k)
+		binary.Write(&bin, binary.LittleEndian, false)
+		binary.Write(&bin, binary.LittleEndian, uint64(i+1))
+	}
+	filename := dir + "/sst-0000.bin"
+	check(ioutil.WriteFile(filename, bin.Bytes(), 0644))
+	check(ioutil.WriteFile(dir+"/sst-0000.index", idx.Bytes(), 0644))
+
+	index, header, err := readIndexFile(filename)
+	check(err)
+	if len(index) != 2 || index[1].Key != "鍵" {
+		t.Error("Unexpected index", index)
+	}
+	entries, err = LoadBlock(filename, header, index, 1)
+	check(err)
+	if len(entries) != 1 || entries[0].Key != "鍵" || entries[0].Seq != 2 {
+		t.Error("Unexpected entries", entries)
+	}
+
+	// Repair converts the file to the block format
+	_, err = Repair(filename)
+	check(err)
+	if files := Filenames(dir); len(files) != 1 || files[0] != "sst-0000.sst" {
+		t.Error("Unexpected files after repair", files)
+	}
+	entries, _, err = Load(dir + "/sst-0000.sst")
+	check(err)
+	if len(entries) != 2 || entries[0].Key != "ключ" || string(entries[1].Value) != "鍵" {
+		t.Error("Unexpected entries", entries)
+	}
+}
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func TestFilterBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-sst")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	var keys []string
+	m := make(map[string]SstEntry)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("Key %03d", i)
+		keys = append(keys, key)
+		m[key] = SstEntry{key, []byte("Test Value " + key), false, uint64(i), 0}
+	}
+	check(writeSst(dir+"/sst-0000.sst", keys, m, uint64(100), 10))
+
+	// The filter is stored in the file
+	filter, err := readFilterFile(dir + "/sst-0000.sst")
+	check(err)
+	if filter == nil {
+		t.Fatal("Expected file to contain a filter")
+	}
+	if filter.Count() != 100 {
+		t.Error("Unexpected filter count", filter.Count())
+	}
+
+	sstf, err := NewSstFile(dir, "sst-0000.sst")
+	check(err)
+	for _, k := range keys {
+		if !sstf.Filter.Test(k) {
+			t.Error("Expected filter to contain key", k)
+		}
+	}
+	if sstf.Filter.Test("missing") {
+		t.Error("Unexpected key in filter")
+	}
+
+	// Legacy files have a filter built from their contents
+	sstf, err = NewSstFile("test-data", "sst-0000.bin")
+	check(err)
+	if !sstf.Filter.Test("1") || sstf.Filter.Count() != 6 {
+		t.Error("Unexpected filter for legacy file", sstf.Filter.Count())
+	}
+}
+
+func TestFilenames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-sst")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	for _, f := range []string{"sst-9999.sst", "sst-10000.sst", "sst-0002.bin", "sst-01.sst"} {
+		check(ioutil.WriteFile(dir+"/"+f, nil, 0644))
+	}
+	files := Filenames(dir)
+	if len(files) != 3 || files[0] != "sst-0002.bin" || files[2] != "sst-10000.sst" {
+		t.Error("Unexpected files", files)
+	}
+	if next, err := NextFilename(dir); err != nil || next != "sst-10001.sst" {
+		t.Error("Unexpected next filename", next, err)
+	}
+}
+
+func TestTableOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-sst")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	var entries []SstEntry
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("Key %03d", i)
+		entries = append(entries, SstEntry{key, bytes.Repeat([]byte("v"), 100), false, uint64(i), 0})
+	}
+
+	// Blocks are finished early once they are full
+	opts := TableOptions{IndexInterval: 20, BlockSize: 250, FilterRate: 1000}
+	check(CreateWithOptions(dir+"/sst-0000.sst", entries, 100, opts))
+	index, _, err := readIndexFile(dir + "/sst-0000.sst")
+	check(err)
+	if len(index) != 34 {
+		t.Error("Expected index of length 34 but received one of length", len(index))
+	}
+	opts.BlockSize = 0
+	check(CreateWithOptions(dir+"/sst-0001.sst", entries, 100, opts))
+	index, _, err = readIndexFile(dir + "/sst-0001.sst")
+	check(err)
+	if len(index) != 5 {
+		t.Error("Expected index of length 5 but received one of length", len(index))
+	}
+
+	// New files are started once the current one is large enough
+	tmpDir, err := CompactWithOptions([]string{dir + "/sst-0000.sst"}, dir, CompactOptions{FileSize: 4000, Table: opts})
+	check(err)
+	files := Filenames(tmpDir)
+	if len(files) != 3 {
+		t.Error("Expected 3 files but found", files)
+	}
+	n := 0
+	for _, f := range files {
+		loaded, _, err := Load(tmpDir + "/" + f)
+		check(err)
+		n += len(loaded)
+	}
+	if n != len(entries) {
+		t.Error("Unexpected number of entries", n)
+	}
+}
+
+func TestDump(t *testing.T) {
+	var buf bytes.Buffer
+	if err := DumpBin(&buf, "mytest.sst"); err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(buf.Bytes(), []byte("\n")); n != 10 {
+		t.Error("Expected 10 entries but received", n, buf.String())
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("Key Key 0 Val")) {
+		t.Error("Unexpected output", buf.String())
+	}
+
+	buf.Reset()
+	if err := DumpIndex(&buf, "mytest.sst"); err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(buf.Bytes(), []byte("\n")); n != 5 || !bytes.HasPrefix(buf.Bytes(), []byte("Header")) {
+		t.Error("Expected a header and 4 index entries but received", buf.String())
+	}
 }
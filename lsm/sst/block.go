@@ -0,0 +1,260 @@
+package sst
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Data blocks in formatPrefix files store each key as the length of the
+// prefix it shares with the previous key, followed by the rest of the key:
+//
+//   shared   uvarint   Number of bytes shared with the previous key
+//   unshared uvarint   Number of bytes that follow
+//   valueLen uvarint
+//   key      [unshared]byte
+//   value    [valueLen]byte
+//   flags    uint8     entryDeleted and entryExpires
+//   seq      uint64
+//   expires  int64     Only present if flags has entryExpires set
+//
+// Only files in formatExpiry or later set entryExpires.
+//
+// Every restartInterval entries the full key is stored, so shared is zero.
+// These restart points are listed at the end of the block:
+//
+//   restarts    [n]uint32   Offset of each restart point in the block
+//   numRestarts uint32
+//
+// The restart points are in key order, so a lookup can binary search them
+// and then only decode the entries following a single restart point.
+
+// restartInterval is the number of entries between restart points
+const restartInterval = 16
+
+// Flags of an entry in a data block
+const (
+	entryDeleted = 1 << 0
+	entryExpires = 1 << 1
+)
+
+// blockBuilder encodes the entries of a data block.
+type blockBuilder struct {
+	buf      []byte
+	restarts []uint32
+	counter  int // Entries since the last restart point
+	lastKey  string
+}
+
+// add appends an entry to the block. Entries must be added in sorted order.
+func (b *blockBuilder) add(e *SstEntry) {
+	shared := 0
+	if len(b.buf) == 0 || b.counter >= restartInterval {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+		b.counter = 0
+	} else {
+		for shared < len(b.lastKey) && shared < len(e.Key) && b.lastKey[shared] == e.Key[shared] {
+			shared++
+		}
+	}
+	b.buf = appendUvarint(b.buf, uint64(shared))
+	b.buf = appendUvarint(b.buf, uint64(len(e.Key)-shared))
+	b.buf = appendUvarint(b.buf, uint64(len(e.Value)))
+	b.buf = append(b.buf, e.Key[shared:]...)
+	b.buf = append(b.buf, e.Value...)
+	var flags uint8
+	if e.Deleted {
+		flags |= entryDeleted
+	}
+	if e.Expires != 0 {
+		flags |= entryExpires
+	}
+	b.buf = append(b.buf, flags)
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], e.Seq)
+	b.buf = append(b.buf, tmp[:]...)
+	if e.Expires != 0 {
+		binary.LittleEndian.PutUint64(tmp[:], uint64(e.Expires))
+		b.buf = append(b.buf, tmp[:]...)
+	}
+	b.counter++
+	b.lastKey = e.Key
+}
+
+// empty returns true if no entries have been added since the block was
+// last reset.
+func (b *blockBuilder) empty() bool {
+	return len(b.buf) == 0
+}
+
+// size returns the number of bytes of entries added to the block.
+func (b *blockBuilder) size() int {
+	return len(b.buf)
+}
+
+// finish appends the restart points and returns the contents of the block.
+// The contents are only valid until reset is called.
+func (b *blockBuilder) finish() []byte {
+	var tmp [4]byte
+	for _, r := range b.restarts {
+		binary.LittleEndian.PutUint32(tmp[:], r)
+		b.buf = append(b.buf, tmp[:]...)
+	}
+	binary.LittleEndian.PutUint32(tmp[:], uint32(len(b.restarts)))
+	return append(b.buf, tmp[:]...)
+}
+
+// reset clears the builder so it can be used for the next block.
+func (b *blockBuilder) reset() {
+	b.buf = b.buf[:0]
+	b.restarts = b.restarts[:0]
+	b.counter = 0
+	b.lastKey = ""
+}
+
+// dataBlock is a data block read from an SST file. Blocks with restart
+// points are kept in their encoded form and decoded as needed, blocks in
+// older formats are decoded in full when they are read.
+type dataBlock struct {
+	data     []byte   // Encoded entries, not including the restart points
+	restarts []uint32 // Offset of each restart point in data
+	entries  []SstEntry
+}
+
+// newDataBlock parses the restart points of an encoded data block.
+func newDataBlock(buf []byte) (*dataBlock, error) {
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("%w: data block too short", ErrCorrupt)
+	}
+	n := uint64(binary.LittleEndian.Uint32(buf[len(buf)-4:]))
+	if n == 0 || n*4+4 > uint64(len(buf)) {
+		return nil, fmt.Errorf("%w: invalid number of restart points %d", ErrCorrupt, n)
+	}
+	end := len(buf) - int(n)*4 - 4
+	b := &dataBlock{data: buf[:end], restarts: make([]uint32, n)}
+	for i := range b.restarts {
+		b.restarts[i] = binary.LittleEndian.Uint32(buf[end+i*4:])
+		if b.restarts[i] >= uint32(end) || (i > 0 && b.restarts[i] <= b.restarts[i-1]) {
+			return nil, fmt.Errorf("%w: invalid restart point %d", ErrCorrupt, b.restarts[i])
+		}
+	}
+	return b, nil
+}
+
+// size approximates the memory used by the block.
+func (b *dataBlock) size() int64 {
+	size := int64(len(b.data) + len(b.restarts)*4)
+	for i := range b.entries {
+		size += int64(len(b.entries[i].Key) + len(b.entries[i].Value) + entryOverhead)
+	}
+	return size
+}
+
+// entryAt decodes the entry at offset off of the block, given the key of the
+// entry before it. The value of the returned entry refers to the contents of
+// the block. Returns the offset of the next entry.
+func (b *dataBlock) entryAt(off int, prevKey string) (SstEntry, int, error) {
+	var e SstEntry
+	var lens [3]uint64 // shared, unshared and value lengths
+	buf := b.data[off:]
+	for i := range lens {
+		var n int
+		lens[i], n = binary.Uvarint(buf)
+		if n <= 0 {
+			return e, 0, fmt.Errorf("%w: invalid entry at offset %d of data block", ErrCorrupt, off)
+		}
+		buf = buf[n:]
+	}
+	shared, unshared, valueLen := lens[0], lens[1], lens[2]
+	if shared > uint64(len(prevKey)) || unshared > uint64(len(buf)) ||
+		uint64(len(buf))-unshared < 9 || valueLen > uint64(len(buf))-unshared-9 {
+		return e, 0, fmt.Errorf("%w: invalid entry at offset %d of data block", ErrCorrupt, off)
+	}
+	e.Key = prevKey[:shared] + string(buf[:unshared])
+	buf = buf[unshared:]
+	e.Value = buf[:valueLen:valueLen]
+	flags := buf[valueLen]
+	e.Deleted = flags&entryDeleted != 0
+	e.Seq = binary.LittleEndian.Uint64(buf[valueLen+1:])
+	size := int(valueLen) + 9
+	if flags&entryExpires != 0 {
+		if len(buf) < size+8 {
+			return e, 0, fmt.Errorf("%w: invalid entry at offset %d of data block", ErrCorrupt, off)
+		}
+		e.Expires = int64(binary.LittleEndian.Uint64(buf[size:]))
+		size += 8
+	}
+	return e, len(b.data) - len(buf) + size, nil
+}
+
+// restartKey returns the key of restart point i.
+func (b *dataBlock) restartKey(i int) (string, error) {
+	e, _, err := b.entryAt(int(b.restarts[i]), "")
+	return e.Key, err
+}
+
+// decode returns every entry in the block.
+func (b *dataBlock) decode() ([]SstEntry, error) {
+	if b.restarts == nil {
+		return b.entries, nil
+	}
+	var entries []SstEntry
+	prevKey := ""
+	for off := 0; off < len(b.data); {
+		e, next, err := b.entryAt(off, prevKey)
+		if err != nil {
+			return nil, err
+		}
+		e.Value = append([]byte(nil), e.Value...)
+		entries = append(entries, e)
+		prevKey = e.Key
+		off = next
+	}
+	return entries, nil
+}
+
+// find returns the most recent entry for key that is visible at sequence
+// number seq, if the block contains one. Only the entries that follow the
+// closest restart point before key are decoded.
+func (b *dataBlock) find(key string, seq uint64) (SstEntry, bool, error) {
+	if b.restarts == nil {
+		entry, found := findValue(key, seq, b.entries)
+		return entry, found, nil
+	}
+
+	// Find the first restart point with a key at or after key. Earlier
+	// versions of key may be stored before it, so start from the one before.
+	left, right := 0, len(b.restarts)
+	for left < right {
+		mid := left + (right-left)/2
+		k, err := b.restartKey(mid)
+		if err != nil {
+			return SstEntry{}, false, err
+		}
+		if k < key {
+			left = mid + 1
+		} else {
+			right = mid
+		}
+	}
+	if left > 0 {
+		left--
+	}
+
+	prevKey := ""
+	for off := int(b.restarts[left]); off < len(b.data); {
+		e, next, err := b.entryAt(off, prevKey)
+		if err != nil {
+			return SstEntry{}, false, err
+		}
+		if e.Key > key {
+			break
+		}
+		if e.Key == key && e.Seq <= seq {
+			e.Value = append([]byte(nil), e.Value...)
+			return e, true, nil
+		}
+		prevKey = e.Key
+		off = next
+	}
+	return SstEntry{}, false, nil
+}
@@ -0,0 +1,98 @@
+package sst
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestPrefixBlock(t *testing.T) {
+	var b blockBuilder
+	var entries []SstEntry
+	var size int
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("/kv/tenant-42/orders/%05d", i*2)
+		// Every third key has an older version that crosses restart points
+		versions := 1 + i%3
+		// Some entries have an expiry time
+		var expires int64
+		if i%5 == 0 {
+			expires = int64(i+1) * 1e9
+		}
+		for v := versions; v > 0; v-- {
+			e := SstEntry{key, []byte(fmt.Sprintf("%d.%d", i, v)), v == 2, uint64(v * 10), expires}
+			b.add(&e)
+			entries = append(entries, e)
+			size += len(e.Key)
+		}
+	}
+	block, err := newDataBlock(append([]byte(nil), b.finish()...))
+	check(err)
+	if len(block.restarts) != (len(entries)+restartInterval-1)/restartInterval {
+		t.Error("Unexpected number of restart points", len(block.restarts))
+	}
+	if len(block.data) > size {
+		t.Error("Expected keys to be prefix compressed, block size", len(block.data), "keys", size)
+	}
+
+	decoded, err := block.decode()
+	check(err)
+	if len(decoded) != len(entries) {
+		t.Fatal("Unexpected number of entries", len(decoded))
+	}
+	for i, e := range decoded {
+		if e.Key != entries[i].Key || string(e.Value) != string(entries[i].Value) ||
+			e.Deleted != entries[i].Deleted || e.Seq != entries[i].Seq || e.Expires != entries[i].Expires {
+			t.Error("Unexpected entry", e, "expected", entries[i])
+		}
+	}
+
+	for _, e := range entries {
+		found, ok, err := block.find(e.Key, e.Seq)
+		check(err)
+		if !ok || found.Seq != e.Seq || string(found.Value) != string(e.Value) {
+			t.Error("Unexpected result", found, ok, "finding", e)
+		}
+	}
+	for _, key := range []string{"/kv", "/kv/tenant-42/orders/00001", "/kv/tenant-42/orders/00099", "/kv/z"} {
+		if e, ok, err := block.find(key, math.MaxUint64); ok || err != nil {
+			t.Error("Unexpected result", e, err, "finding", key)
+		}
+	}
+	// Versions newer than seq are skipped
+	if e, ok, _ := block.find("/kv/tenant-42/orders/00004", 25); !ok || e.Seq != 20 {
+		t.Error("Unexpected result", e, ok)
+	}
+	if _, ok, _ := block.find("/kv/tenant-42/orders/00004", 5); ok {
+		t.Error("Expected no version visible at seq 5")
+	}
+
+	// Restart points must be within the block
+	buf := b.finish()
+	binary.LittleEndian.PutUint32(buf[len(buf)-8:], uint32(len(buf)))
+	if _, err := newDataBlock(buf); !errors.Is(err, ErrCorrupt) {
+		t.Error("Expected ErrCorrupt for invalid restart point", err)
+	}
+}
+
+func TestBlockFormat(t *testing.T) {
+	// Files written before keys were prefix compressed can still be read
+	entries, header, err := Load("test-data/format3.sst")
+	check(err)
+	if header.Version != formatBlock || len(entries) != 12 {
+		t.Error("Unexpected contents of version 3 file", header, entries)
+	}
+
+	sstf, err := NewSstFile("test-data", "format3.sst")
+	check(err)
+	lvl := []SstLevel{{Files: []SstFile{sstf}}}
+	for _, e := range entries {
+		found, ok, err := FindEntry(e.Key, math.MaxUint64, lvl, "test-data", nil, false, nil)
+		check(err)
+		if !ok || found.Seq != e.Seq || string(found.Value) != string(e.Value) {
+			t.Error("Unexpected result", found, ok, "finding", e)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package sst
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// entryOverhead approximates the memory used by an SstEntry in addition to
+// its key and value.
+const entryOverhead = 64
+
+// nextFileId is used to give each open SST file a unique id, so blocks of a
+// file are never confused with those of a file later written with the same
+// name.
+var nextFileId uint64
+
+// CacheStats describes the current state of a BlockCache.
+type CacheStats struct {
+	Hits     uint64 // Number of reads that found their block in the cache
+	Misses   uint64 // Number of reads that had to load their block from disk
+	Blocks   int    // Number of blocks in the cache
+	Size     int64  // Approximate size of the cached blocks in bytes
+	Capacity int64  // Maximum size of the cache in bytes
+}
+
+// BlockCache holds recently used data blocks in memory so they do not have
+// to be read from disk again. Once the cache grows past its capacity the
+// least recently used blocks are evicted. A BlockCache may be shared by any
+// number of SST files and is safe for concurrent use.
+//
+// A nil *BlockCache is valid and caches nothing.
+type BlockCache struct {
+	lock     sync.Mutex
+	capacity int64
+	size     int64
+	blocks   map[blockCacheKey]*list.Element
+	lru      *list.List // Most recently used block at the front
+	hits     uint64
+	misses   uint64
+}
+
+type blockCacheKey struct {
+	file uint64 // SstFile.id
+	idx  int    // Position of the block in the file's index
+}
+
+type cachedBlock struct {
+	key   blockCacheKey
+	block *dataBlock
+	size  int64
+}
+
+// NewBlockCache creates a cache that holds up to capacity bytes of blocks.
+func NewBlockCache(capacity int64) *BlockCache {
+	return &BlockCache{
+		capacity: capacity,
+		blocks:   make(map[blockCacheKey]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// SetCapacity changes the maximum size of the cache in bytes, evicting
+// blocks if necessary.
+func (c *BlockCache) SetCapacity(capacity int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.capacity = capacity
+	c.evict()
+}
+
+// Stats returns the hit and miss counts of the cache along with its size.
+func (c *BlockCache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return CacheStats{
+		Hits:     c.hits,
+		Misses:   c.misses,
+		Blocks:   c.lru.Len(),
+		Size:     c.size,
+		Capacity: c.capacity,
+	}
+}
+
+// get returns a cached block and marks it as recently used.
+func (c *BlockCache) get(key blockCacheKey) (*dataBlock, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.blocks[key]; ok {
+		c.hits++
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*cachedBlock).block, true
+	}
+	c.misses++
+	return nil, false
+}
+
+// add stores a block in the cache.
+func (c *BlockCache) add(key blockCacheKey, block *dataBlock) {
+	if c == nil {
+		return
+	}
+	size := block.size()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if size > c.capacity {
+		return
+	}
+	if elem, ok := c.blocks[key]; ok {
+		// Loaded by another reader at the same time
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.blocks[key] = c.lru.PushFront(&cachedBlock{key, block, size})
+	c.size += size
+	c.evict()
+}
+
+// evict removes the least recently used blocks until the cache is within
+// its capacity. Must be called with c.lock held.
+func (c *BlockCache) evict() {
+	for c.size > c.capacity && c.lru.Len() > 0 {
+		elem := c.lru.Back()
+		block := elem.Value.(*cachedBlock)
+		c.lru.Remove(elem)
+		delete(c.blocks, block.key)
+		c.size -= block.size
+	}
+}
+
+// newFileId returns a unique id for an SST file.
+func newFileId() uint64 {
+	return atomic.AddUint64(&nextFileId, 1)
+}
+
+// load returns data block idx of the given file, from the cache if
+// possible. Otherwise the block is read from disk by calling read, and added
+// to the cache if fill is true.
+func (c *BlockCache) load(file uint64, idx int, fill bool, read func() (*dataBlock, error)) (*dataBlock, error) {
+	key := blockCacheKey{file, idx}
+	if block, ok := c.get(key); ok {
+		return block, nil
+	}
+	block, err := read()
+	if err != nil {
+		return nil, err
+	}
+	if fill {
+		c.add(key, block)
+	}
+	return block, nil
+}
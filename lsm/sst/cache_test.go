@@ -0,0 +1,54 @@
+package sst
+
+import (
+	"testing"
+)
+
+func TestBlockCache(t *testing.T) {
+	block := func(keys ...string) *dataBlock {
+		var entries []SstEntry
+		for _, k := range keys {
+			entries = append(entries, SstEntry{Key: k, Value: make([]byte, 35)}) // 100 bytes
+		}
+		return &dataBlock{entries: entries}
+	}
+
+	c := NewBlockCache(250)
+	c.add(blockCacheKey{1, 0}, block("a"))
+	c.add(blockCacheKey{1, 1}, block("b"))
+	if _, ok := c.get(blockCacheKey{1, 0}); !ok {
+		t.Error("Expected block to be cached")
+	}
+
+	// Block 1 is now the least recently used and is evicted
+	c.add(blockCacheKey{2, 0}, block("c"))
+	if _, ok := c.get(blockCacheKey{1, 1}); ok {
+		t.Error("Expected least recently used block to be evicted")
+	}
+	if b, ok := c.get(blockCacheKey{2, 0}); !ok || b.entries[0].Key != "c" {
+		t.Error("Unexpected block", b)
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Blocks != 2 || stats.Size != 200 {
+		t.Error("Unexpected stats", stats)
+	}
+
+	c.SetCapacity(100)
+	if stats = c.Stats(); stats.Blocks != 1 || stats.Size != 100 {
+		t.Error("Unexpected stats after reducing capacity", stats)
+	}
+
+	// Blocks larger than the cache are never added
+	c.add(blockCacheKey{3, 0}, block("d", "e"))
+	if _, ok := c.get(blockCacheKey{3, 0}); ok {
+		t.Error("Expected block larger than the cache to be skipped")
+	}
+
+	// A nil cache never holds anything
+	var none *BlockCache
+	none.add(blockCacheKey{1, 0}, block("a"))
+	if _, ok := none.get(blockCacheKey{1, 0}); ok {
+		t.Error("Unexpected block in nil cache")
+	}
+}
@@ -2,10 +2,12 @@ package sst
 
 import (
 	"container/heap"
-	"encoding/binary"
+	"fmt"
+	"github.com/justinethier/keyva/lsm/logger"
 	"io/ioutil"
-	"log"
 	"os"
+	"sort"
+	"time"
 )
 
 // Compact performs a k-way merge of data from the given SST files under
@@ -27,122 +29,222 @@ import (
 // Thus we can handle large files as only a small portion of data is kept in memory at once.
 //
 // If there are any duplicate keys, only the most recent entry (IE largest sequence number)
-// is written. Note this is only applicable to SST level 0 which contains SST files that
-// may contain overlapping data.
+// is written unless an older entry is still visible to one of the given snapshots.
+// The snapshots parameter is a sorted list of sequence numbers for which a
+// consistent view of the data must be preserved.
 //
-func Compact(filenames []string, path string, recordsPerSst int, keysPerSegment int, removeDeleted bool) (string, error) {
+// Data blocks of the new files are compressed using c, or stored
+// uncompressed if c is nil.
+//
+func Compact(filenames []string, path string, recordsPerSst int, keysPerSegment int, removeDeleted bool, snapshots []uint64, c Compressor) (string, error) {
+	return CompactWithOptions(filenames, path, CompactOptions{
+		RecordsPerSst: recordsPerSst,
+		RemoveDeleted: removeDeleted,
+		Snapshots:     snapshots,
+		Table:         TableOptions{IndexInterval: keysPerSegment, Compressor: c},
+	})
+}
+
+// CompactOptions control the output of CompactWithOptions. The fields
+// correspond to the parameters of Compact.
+type CompactOptions struct {
+	// Maximum number of records written to each new SST file, zero for no
+	// limit
+	RecordsPerSst int
+
+	// A new SST file is started once this many bytes have been written to
+	// the current one, zero for no limit
+	FileSize int64
+
+	RemoveDeleted bool
+	Snapshots     []uint64
+
+	// Layout of the new SST files
+	Table TableOptions
+
+	// Receives debug messages about the progress of the merge, nil for none
+	Logger logger.Logger
+}
+
+// CompactWithOptions is the same as Compact but allows control over the
+// size and layout of the new SST files.
+func CompactWithOptions(filenames []string, path string, opts CompactOptions) (string, error) {
 	h := &SstHeap{}
 	heap.Init(h)
 
-	// load header, file pointer from each SST
+	// load header, index and position an iterator at the start of each SST
 	var seqNum uint64 = 0
+	var writeTime int64
 	for _, filename := range filenames {
-		_, header, err := readIndexFile(filename)
+		index, header, err := readIndexFile(filename)
 		if err != nil {
-			return "", err
+			return "", fmt.Errorf("%s: %w", filename, err)
 		}
 		if header.Seq > seqNum {
 			seqNum = header.Seq
 		}
-		f, err := os.Open(filename)
+		if header.Time > writeTime {
+			writeTime = header.Time
+		}
+		// Blocks are not cached, they are only read once
+		it, err := NewIterator(filename, &SstFile{Header: header, Index: index}, nil, false)
 		if err != nil {
-			log.Fatal(err)
 			return "", err
 		}
-		defer f.Close()
+		defer it.Close()
 
-		pushNextToHeap(h, f, header.Seq)
+		it.First()
+		err = pushNextToHeap(h, it)
+		if err != nil {
+			return "", err
+		}
 	}
 
 	tmpDir, err := ioutil.TempDir(path, "merged-sst")
 	if err != nil {
-		log.Fatal(err)
 		return "", err
 	}
 
-	// create index/sst files
+	err = compactTo(tmpDir, h, seqNum, writeTime, opts)
+	if err != nil {
+		// Do not leave partial results behind
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+	return tmpDir, nil
+}
+
+// compactTo writes the contents of the heap out to new SST files in tmpDir.
+func compactTo(tmpDir string, h *SstHeap, seqNum uint64, writeTime int64, opts CompactOptions) error {
+	// Files are created as needed, so no empty files are written
 	count := 0
-	var offset int = 0
-	createFiles := func() (*os.File, *os.File) {
-		filename := NextFilename(tmpDir)
-		indexFilename := indexFileForBin(filename)
-		fbin, err := os.Create(tmpDir + "/" + filename)
-		check(err)
-		fidx, err := os.Create(tmpDir + "/" + indexFilename)
-		check(err)
-		return fbin, fidx
+	var w *tableWriter
+	defer func() {
+		if w != nil {
+			w.abort()
+		}
+	}()
+	finishFile := func() error {
+		err := w.finish()
+		w = nil
+		return err
 	}
-	myWriteEntry := func(f *os.File, fidx *os.File, e *SstEntry, removeDeleted bool) {
-		if (e.Deleted && removeDeleted) || e == nil {
-			return
+
+	// writeKey writes all retained entries for a single key. Entries for
+	// a key are never split across files or data blocks.
+	writeKey := func(versions []SstEntry) error {
+		versions = RetainVersions(versions, opts.Snapshots, opts.RemoveDeleted)
+		if len(versions) == 0 {
+			return nil
 		}
-		log.Println("Debug compact writing entry", e.Key)
-		bytes, _ := writeEntry(f, e)
-		if (count % keysPerSegment) == 0 {
-			log.Println("Debug compact writing to index", e.Key)
-			writeKeyToIndex(fidx, e.Key, offset)
+		if w != nil && ((opts.RecordsPerSst > 0 && count > opts.RecordsPerSst) ||
+			(opts.FileSize > 0 && int64(w.size()) >= opts.FileSize)) {
+			count = 0
+			if err := finishFile(); err != nil {
+				return err
+			}
 		}
-		offset += bytes
-	}
-	fbin, fidx := createFiles()
-	// write seq header to index file
-	err = binary.Write(fidx, binary.LittleEndian, seqNum)
-	check(err)
-
-	// while data
-	var cur, next *SstHeapNode
-	if h.Len() > 0 {
-		cur = heap.Pop(h).(*SstHeapNode)
-		pushNextToHeap(h, cur.File, cur.Seq)
+		if w == nil {
+			filename, err := NextFilename(tmpDir)
+			if err != nil {
+				return err
+			}
+			w, err = newTableWriter(tmpDir+"/"+filename, seqNum, opts.Table)
+			if err != nil {
+				return err
+			}
+			w.time = writeTime
+		}
+		for i := range versions {
+			if err := w.add(&versions[i]); err != nil {
+				return err
+			}
+		}
+		count++
+		return nil
 	}
+
+	// while data, collect every entry for the next key and write it out
+	var versions []SstEntry
 	for h.Len() > 0 {
 		// Get next heap entry
 		next := heap.Pop(h).(*SstHeapNode)
-		pushNextToHeap(h, next.File, next.Seq)
+		next.Iter.Next()
+		err := pushNextToHeap(h, next.Iter)
+		if err != nil {
+			return err
+		}
 
-		// Account for duplicate keys
-		if next.Entry.Key == cur.Entry.Key {
-			if next.Seq > cur.Seq {
-				cur = next
+		if len(versions) > 0 && next.Entry.Key != versions[0].Key {
+			if err = writeKey(versions); err != nil {
+				return err
 			}
-			continue
+			versions = versions[:0]
 		}
-
-		// write data to index and SST file
-		myWriteEntry(fbin, fidx, cur.Entry, removeDeleted)
-		cur = next
-		count++
-		if count > recordsPerSst {
-			count = 0
-			offset = 0
-			fbin.Close()
-			fidx.Close()
-			fbin, fidx = createFiles()
-			err = binary.Write(fidx, binary.LittleEndian, seqNum)
-			check(err)
+		versions = append(versions, *next.Entry)
+	}
+	if len(versions) > 0 {
+		if err := writeKey(versions); err != nil {
+			return err
 		}
 	}
-
-	log.Println("before special case", cur, next)
-	// Special case, only one SST entry
-	if next == nil {
-		if cur != nil {
-			myWriteEntry(fbin, fidx, cur.Entry, removeDeleted)
+	if w != nil {
+		if err := finishFile(); err != nil {
+			return err
 		}
-	} else {
-		myWriteEntry(fbin, fidx, next.Entry, removeDeleted)
 	}
 
-	log.Println("done writing sst files")
-	fbin.Close()
-	fidx.Close()
+	if opts.Logger != nil {
+		opts.Logger.Debug("finished writing sst files", "dir", tmpDir, "keys", count)
+	}
+	return nil
+}
 
-	return tmpDir, nil
+// RetainVersions filters the entries for a single key, ordered from newest
+// to oldest, down to the ones a reader may still see. The newest entry is
+// always kept. An older entry is only kept if one of the snapshots was taken
+// after it was written but before the next newer entry.
+//
+// Entries that have expired can no longer be read, so they are replaced by
+// tombstones that hide any older entries for the key.
+//
+// If removeDeleted is true, tombstones are dropped once there are no older
+// entries left for them to hide.
+func RetainVersions(versions []SstEntry, snapshots []uint64, removeDeleted bool) []SstEntry {
+	now := time.Now().UnixNano()
+	var kept []SstEntry
+	for i, e := range versions {
+		if i > 0 {
+			newer := versions[i-1].Seq
+			if e.Seq >= newer {
+				continue // Duplicate entry
+			}
+			j := sort.Search(len(snapshots), func(j int) bool { return snapshots[j] >= e.Seq })
+			if j == len(snapshots) || snapshots[j] >= newer {
+				continue // No snapshot can see this entry
+			}
+		}
+		if e.Expired(now) {
+			e = SstEntry{Key: e.Key, Deleted: true, Seq: e.Seq}
+		}
+		kept = append(kept, e)
+	}
+
+	if removeDeleted {
+		for len(kept) > 0 && kept[len(kept)-1].Deleted {
+			kept = kept[:len(kept)-1]
+		}
+	}
+	return kept
 }
 
-func pushNextToHeap(h *SstHeap, f *os.File, seq uint64) {
-	entry, err := readEntry(f)
-	if err == nil {
-		heap.Push(h, &SstHeapNode{seq, &entry, f})
+// pushNextToHeap adds the current entry of the iterator to the heap, if
+// there is one.
+func pushNextToHeap(h *SstHeap, it *Iterator) error {
+	if !it.Valid() {
+		return it.Err()
 	}
+	entry := *it.Entry()
+	heap.Push(h, &SstHeapNode{entry.Seq, &entry, it})
+	return nil
 }
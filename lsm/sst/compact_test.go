@@ -3,6 +3,7 @@ package sst
 import (
 	"github.com/justinethier/keyva/util"
 	"testing"
+	"time"
 )
 
 func TestSstCompact(t *testing.T) {
@@ -11,8 +12,59 @@ func TestSstCompact(t *testing.T) {
 	files = append(files, "./test-data/sst-0000.bin")
 	files = append(files, "./test-data/sst-0001.bin")
 	//files = append(files, "./test-data/sst-0002.bin")
-	newdir, _ := Compact(files, "test-data", 100, 10, false)
-	if !util.DeepCompare(newdir+"/sst-0000.bin", "test-data/compacted.bin") {
+	newdir, _ := Compact(files, "test-data", 100, 10, false, nil, nil)
+	if !util.DeepCompare(newdir+"/sst-0000.sst", "test-data/compacted.sst") {
 		t.Error("Compacted SST file does not contain expected contents", "newsst")
 	}
 }
+
+func TestRetainVersions(t *testing.T) {
+	versions := []SstEntry{
+		{"a", []byte("4"), false, 40, 0},
+		{"a", nil, true, 30, 0},
+		{"a", []byte("2"), false, 20, 0},
+		{"a", []byte("1"), false, 10, 0},
+	}
+
+	check := func(snapshots []uint64, removeDeleted bool, expected ...uint64) {
+		kept := RetainVersions(versions, snapshots, removeDeleted)
+		if len(kept) != len(expected) {
+			t.Error("Snapshots", snapshots, "expected", expected, "but received", kept)
+			return
+		}
+		for i, e := range kept {
+			if e.Seq != expected[i] {
+				t.Error("Snapshots", snapshots, "expected", expected, "but received", kept)
+			}
+		}
+	}
+
+	check(nil, false, 40)
+	check([]uint64{5}, false, 40)
+	check([]uint64{15}, false, 40, 10)
+	check([]uint64{25, 35}, false, 40, 30, 20)
+	check([]uint64{35}, true, 40)
+	check([]uint64{45}, false, 40)
+}
+
+func TestRetainExpired(t *testing.T) {
+	later := time.Now().Add(time.Hour).UnixNano()
+	versions := []SstEntry{
+		{"a", []byte("3"), false, 30, 1},
+		{"a", []byte("2"), false, 20, later},
+		{"a", []byte("1"), false, 10, 0},
+	}
+
+	// An expired entry still hides older entries, so it becomes a tombstone
+	kept := RetainVersions(versions, []uint64{25}, false)
+	if len(kept) != 2 || !kept[0].Deleted || kept[0].Value != nil || kept[0].Expires != 0 {
+		t.Error("Expected expired entry to be replaced by a tombstone", kept)
+	}
+	if kept[1].Seq != 20 || kept[1].Deleted || kept[1].Expires != later {
+		t.Error("Unexpected entry", kept[1])
+	}
+
+	if kept := RetainVersions(versions, nil, true); len(kept) != 0 {
+		t.Error("Expected expired entry to be removed", kept)
+	}
+}
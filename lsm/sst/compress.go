@@ -0,0 +1,124 @@
+package sst
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// Compressor compresses the contents of data blocks in SST files.
+//
+// The id of the compressor is recorded with each block it writes, so a file
+// may contain blocks written by different compressors and each one is read
+// back with the compressor that wrote it. A compressor must be registered
+// with RegisterCompressor before any block it wrote can be read.
+type Compressor interface {
+	// Id uniquely identifies the compressor. Zero is reserved for blocks
+	// that are not compressed.
+	Id() uint8
+	// Compress appends the compressed form of src to dst.
+	Compress(dst, src []byte) ([]byte, error)
+	// Decompress appends the decompressed form of src to dst.
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+// Compressors that are built in
+var (
+	// Snappy is a fast compressor that gives moderate compression, using
+	// the Snappy block format.
+	Snappy Compressor = snappyCompressor{}
+	// Flate is slower than Snappy but compresses data further, EG: for
+	// data at the bottom level of the tree that is rarely rewritten.
+	Flate Compressor = flateCompressor{}
+)
+
+var compressorLock sync.RWMutex
+var compressors = map[uint8]Compressor{
+	Snappy.Id(): Snappy,
+	Flate.Id():  Flate,
+}
+
+// RegisterCompressor makes a compressor available for reading blocks.
+// Built-in compressors are always registered.
+func RegisterCompressor(c Compressor) error {
+	compressorLock.Lock()
+	defer compressorLock.Unlock()
+	if c.Id() == blockRaw {
+		return fmt.Errorf("sst: compressor id %d is reserved", c.Id())
+	}
+	if existing, ok := compressors[c.Id()]; ok && existing != c {
+		return fmt.Errorf("sst: compressor id %d is already registered", c.Id())
+	}
+	compressors[c.Id()] = c
+	return nil
+}
+
+// compressBlock compresses the contents of a block, returning them along with
+// the block type. Blocks are stored as-is if compression does not save at
+// least 1/8 of their size.
+func compressBlock(c Compressor, contents []byte) ([]byte, uint8, error) {
+	if c == nil || len(contents) == 0 {
+		return contents, blockRaw, nil
+	}
+	compressed, err := c.Compress(nil, contents)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(compressed) > len(contents)-len(contents)/8 {
+		return contents, blockRaw, nil
+	}
+	return compressed, c.Id(), nil
+}
+
+// decompressBlock returns the contents of a block of the given type.
+func decompressBlock(blockType uint8, buf []byte) ([]byte, error) {
+	if blockType == blockRaw {
+		return buf, nil
+	}
+	compressorLock.RLock()
+	c, ok := compressors[blockType]
+	compressorLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown compressor %d", ErrCorrupt, blockType)
+	}
+	contents, err := c.Decompress(nil, buf)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return contents, nil
+}
+
+type flateCompressor struct{}
+
+var flateWriters = sync.Pool{New: func() interface{} {
+	w, _ := flate.NewWriter(nil, flate.BestCompression)
+	return w
+}}
+
+func (flateCompressor) Id() uint8 { return 2 }
+
+func (flateCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, buf...), nil
+}
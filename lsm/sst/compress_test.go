@@ -0,0 +1,122 @@
+package sst
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestCompressors(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 5000)
+	r.Read(random)
+	var text bytes.Buffer
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&text, "Key %03d Test Value %d ", i, i%7)
+	}
+	inputs := [][]byte{
+		nil,
+		[]byte("a"),
+		[]byte("hello hello hello hello"),
+		bytes.Repeat([]byte{'x'}, 70000),
+		random,
+		text.Bytes(),
+		append(append([]byte(nil), random...), random...),
+	}
+
+	for _, c := range []Compressor{Snappy, Flate} {
+		for i, src := range inputs {
+			buf, err := c.Compress(nil, src)
+			check(err)
+			out, err := c.Decompress(nil, buf)
+			check(err)
+			if !bytes.Equal(out, src) {
+				t.Error("Compressor", c.Id(), "input", i, "did not round trip")
+			}
+		}
+		buf, _ := c.Compress(nil, text.Bytes())
+		if len(buf) > text.Len()/2 {
+			t.Error("Compressor", c.Id(), "compressed", text.Len(), "bytes to", len(buf))
+		}
+	}
+}
+
+func TestSnappyFormat(t *testing.T) {
+	// A literal followed by a copy of the previous 5 bytes
+	out, err := snappyDecode(nil, []byte{10, 4 << 2, 'h', 'e', 'l', 'l', 'o', 1<<2 | 0x01, 5})
+	check(err)
+	if string(out) != "hellohello" {
+		t.Error("Unexpected output", string(out))
+	}
+
+	corrupt := [][]byte{
+		{},
+		{5, 4 << 2, 'h', 'e'},      // Literal past the end of the input
+		{5, 1<<2 | 0x01, 5},        // Copy before the start of the output
+		{3, 4 << 2, 'h', 'e', 'l'}, // Output longer than expected
+	}
+	for i, buf := range corrupt {
+		if _, err := snappyDecode(nil, buf); err == nil {
+			t.Error("Expected error decoding input", i)
+		}
+	}
+}
+
+func TestMixedCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-sst")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	// Each block is written with a different compressor
+	w, err := newTableWriter(dir+"/sst-0000.sst", 30, TableOptions{IndexInterval: 10})
+	check(err)
+	compressors := []Compressor{nil, Snappy, Flate}
+	for i := 0; i < 30; i++ {
+		if i%10 == 0 {
+			check(w.finishBlock())
+			w.compressor = compressors[i/10]
+		}
+		key := fmt.Sprintf("Key %03d", i)
+		check(w.add(&SstEntry{key, bytes.Repeat([]byte(key), 10), false, uint64(i), 0}))
+	}
+	check(w.finish())
+
+	f, err := os.Open(dir + "/sst-0000.sst")
+	check(err)
+	defer f.Close()
+	index, header, err := readTable(f)
+	check(err)
+	for i, idx := range index {
+		var trailer [1]byte
+		_, err := f.ReadAt(trailer[:], int64(idx.offset+idx.size))
+		check(err)
+		var want uint8
+		if compressors[i] != nil {
+			want = compressors[i].Id()
+		}
+		if trailer[0] != want {
+			t.Error("Block", i, "has type", trailer[0], "expected", want)
+		}
+
+		entries, err := readDataBlock(f, header, index, i)
+		check(err)
+		for j, e := range entries {
+			key := fmt.Sprintf("Key %03d", i*10+j)
+			if e.Key != key || !bytes.Equal(e.Value, bytes.Repeat([]byte(key), 10)) {
+				t.Error("Unexpected entry", e.Key, "in block", i)
+			}
+		}
+	}
+
+	// Blocks written by an unknown compressor cannot be read
+	if _, err := decompressBlock(99, []byte("data")); !errors.Is(err, ErrCorrupt) {
+		t.Error("Expected ErrCorrupt for unknown compressor", err)
+	}
+	if err := RegisterCompressor(flateCompressor{}); err != nil {
+		t.Error("Unexpected error registering built-in compressor", err)
+	}
+}
@@ -5,10 +5,10 @@ import (
 )
 
 func TestFindIndex(t *testing.T) {
-	e := SstIndex{"ee", 0}
-	j := SstIndex{"jj", 100}
-	m := SstIndex{"pp", 200}
-	u := SstIndex{"uu", 300}
+	e := SstIndex{Key: "ee", offset: 0}
+	j := SstIndex{Key: "jj", offset: 100}
+	m := SstIndex{Key: "pp", offset: 200}
+	u := SstIndex{Key: "uu", offset: 300}
 	index := []SstIndex{e, j, m, u}
 
 	check := func(key string, start int, end int, idx int, found bool) {
@@ -0,0 +1,577 @@
+package sst
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/justinethier/keyva/bloom"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SST files are written as a single file made up of blocks:
+//
+//   [data block 1]
+//   ...
+//   [data block N]
+//   [filter block]
+//   [index block]
+//   [properties block]
+//   [footer]
+//
+// Each block is followed by a trailer:
+//
+//   type     uint8    How the block contents are stored, EG: blockRaw
+//   checksum uint32   CRC-32C of the block contents and type
+//
+// Data blocks may be compressed, in which case the type is the id of the
+// Compressor used and the checksum covers the compressed contents. All
+// other blocks are stored as-is.
+//
+// A data block contains a run of entries, sorted by key and then from
+// newest to oldest. All entries for a key are kept in the same block. Keys
+// are prefix compressed as described in block.go. Files in formatBlock
+// store every entry in full instead:
+//
+//   key     uvarint length, followed by the key
+//   value   uvarint length, followed by the value
+//   deleted uint8
+//   seq     uint64
+//
+// The index block contains the first key of each data block, along with
+// the location of that block:
+//
+//   key     uvarint length, followed by the key
+//   offset  uvarint
+//   size    uvarint   Size of the block, not including the trailer
+//
+// The filter block contains a bloom filter over the keys in the file, as
+// encoded by bloom.Filter.MarshalBinary. If it is empty the filter is built
+// from the keys in the file when the file is opened.
+//
+// The properties block describes the file as a list of named values, each
+// stored as a uvarint length followed by the bytes of the name or value.
+// Readers ignore any properties they do not recognize.
+//
+// The footer is a fixed size and is found at the end of the file:
+//
+//   filter     offset uint64, size uint64
+//   index      offset uint64, size uint64
+//   properties offset uint64, size uint64
+//   version    uint32
+//   checksum   uint32   CRC-32C of the footer up to this point
+//   magic      [8]byte  "KEYVASST"
+//
+// All fixed size integers are little endian.
+
+var tableMagic = [8]byte{'K', 'E', 'Y', 'V', 'A', 'S', 'S', 'T'}
+
+const (
+	blockHandleSize  = 16
+	blockTrailerSize = 5
+	footerSize       = 3*blockHandleSize + 16
+
+	// Block contents are stored as-is
+	blockRaw uint8 = 0
+
+	// Filters have a false positive rate of less than 1/filterRate unless
+	// TableOptions.FilterRate is set
+	filterRate = 200
+)
+
+// Names of the properties stored in the properties block
+const (
+	propSeq      = "keyva.seq"
+	propEntries  = "keyva.entries"
+	propSmallest = "keyva.smallest"
+	propLargest  = "keyva.largest"
+	propTime     = "keyva.time"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// blockHandle is the location of a block within an SST file.
+type blockHandle struct {
+	offset uint64
+	size   uint64
+}
+
+type footer struct {
+	filter     blockHandle
+	index      blockHandle
+	properties blockHandle
+	version    uint32
+}
+
+func (h blockHandle) encode(buf []byte) {
+	binary.LittleEndian.PutUint64(buf, h.offset)
+	binary.LittleEndian.PutUint64(buf[8:], h.size)
+}
+
+func decodeBlockHandle(buf []byte) blockHandle {
+	return blockHandle{binary.LittleEndian.Uint64(buf), binary.LittleEndian.Uint64(buf[8:])}
+}
+
+func (ft *footer) encode() []byte {
+	buf := make([]byte, footerSize)
+	ft.filter.encode(buf)
+	ft.index.encode(buf[blockHandleSize:])
+	ft.properties.encode(buf[2*blockHandleSize:])
+	binary.LittleEndian.PutUint32(buf[3*blockHandleSize:], ft.version)
+	binary.LittleEndian.PutUint32(buf[3*blockHandleSize+4:], crc32.Checksum(buf[:3*blockHandleSize+4], crcTable))
+	copy(buf[footerSize-8:], tableMagic[:])
+	return buf
+}
+
+// readFooter reads and validates the footer at the end of the file.
+func readFooter(f *os.File) (footer, error) {
+	var ft footer
+	fi, err := f.Stat()
+	if err != nil {
+		return ft, err
+	}
+	if fi.Size() < footerSize {
+		return ft, fmt.Errorf("%w: file is too small", ErrCorrupt)
+	}
+
+	buf := make([]byte, footerSize)
+	_, err = f.ReadAt(buf, fi.Size()-footerSize)
+	if err != nil {
+		return ft, corrupt(err)
+	}
+	var magic [8]byte
+	copy(magic[:], buf[footerSize-8:])
+	if magic != tableMagic {
+		return ft, fmt.Errorf("%w: missing footer", ErrCorrupt)
+	}
+	checksum := binary.LittleEndian.Uint32(buf[3*blockHandleSize+4:])
+	if crc32.Checksum(buf[:3*blockHandleSize+4], crcTable) != checksum {
+		return ft, fmt.Errorf("%w: footer checksum mismatch", ErrCorrupt)
+	}
+
+	ft.filter = decodeBlockHandle(buf)
+	ft.index = decodeBlockHandle(buf[blockHandleSize:])
+	ft.properties = decodeBlockHandle(buf[2*blockHandleSize:])
+	ft.version = binary.LittleEndian.Uint32(buf[3*blockHandleSize:])
+	if ft.version < formatBlock || ft.version > formatExpiry {
+		return ft, fmt.Errorf("%w: unsupported version %d", ErrCorrupt, ft.version)
+	}
+	return ft, nil
+}
+
+// readBlock reads the contents of a block, verifies its checksum and
+// decompresses it if needed.
+func readBlock(f *os.File, h blockHandle) ([]byte, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if h.offset+h.size+blockTrailerSize > uint64(fi.Size()) || h.offset+h.size < h.offset {
+		return nil, fmt.Errorf("%w: block at offset %d extends past the end of the file", ErrCorrupt, h.offset)
+	}
+
+	buf := make([]byte, h.size+blockTrailerSize)
+	_, err = f.ReadAt(buf, int64(h.offset))
+	if err != nil {
+		return nil, corrupt(err)
+	}
+	checksum := binary.LittleEndian.Uint32(buf[h.size+1:])
+	if crc32.Checksum(buf[:h.size+1], crcTable) != checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch in block at offset %d", ErrCorrupt, h.offset)
+	}
+	return decompressBlock(buf[h.size], buf[:h.size])
+}
+
+// readTable reads the index and properties of an SST file.
+func readTable(f *os.File) ([]SstIndex, SstFileHeader, error) {
+	var header SstFileHeader
+	ft, err := readFooter(f)
+	if err != nil {
+		return nil, header, err
+	}
+	header.Version = ft.version
+
+	buf, err := readBlock(f, ft.properties)
+	if err != nil {
+		return nil, header, err
+	}
+	err = decodeProperties(buf, &header)
+	if err != nil {
+		return nil, header, err
+	}
+
+	buf, err = readBlock(f, ft.index)
+	if err != nil {
+		return nil, header, err
+	}
+	index, err := decodeIndexBlock(buf)
+	return index, header, err
+}
+
+// readFilter reads the bloom filter of an SST file. Returns nil if the file
+// does not contain a filter.
+func readFilter(f *os.File) (*bloom.Filter, error) {
+	ft, err := readFooter(f)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := readBlock(f, ft.filter)
+	if err != nil || len(buf) == 0 {
+		return nil, err
+	}
+	filter := &bloom.Filter{}
+	if err = filter.UnmarshalBinary(buf); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return filter, nil
+}
+
+// readDataBlock reads the entries of the data block at position idx of the
+// index.
+func readDataBlock(f *os.File, header SstFileHeader, index []SstIndex, idx int) ([]SstEntry, error) {
+	block, err := readBlockData(f, header, index, idx)
+	if err != nil {
+		return nil, err
+	}
+	return block.decode()
+}
+
+// readBlockData reads the data block at position idx of the index. Blocks
+// in the current format are left encoded, older ones are decoded in full.
+func readBlockData(f *os.File, header SstFileHeader, index []SstIndex, idx int) (*dataBlock, error) {
+	if header.Version < formatBlock {
+		end := -1
+		if idx+1 < len(index) {
+			end = index[idx+1].offset
+		}
+		entries, err := readDataBlockEntries(f, header, index[idx].offset, end)
+		if err != nil {
+			return nil, err
+		}
+		return &dataBlock{entries: entries}, nil
+	}
+
+	buf, err := readBlock(f, blockHandle{uint64(index[idx].offset), uint64(index[idx].size)})
+	if err != nil {
+		return nil, err
+	}
+	if header.Version == formatBlock {
+		entries, err := decodeDataBlock(buf)
+		if err != nil {
+			return nil, err
+		}
+		return &dataBlock{entries: entries}, nil
+	}
+	return newDataBlock(buf)
+}
+
+// readBytes reads a length prefixed byte string from buf and returns it
+// along with the remainder of buf.
+func readBytes(buf []byte) ([]byte, []byte, error) {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 || length > uint64(len(buf)-n) {
+		return nil, nil, ErrCorrupt
+	}
+	end := n + int(length)
+	return buf[n:end], buf[end:], nil
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(len(b)))
+	buf = append(buf, tmp[:n]...)
+	return append(buf, b...)
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+// decodeDataBlock decodes all of the entries in a formatBlock data block.
+func decodeDataBlock(buf []byte) ([]SstEntry, error) {
+	var entries []SstEntry
+	for len(buf) > 0 {
+		var e SstEntry
+		key, rest, err := readBytes(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid key in data block", ErrCorrupt)
+		}
+		value, rest, err := readBytes(rest)
+		if err != nil || len(rest) < 9 {
+			return nil, fmt.Errorf("%w: invalid entry for key %q", ErrCorrupt, key)
+		}
+		e.Key = string(key)
+		e.Value = make([]byte, len(value))
+		copy(e.Value, value)
+		e.Deleted = rest[0] != 0
+		e.Seq = binary.LittleEndian.Uint64(rest[1:])
+		entries = append(entries, e)
+		buf = rest[9:]
+	}
+	return entries, nil
+}
+
+// decodeIndexBlock decodes the first key and location of each data block.
+func decodeIndexBlock(buf []byte) ([]SstIndex, error) {
+	var index []SstIndex
+	for len(buf) > 0 {
+		key, rest, err := readBytes(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid index block", ErrCorrupt)
+		}
+		offset, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: invalid index block", ErrCorrupt)
+		}
+		rest = rest[n:]
+		size, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: invalid index block", ErrCorrupt)
+		}
+		index = append(index, SstIndex{Key: string(key), offset: int(offset), size: int(size)})
+		buf = rest[n:]
+	}
+	return index, nil
+}
+
+// decodeProperties reads the properties of a file into header.
+func decodeProperties(buf []byte, header *SstFileHeader) error {
+	for len(buf) > 0 {
+		name, rest, err := readBytes(buf)
+		if err != nil {
+			return fmt.Errorf("%w: invalid properties block", ErrCorrupt)
+		}
+		value, rest, err := readBytes(rest)
+		if err != nil {
+			return fmt.Errorf("%w: invalid properties block", ErrCorrupt)
+		}
+		buf = rest
+
+		switch string(name) {
+		case propSeq, propEntries, propTime:
+			if len(value) != 8 {
+				return fmt.Errorf("%w: invalid property %s", ErrCorrupt, name)
+			}
+			switch string(name) {
+			case propSeq:
+				header.Seq = binary.LittleEndian.Uint64(value)
+			case propEntries:
+				header.Entries = binary.LittleEndian.Uint64(value)
+			default:
+				header.Time = int64(binary.LittleEndian.Uint64(value))
+			}
+		case propSmallest:
+			header.Smallest = string(value)
+		case propLargest:
+			header.Largest = string(value)
+		}
+	}
+	return nil
+}
+
+// tableWriter writes a sorted run of entries to a new SST file.
+//
+// The file is written under a temporary name and only renamed once it is
+// complete and synced to disk, so a crash never leaves a partial SST file
+// behind.
+type tableWriter struct {
+	f            *os.File
+	filename     string
+	offset       uint64
+	seq          uint64
+	time         int64 // Unix time the data was written, defaults to now
+	keysPerBlock int
+	blockSize    int
+	filterRate   int
+	compressor   Compressor
+	block        blockBuilder // Data block being built
+	blockKey     string       // First key in the current data block
+	blockKeys    int          // Number of distinct keys in the current data block
+	keys         []string
+	index        []byte
+	entries      uint64
+	smallest     string
+	largest      string
+}
+
+// newTableWriter creates a new SST file laid out according to opts. seqNum
+// is the sequence number of the latest entry.
+func newTableWriter(filename string, seqNum uint64, opts TableOptions) (*tableWriter, error) {
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	keysPerBlock := opts.IndexInterval
+	if keysPerBlock < 1 {
+		keysPerBlock = 1
+	}
+	rate := opts.FilterRate
+	if rate <= 0 {
+		rate = filterRate
+	}
+	return &tableWriter{f: f, filename: filename, seq: seqNum, time: time.Now().Unix(),
+		keysPerBlock: keysPerBlock, blockSize: opts.BlockSize, filterRate: rate,
+		compressor: opts.Compressor}, nil
+}
+
+// add appends an entry to the file. Entries must be added in sorted order.
+func (w *tableWriter) add(e *SstEntry) error {
+	newKey := w.entries == 0 || e.Key != w.largest
+	full := w.blockKeys >= w.keysPerBlock || (w.blockSize > 0 && w.block.size() >= w.blockSize)
+	if newKey && full {
+		if err := w.finishBlock(); err != nil {
+			return err
+		}
+	}
+	if w.block.empty() {
+		w.blockKey = e.Key
+	}
+	if newKey {
+		w.blockKeys++
+		w.keys = append(w.keys, e.Key)
+	}
+	if w.entries == 0 {
+		w.smallest = e.Key
+	}
+	w.largest = e.Key
+	w.entries++
+	w.block.add(e)
+	return nil
+}
+
+// size returns the approximate size of the file so far, including the data
+// block being built.
+func (w *tableWriter) size() uint64 {
+	return w.offset + uint64(w.block.size())
+}
+
+// finishBlock writes out the current data block and adds it to the index.
+func (w *tableWriter) finishBlock() error {
+	if w.block.empty() {
+		return nil
+	}
+	contents, blockType, err := compressBlock(w.compressor, w.block.finish())
+	if err != nil {
+		return err
+	}
+	h, err := w.writeBlock(contents, blockType)
+	if err != nil {
+		return err
+	}
+	w.index = appendBytes(w.index, []byte(w.blockKey))
+	w.index = appendUvarint(w.index, h.offset)
+	w.index = appendUvarint(w.index, h.size)
+	w.block.reset()
+	w.blockKeys = 0
+	return nil
+}
+
+// writeBlock writes a block followed by its trailer.
+func (w *tableWriter) writeBlock(contents []byte, blockType uint8) (blockHandle, error) {
+	h := blockHandle{w.offset, uint64(len(contents))}
+	var trailer [blockTrailerSize]byte
+	trailer[0] = blockType
+	crc := crc32.Update(crc32.Checksum(contents, crcTable), crcTable, trailer[:1])
+	binary.LittleEndian.PutUint32(trailer[1:], crc)
+
+	if _, err := w.f.Write(contents); err != nil {
+		return h, err
+	}
+	if _, err := w.f.Write(trailer[:]); err != nil {
+		return h, err
+	}
+	w.offset += uint64(len(contents) + blockTrailerSize)
+	return h, nil
+}
+
+// filter encodes a bloom filter over every key in the file.
+func (w *tableWriter) filter() []byte {
+	filter := bloom.New(len(w.keys), w.filterRate)
+	for _, k := range w.keys {
+		filter.Add(k)
+	}
+	buf, _ := filter.MarshalBinary()
+	return buf
+}
+
+// properties encodes the properties block for the file.
+func (w *tableWriter) properties() []byte {
+	var buf []byte
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], w.seq)
+	buf = appendBytes(buf, []byte(propSeq))
+	buf = appendBytes(buf, tmp[:])
+	binary.LittleEndian.PutUint64(tmp[:], w.entries)
+	buf = appendBytes(buf, []byte(propEntries))
+	buf = appendBytes(buf, tmp[:])
+	buf = appendBytes(buf, []byte(propSmallest))
+	buf = appendBytes(buf, []byte(w.smallest))
+	buf = appendBytes(buf, []byte(propLargest))
+	buf = appendBytes(buf, []byte(w.largest))
+	binary.LittleEndian.PutUint64(tmp[:], uint64(w.time))
+	buf = appendBytes(buf, []byte(propTime))
+	buf = appendBytes(buf, tmp[:])
+	return buf
+}
+
+// finish writes the remaining blocks and footer, syncs the file to disk and
+// moves it into place. The writer may not be used afterwards.
+func (w *tableWriter) finish() error {
+	var ft footer
+	ft.version = formatExpiry
+	err := w.finishBlock()
+	if err == nil {
+		ft.filter, err = w.writeBlock(w.filter(), blockRaw)
+	}
+	if err == nil {
+		ft.index, err = w.writeBlock(w.index, blockRaw)
+	}
+	if err == nil {
+		ft.properties, err = w.writeBlock(w.properties(), blockRaw)
+	}
+	if err == nil {
+		_, err = w.f.Write(ft.encode())
+	}
+	if err == nil {
+		err = w.f.Sync()
+	}
+	if err != nil {
+		w.abort()
+		return err
+	}
+	if err = w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	if err = os.Rename(w.f.Name(), w.filename); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(w.filename))
+}
+
+// abort discards the file being written.
+func (w *tableWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// loadTable reads every entry from a block format SST file.
+func loadTable(f *os.File) ([]SstEntry, SstFileHeader, error) {
+	index, header, err := readTable(f)
+	if err != nil {
+		return nil, header, err
+	}
+	var entries []SstEntry
+	for i := range index {
+		block, err := readDataBlock(f, header, index, i)
+		if err != nil {
+			return nil, header, err
+		}
+		entries = append(entries, block...)
+	}
+	return entries, header, nil
+}
@@ -7,11 +7,11 @@ import (
 )
 
 func TestMinHeap(t *testing.T) {
-	a := &SstHeapNode{1, &SstEntry{"a", nil, false}, nil}
-	b := &SstHeapNode{1, &SstEntry{"b", nil, false}, nil}
-	c := &SstHeapNode{1, &SstEntry{"c", nil, false}, nil}
-	d := &SstHeapNode{1, &SstEntry{"d", nil, false}, nil}
-	e := &SstHeapNode{1, &SstEntry{"e", nil, false}, nil}
+	a := &SstHeapNode{1, &SstEntry{"a", nil, false, 1, 0}, nil}
+	b := &SstHeapNode{1, &SstEntry{"b", nil, false, 1, 0}, nil}
+	c := &SstHeapNode{1, &SstEntry{"c", nil, false, 1, 0}, nil}
+	d := &SstHeapNode{1, &SstEntry{"d", nil, false, 1, 0}, nil}
+	e := &SstHeapNode{1, &SstEntry{"e", nil, false, 1, 0}, nil}
 	//e_del := &SstEntry{"e", nil, true}
 
 	// This example inserts several ints into an IntHeap, checks the minimum,
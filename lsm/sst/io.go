@@ -3,53 +3,124 @@ package sst
 import (
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
 
-// TODO: input is name of .bin file. write that and corresponding .index file
-// Create creates a new SST file from given data
-func Create(filename string, keys []string, m map[string]SstEntry, seqNum uint64) {
-	keysPerSegment := (len(keys) / 10) + 1
-	writeSst(filename, keys, m, seqNum, keysPerSegment)
-}
+// TableOptions control the layout of new SST files.
+type TableOptions struct {
+	// Number of keys stored in each data block, and so the number of keys
+	// between entries of the sparse index. If zero, Create splits the file
+	// into about ten blocks.
+	IndexInterval int
 
-// TODO: input is name of .bin file. read that and corresponding .index file and load into memory
-func Load(filename string) ([]SstEntry, SstFileHeader) {
-	var buf []SstEntry
+	// A data block is finished once it holds this many bytes, even if it
+	// has fewer than IndexInterval keys. Zero for no limit.
+	BlockSize int
 
-	fbin, err := os.Open(filename)
-	check(err)
-	defer fbin.Close()
-	buf = readEntries(fbin)
+	// Bloom filters have a false positive rate of less than 1/FilterRate,
+	// defaults to 200
+	FilterRate int
+
+	// Data blocks are compressed using Compressor, or stored uncompressed
+	// if it is nil
+	Compressor Compressor
+}
+
+// Create creates a new SST file from given data. Entries must be sorted by
+// key, with multiple entries for the same key ordered from newest to oldest.
+// The file is synced to disk before Create returns. Data blocks are
+// compressed using c, or stored uncompressed if c is nil.
+func Create(filename string, entries []SstEntry, seqNum uint64, c Compressor) error {
+	return CreateWithOptions(filename, entries, seqNum, TableOptions{Compressor: c})
+}
 
-	_, header, err := readIndexFile(filename)
-	check(err)
+// CreateWithOptions is the same as Create but allows control over the
+// layout of the file.
+func CreateWithOptions(filename string, entries []SstEntry, seqNum uint64, opts TableOptions) error {
+	if opts.IndexInterval == 0 {
+		opts.IndexInterval = (len(entries) / 10) + 1
+	}
+	return writeSstEntries(filename, entries, seqNum, opts)
+}
 
-	return buf, header
+// Load reads every entry of the given SST file into memory.
+func Load(filename string) ([]SstEntry, SstFileHeader, error) {
+	var entries []SstEntry
+	var header SstFileHeader
+	var err error
+	if isLegacy(filename) {
+		entries, header, err = loadLegacy(filename)
+	} else {
+		var f *os.File
+		f, err = os.Open(filename)
+		if err != nil {
+			return nil, header, err
+		}
+		defer f.Close()
+		entries, header, err = loadTable(f)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		err = fmt.Errorf("%s: %w", filename, err)
+	}
+	return entries, header, err
 }
 
-func LoadBlock(filename string, start int, end int) []SstEntry {
-	var data []SstEntry
+func loadLegacy(filename string) ([]SstEntry, SstFileHeader, error) {
+	_, header, err := readLegacyIndexFile(filename)
+	if err != nil {
+		return nil, header, err
+	}
 
 	fbin, err := os.Open(filename)
-	check(err)
+	if err != nil {
+		return nil, header, err
+	}
 	defer fbin.Close()
-	data = readDataBlockEntries(fbin, start, end)
 
-	return data
+	buf, err := readEntries(fbin, header)
+	return buf, header, err
+}
+
+// LoadBlock reads the entries of the data block at position idx of the
+// given index.
+func LoadBlock(filename string, header SstFileHeader, index []SstIndex, idx int) ([]SstEntry, error) {
+	block, err := loadBlockData(filename, header, index, idx)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := block.decode()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return entries, nil
+}
+
+// loadBlockData reads data block idx of the given file without decoding it.
+func loadBlockData(filename string, header SstFileHeader, index []SstIndex, idx int) (*dataBlock, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	block, err := readBlockData(f, header, index, idx)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return block, nil
 }
 
 // Levels returns the names of any directories containing consolidated
 // SST files at levels greater than level 0. This implies the data is
 // organized in non-overlapping regions across files at that level.
-func Levels(path string) []string {
+func Levels(path string) ([]string, error) {
 	files, err := ioutil.ReadDir(path)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	var lvls []string
@@ -60,7 +131,7 @@ func Levels(path string) []string {
 		}
 	}
 
-	return lvls
+	return lvls, nil
 }
 
 func PathForLevel(base string, level int) string {
@@ -71,67 +142,99 @@ func PathForLevel(base string, level int) string {
 	return fmt.Sprintf("%s/level-%d", base, level)
 }
 
-// Filenames returns names of the SST binary files under path
+// filenamePattern matches SST files, along with the .bin file of legacy
+// SST files. Files are numbered with at least 4 digits.
+var filenamePattern = regexp.MustCompile(`^sst-([0-9]{4,})\.(sst|bin)$`)
+
+// FileNumber returns the number of the given SST file, or -1 if filename
+// is not the name of an SST file.
+func FileNumber(filename string) int {
+	m := filenamePattern.FindStringSubmatch(filename)
+	if m == nil {
+		return -1
+	}
+	n, _ := strconv.Atoi(m[1])
+	return n
+}
+
+// NumberedFilename returns the name of SST file number n.
+func NumberedFilename(n int) string {
+	return fmt.Sprintf("sst-%04d.sst", n)
+}
+
+// Filenames returns names of the SST files under path, oldest first
 func Filenames(path string) []string {
 	var sstFiles []string
 	files, err := ioutil.ReadDir(path)
 	if err == nil {
 		for _, file := range files {
-			matched, _ := regexp.Match(`^sst-[0-9]*\.bin`, []byte(file.Name()))
+			matched := filenamePattern.MatchString(file.Name())
 			if matched && !file.IsDir() {
 				sstFiles = append(sstFiles, file.Name())
 			}
 		}
 	}
 
+	sort.SliceStable(sstFiles, func(i, j int) bool {
+		return FileNumber(sstFiles[i]) < FileNumber(sstFiles[j])
+	})
 	return sstFiles
 }
 
-// NextFilename returns the name of the next SST binary file in given directory
-func NextFilename(path string) string {
-	files, err := ioutil.ReadDir(path)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	var sstFiles []string
-	for _, file := range files {
-		matched, _ := regexp.Match(`^sst-[0-9]*\.bin`, []byte(file.Name()))
-		if matched && !file.IsDir() {
-			//fmt.Println(file.Name(), file.IsDir())
-			sstFiles = append(sstFiles, file.Name())
-		}
+// NextFilename returns the name of the next SST file in given directory
+func NextFilename(path string) (string, error) {
+	if _, err := os.Stat(path); err != nil {
+		return "", err
 	}
 
+	sstFiles := Filenames(path)
 	if len(sstFiles) > 0 {
-		var latest = sstFiles[len(sstFiles)-1][4:8]
-		n, _ := strconv.Atoi(latest)
-		return fmt.Sprintf("sst-%04d.bin", n+1)
+		n := FileNumber(sstFiles[len(sstFiles)-1])
+		return NumberedFilename(n + 1), nil
 	}
 
-	return "sst-0000.bin"
+	return NumberedFilename(0), nil
 }
 
 // Delete SST file from disk
-func Remove(filename string) {
-	indexFile := indexFileForBin(filename)
-	os.Remove(filename)
-	os.Remove(indexFile)
+func Remove(filename string) error {
+	err := os.Remove(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if isLegacy(filename) {
+		err = os.Remove(indexFileForBin(filename))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
 }
 
 // Delete all SST files from disk
-func RemoveAll(path string) {
+func RemoveAll(path string) error {
 	sstFilenames := Filenames(path)
 	for _, filename := range sstFilenames {
-		indexFile := indexFileForBin(filename)
-		os.Remove(path + "/" + filename)
-		os.Remove(path + "/" + indexFile)
+		if err := Remove(path + "/" + filename); err != nil {
+			return err
+		}
 	}
 
-	sstLevels := Levels(path)
+	sstLevels, err := Levels(path)
+	if err != nil {
+		return err
+	}
 	for _, level := range sstLevels {
-		os.RemoveAll(path + "/" + level)
+		if err := os.RemoveAll(path + "/" + level); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// isLegacy returns true if filename is the .bin file of a legacy SST file
+func isLegacy(filename string) bool {
+	return strings.HasSuffix(filename, ".bin")
 }
 
 // Get filename of index file for given SST file
@@ -145,7 +248,10 @@ func binFileForIndex(filename string) string {
 }
 
 func sstBaseFilename(filename string) string {
-	nobin := strings.TrimSuffix(filename, ".bin")
-	noidx := strings.TrimSuffix(nobin, ".index")
-	return noidx
+	for _, ext := range []string{".sst", ".bin", ".index"} {
+		if strings.HasSuffix(filename, ext) {
+			return strings.TrimSuffix(filename, ext)
+		}
+	}
+	return filename
 }
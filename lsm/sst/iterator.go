@@ -0,0 +1,155 @@
+package sst
+
+import (
+	"fmt"
+	"os"
+)
+
+// Iterator walks the entries of a single SST file in key order.
+//
+// Data blocks are loaded from disk one at a time using the index,
+// so only a small portion of the file is kept in memory at once.
+// The file is held open until Close is called.
+type Iterator struct {
+	file    *os.File
+	sstf    *SstFile
+	cache   *BlockCache
+	fill    bool
+	block   int        // Index of the data block currently loaded
+	entries []SstEntry // Contents of the current data block
+	pos     int        // Position within entries
+	err     error
+}
+
+// NewIterator returns an iterator over the SST file with the given filename.
+// Entries are returned in key order, and entries for the same key are
+// returned from newest to oldest. The iterator is not positioned until one
+// of the First, Last or Seek methods is called.
+//
+// Data blocks are read through the given cache, which may be nil. If fill
+// is false blocks read from disk are not added to the cache, EG: so a large
+// scan does not evict blocks that are used more often.
+func NewIterator(filename string, sstf *SstFile, cache *BlockCache, fill bool) (*Iterator, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &Iterator{file: f, sstf: sstf, cache: cache, fill: fill, block: -1, pos: -1}, nil
+}
+
+// loadBlock reads the data block at position idx of the sparse index.
+// Returns false if there is no such block or it cannot be read.
+func (it *Iterator) loadBlock(idx int) bool {
+	it.block = idx
+	it.entries = nil
+	if it.err != nil || idx < 0 || idx >= len(it.sstf.Index) {
+		return false
+	}
+	block, err := it.cache.load(it.sstf.id, idx, it.fill, func() (*dataBlock, error) {
+		return readBlockData(it.file, it.sstf.Header, it.sstf.Index, idx)
+	})
+	if err == nil {
+		it.entries, err = block.decode()
+	}
+	if err != nil {
+		it.err = fmt.Errorf("%s: %w", it.file.Name(), err)
+		it.entries = nil
+		return false
+	}
+	return true
+}
+
+// First moves the iterator to the first entry in the file.
+func (it *Iterator) First() {
+	for ok := it.loadBlock(0); ok; ok = it.loadBlock(it.block + 1) {
+		if len(it.entries) > 0 {
+			it.pos = 0
+			return
+		}
+	}
+	it.pos = -1
+}
+
+// Last moves the iterator to the last entry in the file.
+func (it *Iterator) Last() {
+	for ok := it.loadBlock(len(it.sstf.Index) - 1); ok; ok = it.loadBlock(it.block - 1) {
+		if len(it.entries) > 0 {
+			it.pos = len(it.entries) - 1
+			return
+		}
+	}
+	it.pos = -1
+}
+
+// Seek moves the iterator to the first entry with a key greater than or
+// equal to the given key.
+func (it *Iterator) Seek(key string) {
+	_, _, idx, found := findBlock(key, it.sstf.Index)
+	if !found {
+		// Key sorts before the first block
+		it.First()
+		return
+	}
+
+	if !it.loadBlock(idx) {
+		it.pos = -1
+		return
+	}
+	for i, e := range it.entries {
+		if e.Key >= key {
+			it.pos = i
+			return
+		}
+	}
+
+	// Key sorts after every entry in the block, continue with the next one
+	it.pos = len(it.entries) - 1
+	it.Next()
+}
+
+// Valid returns true if the iterator is positioned at an entry.
+func (it *Iterator) Valid() bool {
+	return it.pos >= 0 && it.pos < len(it.entries)
+}
+
+// Next moves the iterator to the next entry in the file.
+func (it *Iterator) Next() {
+	it.pos++
+	for it.pos >= len(it.entries) {
+		if !it.loadBlock(it.block + 1) {
+			it.pos = -1
+			return
+		}
+		it.pos = 0
+	}
+}
+
+// Prev moves the iterator to the previous entry in the file.
+func (it *Iterator) Prev() {
+	it.pos--
+	for it.pos < 0 {
+		if !it.loadBlock(it.block - 1) {
+			it.pos = -1
+			return
+		}
+		it.pos = len(it.entries) - 1
+	}
+}
+
+// Err returns the first error encountered while reading the file, if any.
+// The iterator is no longer valid once an error has occurred.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Entry returns the entry at the current position of the iterator.
+func (it *Iterator) Entry() *SstEntry {
+	return &it.entries[it.pos]
+}
+
+// Close releases the file held by the iterator.
+func (it *Iterator) Close() error {
+	it.entries = nil
+	it.pos = -1
+	return it.file.Close()
+}
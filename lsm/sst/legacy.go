@@ -0,0 +1,214 @@
+package sst
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"unicode/utf8"
+)
+
+// SST files were originally written as a pair of files. The .bin file
+// contains the entries and the .index file contains a sparse index into the
+// .bin file. These files are still read so existing data can be opened, but
+// new SST files are always written in the block format.
+//
+// Entries of the .bin file are stored as:
+//
+//   key length  int32
+//   key
+//   value length int32
+//   value
+//   deleted     bool
+//   seq         uint64   Only present in version 2 files
+//
+// The .index file begins with a header of magic, version and sequence
+// number. Version 1 files do not have the magic number or version.
+// The rest of the index contains the first key of each block of entries:
+//
+//   key length int32
+//   key
+//   offset     int32    Offset of the block in the .bin file
+//
+// The length of a key was written as the number of runes in the key rather
+// than the number of bytes, so a key is read one rune at a time.
+
+// indexMagic identifies an index file that begins with a versioned header.
+// Index files written in the original format (version 1) do not have a magic
+// number and begin directly with the sequence number of the file.
+var indexMagic = [8]byte{'K', 'E', 'Y', 'V', 'A', 'I', 'D', 'X'}
+
+// readEntries reads all entries from the given legacy SST file pointer and
+// returns them as an array
+func readEntries(f *os.File, header SstFileHeader) ([]SstEntry, error) {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return decodeLegacyEntries(data, header)
+}
+
+// readDataBlockEntries reads the entries of a legacy SST file from offset
+// start up to (but not including) offset end. If end is negative the block
+// extends to the end of the file.
+func readDataBlockEntries(f *os.File, header SstFileHeader, start int, end int) ([]SstEntry, error) {
+	_, err := f.Seek(int64(start), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	if end < 0 {
+		data, err = ioutil.ReadAll(f)
+	} else if end < start {
+		return nil, fmt.Errorf("%w: invalid block offsets %d to %d", ErrCorrupt, start, end)
+	} else {
+		data = make([]byte, end-start)
+		_, err = f.ReadAt(data, int64(start))
+		err = corrupt(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeLegacyEntries(data, header)
+}
+
+// decodeLegacyEntries decodes every entry in data.
+func decodeLegacyEntries(data []byte, header SstFileHeader) ([]SstEntry, error) {
+	var lis []SstEntry
+	for len(data) > 0 {
+		e, n, err := decodeLegacyEntry(data, header)
+		if err != nil {
+			return lis, err
+		}
+		lis = append(lis, e)
+		data = data[n:]
+	}
+	return lis, nil
+}
+
+// decodeLegacyEntry decodes the entry at the start of data and returns it
+// along with its size in bytes. Entries from version 1 files are assigned
+// the sequence number of the file.
+func decodeLegacyEntry(data []byte, header SstFileHeader) (SstEntry, int, error) {
+	var e SstEntry
+
+	key, pos, err := decodeLegacyKey(data)
+	if err != nil {
+		return e, 0, err
+	}
+	e.Key = key
+
+	if len(data)-pos < 4 {
+		return e, 0, fmt.Errorf("%w: unexpected end of file", ErrCorrupt)
+	}
+	length := int32(binary.LittleEndian.Uint32(data[pos:]))
+	pos += 4
+	if length < 0 || int(length) > len(data)-pos {
+		return e, 0, fmt.Errorf("%w: invalid value length %d", ErrCorrupt, length)
+	}
+	e.Value = make([]byte, length)
+	copy(e.Value, data[pos:])
+	pos += int(length)
+
+	if len(data)-pos < 1 {
+		return e, 0, fmt.Errorf("%w: unexpected end of file", ErrCorrupt)
+	}
+	e.Deleted = data[pos] != 0
+	pos++
+
+	if header.Version < formatEntrySeq {
+		e.Seq = header.Seq
+	} else {
+		if len(data)-pos < 8 {
+			return e, 0, fmt.Errorf("%w: unexpected end of file", ErrCorrupt)
+		}
+		e.Seq = binary.LittleEndian.Uint64(data[pos:])
+		pos += 8
+	}
+	return e, pos, nil
+}
+
+// decodeLegacyKey decodes a key whose length is given as a number of runes.
+// Returns the key along with the number of bytes read from data.
+func decodeLegacyKey(data []byte) (string, int, error) {
+	if len(data) < 4 {
+		return "", 0, fmt.Errorf("%w: unexpected end of file", ErrCorrupt)
+	}
+	length := int32(binary.LittleEndian.Uint32(data))
+	if length < 0 || int(length) > len(data)-4 {
+		return "", 0, fmt.Errorf("%w: invalid key length %d", ErrCorrupt, length)
+	}
+	pos := 4
+	for i := int32(0); i < length; i++ {
+		if pos >= len(data) {
+			return "", 0, fmt.Errorf("%w: unexpected end of file", ErrCorrupt)
+		}
+		_, size := utf8.DecodeRune(data[pos:])
+		pos += size
+	}
+	return string(data[4:pos]), pos, nil
+}
+
+// readLegacyIndexFile reads the .index file that corresponds to the given
+// legacy SST file.
+func readLegacyIndexFile(filename string) ([]SstIndex, SstFileHeader, error) {
+	fp, err := os.Open(indexFileForBin(filename))
+	if err != nil {
+		return nil, SstFileHeader{}, err
+	}
+	defer fp.Close()
+
+	return readIndex(fp)
+}
+
+// readIndex reads and returns the contents of the given legacy SST index
+// file pointer.
+func readIndex(f *os.File) ([]SstIndex, SstFileHeader, error) {
+	var header SstFileHeader
+	var index []SstIndex
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return index, header, err
+	}
+	if len(data) < 8 {
+		return index, header, fmt.Errorf("%w: unexpected end of file", ErrCorrupt)
+	}
+
+	var magic [8]byte
+	copy(magic[:], data)
+	if magic == indexMagic {
+		if len(data) < 20 {
+			return index, header, fmt.Errorf("%w: unexpected end of file", ErrCorrupt)
+		}
+		header.Version = binary.LittleEndian.Uint32(data[8:])
+		header.Seq = binary.LittleEndian.Uint64(data[12:])
+		if header.Version != formatEntrySeq {
+			return index, header, fmt.Errorf("%w: unsupported index version %d", ErrCorrupt, header.Version)
+		}
+		data = data[20:]
+	} else {
+		// Legacy file, header only contains the sequence number
+		header.Version = formatLegacy
+		header.Seq = binary.LittleEndian.Uint64(data)
+		data = data[8:]
+	}
+
+	for len(data) > 0 {
+		key, n, err := decodeLegacyKey(data)
+		if err != nil {
+			return index, header, err
+		}
+		if len(data)-n < 4 {
+			return index, header, fmt.Errorf("%w: unexpected end of file", ErrCorrupt)
+		}
+		offset := int32(binary.LittleEndian.Uint32(data[n:]))
+		if offset < 0 {
+			return index, header, fmt.Errorf("%w: invalid offset %d", ErrCorrupt, offset)
+		}
+		index = append(index, SstIndex{Key: key, offset: int(offset)})
+		data = data[n+4:]
+	}
+
+	return index, header, nil
+}
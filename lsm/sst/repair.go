@@ -0,0 +1,87 @@
+package sst
+
+import (
+	"errors"
+	"fmt"
+	"github.com/justinethier/keyva/lsm/logger"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrInTree is returned by Repair for a legacy file that is part of a tree
+// with a manifest. Repairing it would replace the file with one of a
+// different name, which the manifest does not list.
+var ErrInTree = errors.New("sst: file is part of a tree")
+
+// Repair rewrites an SST file that contains corrupt data blocks, keeping
+// every entry that can still be read, and returns the number of data blocks
+// that were dropped. A file in the legacy format is always rewritten in the
+// block format. Data blocks of the repaired file are not compressed.
+//
+// Dropping a block may make older values of its keys visible again, so the
+// data in those blocks should be restored from elsewhere if possible. A file
+// whose footer or index is corrupt cannot be repaired.
+//
+// A legacy file cannot be repaired once the tree it belongs to has been
+// opened and recorded its files in a manifest, and ErrInTree is returned.
+// Merging its level of the tree rewrites the file in the block format.
+func Repair(filename string) (int, error) {
+	return RepairWithLogger(filename, logger.Default())
+}
+
+// RepairWithLogger is the same as Repair but reports each dropped block to l.
+func RepairWithLogger(filename string, l logger.Logger) (int, error) {
+	if isLegacy(filename) && inTree(filename) {
+		return 0, fmt.Errorf("%w: %s is listed in the manifest of the tree, merge its level to rewrite it",
+			ErrInTree, filename)
+	}
+	index, header, err := readIndexFile(filename)
+	if err != nil {
+		return 0, fmt.Errorf("%s: unable to repair: %w", filename, err)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var entries []SstEntry
+	dropped := 0
+	for i := range index {
+		block, err := readDataBlock(f, header, index, i)
+		if errors.Is(err, ErrCorrupt) {
+			l.Warn("dropping corrupt block", "file", filename, "block", i, "error", err)
+			dropped++
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		entries = append(entries, block...)
+	}
+	if dropped == 0 && !isLegacy(filename) {
+		return 0, nil
+	}
+
+	err = Create(sstBaseFilename(filename)+".sst", entries, header.Seq, nil)
+	if err != nil {
+		return 0, err
+	}
+	if isLegacy(filename) {
+		err = Remove(filename)
+	}
+	return dropped, err
+}
+
+// inTree returns true if filename is in the data directory of a tree, or
+// one of its level directories, and the tree has a CURRENT file naming its
+// manifest.
+func inTree(filename string) bool {
+	dir := filepath.Dir(filename)
+	if strings.HasPrefix(filepath.Base(dir), "level-") {
+		dir = filepath.Dir(dir)
+	}
+	_, err := os.Stat(dir + "/CURRENT")
+	return err == nil
+}
@@ -0,0 +1,193 @@
+package sst
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// A pure Go implementation of the Snappy block format. See
+// https://github.com/google/snappy/blob/main/format_description.txt
+//
+// The encoded data starts with the length of the decoded data as a uvarint,
+// followed by a sequence of elements. The low two bits of the first byte of
+// each element give its type:
+//
+//   00  literal, the length is stored in the upper six bits or in the
+//       1-4 bytes that follow, then the literal bytes
+//   01  copy with a 3-bit length (4-11) and 11-bit offset
+//   10  copy with a 6-bit length (1-64) and 2 byte offset
+//   11  copy with a 6-bit length (1-64) and 4 byte offset
+//
+// The encoder only looks for matches within the previous 64KB, so it never
+// writes 4 byte offsets, but the decoder accepts them.
+
+const (
+	snappyTagLiteral = 0x00
+	snappyTagCopy1   = 0x01
+	snappyTagCopy2   = 0x02
+	snappyTagCopy4   = 0x03
+
+	snappyTableBits = 14
+	snappyMaxOffset = 1<<16 - 1
+)
+
+var errSnappyCorrupt = errors.New("snappy: corrupt input")
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Id() uint8 { return 1 }
+
+func (snappyCompressor) Compress(dst, src []byte) ([]byte, error) {
+	return snappyEncode(dst, src), nil
+}
+
+func (snappyCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	return snappyDecode(dst, src)
+}
+
+func snappyHash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - snappyTableBits)
+}
+
+// snappyEncode appends the encoded form of src to dst.
+func snappyEncode(dst, src []byte) []byte {
+	dst = appendUvarint(dst, uint64(len(src)))
+
+	// table holds the position+1 of the last occurrence of each hashed
+	// 4 byte sequence, zero means there is none
+	var table [1 << snappyTableBits]int32
+	lit := 0
+	for i := 0; i+4 <= len(src); {
+		u := binary.LittleEndian.Uint32(src[i:])
+		h := snappyHash(u)
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if cand < 0 || i-cand > snappyMaxOffset || binary.LittleEndian.Uint32(src[cand:]) != u {
+			i++
+			continue
+		}
+
+		n := 4
+		for i+n < len(src) && src[cand+n] == src[i+n] {
+			n++
+		}
+		dst = snappyAppendLiteral(dst, src[lit:i])
+		dst = snappyAppendCopy(dst, i-cand, n)
+		i += n
+		lit = i
+	}
+	return snappyAppendLiteral(dst, src[lit:])
+}
+
+func snappyAppendLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|snappyTagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyTagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappyTagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+func snappyAppendCopy(dst []byte, offset, length int) []byte {
+	// Long copies are split up, leaving at least 4 bytes for the last one
+	// so it can use the shorter encoding where possible
+	for length >= 68 {
+		dst = append(dst, 63<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 4 && length <= 11 && offset < 2048 {
+		return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|snappyTagCopy1, byte(offset))
+	}
+	return append(dst, byte(length-1)<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+}
+
+// snappyDecode appends the decoded form of src to dst.
+func snappyDecode(dst, src []byte) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 || n > uint64(len(src))*32+64 {
+		return nil, errSnappyCorrupt
+	}
+	src = src[k:]
+	start := len(dst)
+	end := start + int(n)
+	if cap(dst) < end {
+		buf := make([]byte, start, end)
+		copy(buf, dst)
+		dst = buf
+	}
+
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 0x03 {
+		case snappyTagLiteral:
+			x := uint32(tag >> 2)
+			src = src[1:]
+			if x >= 60 {
+				b := int(x - 59)
+				if len(src) < b {
+					return nil, errSnappyCorrupt
+				}
+				x = 0
+				for j := b - 1; j >= 0; j-- {
+					x = x<<8 | uint32(src[j])
+				}
+				src = src[b:]
+			}
+			length = int(x) + 1
+			if length <= 0 || length > len(src) || len(dst)+length > end {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case snappyTagCopy1:
+			if len(src) < 2 {
+				return nil, errSnappyCorrupt
+			}
+			length = 4 + int(tag>>2)&0x07
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case snappyTagCopy2:
+			if len(src) < 3 {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case snappyTagCopy4:
+			if len(src) < 5 {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst)-start || len(dst)+length > end {
+			return nil, errSnappyCorrupt
+		}
+		// Copies may overlap the bytes they produce, so go one byte at a time
+		for j := 0; j < length; j++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if len(dst) != end {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
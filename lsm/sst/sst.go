@@ -1,14 +1,23 @@
 package sst
 
 import (
-	"log"
-	"time"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
 )
 
-func check(e error) {
-	if e != nil {
-		panic(e)
+// ErrCorrupt is returned when the contents of an SST file cannot be read
+// because the file is truncated or contains invalid data.
+var ErrCorrupt = errors.New("sst: corrupt file")
+
+// corrupt reports an unexpected end of file as ErrCorrupt. Any other error
+// is returned as-is.
+func corrupt(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: unexpected end of file", ErrCorrupt)
 	}
+	return err
 }
 
 // findBlock finds the index that may contain the given key. That is, the key is between the starting point of
@@ -50,71 +59,127 @@ func findBlock(key string, tbl []SstIndex) (*SstIndex, *SstIndex, int, bool) {
 	return nil, nil, -1, false
 }
 
-// find searches the given entries for key and returns the corresponding value if found.
-func findValue(key string, entries []SstEntry) (SstEntry, bool) {
+// findValue searches the given entries for key and returns the most recent
+// entry that is visible at sequence number seq, if found.
+func findValue(key string, seq uint64, entries []SstEntry) (SstEntry, bool) {
 	var entry SstEntry
 	var left = 0
-	var right = len(entries) - 1
+	var right = len(entries)
 
-	for left <= right {
+	// Find the first entry for key, which is also the newest
+	for left < right {
 		mid := left + int((right-left)/2)
 		//log.Println("DEBUG FEV", key, left, right, mid, entries[mid])
 
-		// Found the key
-		if entries[mid].Key == key {
-			return entries[mid], true
+		if entries[mid].Key < key {
+			left = mid + 1 // Key would be found after this entry
+		} else {
+			right = mid // Key would be found at or before this entry
 		}
+	}
 
-		if entries[mid].Key > key {
-			right = mid - 1 // Key would be found before this entry
-		} else {
-			left = mid + 1 // Key would be found after this entry
+	// Skip any entries written after seq
+	for i := left; i < len(entries) && entries[i].Key == key; i++ {
+		if entries[i].Seq <= seq {
+			return entries[i], true
 		}
 	}
 
 	return entry, false
 }
 
-func Find(key string, lvl []SstLevel, path string) ([]byte, bool) {
+// FilterStats counts how useful the bloom filters of SST files were to
+// FindEntry. A false positive is a file whose filter matched the key but
+// that did not contain a visible entry for it. The counters are updated
+// atomically, use Load to read them.
+type FilterStats struct {
+	Negatives      uint64 // Files skipped because their filter did not match
+	TruePositives  uint64
+	FalsePositives uint64
+}
+
+// Load returns a copy of the counters.
+func (s *FilterStats) Load() FilterStats {
+	return FilterStats{
+		Negatives:      atomic.LoadUint64(&s.Negatives),
+		TruePositives:  atomic.LoadUint64(&s.TruePositives),
+		FalsePositives: atomic.LoadUint64(&s.FalsePositives),
+	}
+}
+
+// count adds one to the counter for the outcome of a filter check, unless
+// s is nil. The key was in the filter if matched is true, and in the file
+// if found is true.
+func (s *FilterStats) count(matched, found bool) {
+	if s == nil {
+		return
+	}
+	if !matched {
+		atomic.AddUint64(&s.Negatives, 1)
+	} else if found {
+		atomic.AddUint64(&s.TruePositives, 1)
+	} else {
+		atomic.AddUint64(&s.FalsePositives, 1)
+	}
+}
+
+// Find searches the SST levels for key and returns the most recent value
+// visible at sequence number seq.
+//
+// Data blocks are read through the given cache, which may be nil. If fill
+// is false blocks read from disk are not added to the cache.
+func Find(key string, seq uint64, lvl []SstLevel, path string, cache *BlockCache, fill bool) ([]byte, bool, error) {
+	entry, found, err := FindEntry(key, seq, lvl, path, cache, fill, nil)
+	if found && !entry.Deleted {
+		return entry.Value, true, nil
+	}
+	var rv []byte
+	return rv, false, err
+}
+
+// FindEntry searches the SST levels for key and returns the most recent
+// entry visible at sequence number seq. The entry may be a tombstone.
+// Blocks are read through the cache in the same way as Find. Use of the
+// bloom filters is counted in stats, which may be nil.
+func FindEntry(key string, seq uint64, lvl []SstLevel, path string, cache *BlockCache, fill bool, stats *FilterStats) (SstEntry, bool, error) {
 	// Search in reverse order, newest file to oldest
 	for l := 0; l < len(lvl); l++ {
 		for i := len(lvl[l].Files) - 1; i >= 0; i-- {
-			sstf := lvl[l].Files[i]
-			if sstf.Filter.Test(key) {
-				// Only read from disk if key is in the filter
-				var entries []SstEntry
-
-				// Find appropriate data block using sparse index
-				if thisIndex, nextIndex, idx, found := findBlock(key, sstf.Index); found {
-					if len(sstf.Cache[idx].Data) > 0 {
-						entries = sstf.Cache[idx].Data
-					} else {
-						// No cache, read file from disk and cache entries
-						log.Println("DEBUG loading and caching entries from file", sstf.Filename)
-						filename := PathForLevel(path, l) + "/" + sstf.Filename
-						log.Println("DEBUG", thisIndex, nextIndex)
-						start := thisIndex.offset
-						end := -1
-						if nextIndex != nil {
-							end = nextIndex.offset
-						}
-						entries = LoadBlock(filename, start, end)
-						sstf.Cache[idx].Data = entries
-					}
-					sstf.Cache[idx].CachedAt = time.Now()
-				}
-
-				// Search for key in the file's entries
-				if entry, found := findValue(key, entries); found {
-					if entry.Deleted {
-						return entry.Value, false
-					} else {
-						return entry.Value, true
-					}
-				}
+			sstf := &lvl[l].Files[i]
+			if l > 0 && !sstf.Overlaps(key, key) {
+				continue // Files below level 0 do not overlap
+			}
+			if !sstf.Filter.Test(key) {
+				stats.count(false, false)
+				continue // Only read from disk if key is in the filter
 			}
+
+			// Find appropriate data block using sparse index
+			_, _, idx, found := findBlock(key, sstf.Index)
+			if !found {
+				stats.count(true, false)
+				continue
+			}
+			filename := PathForLevel(path, l) + "/" + sstf.Filename
+			block, err := cache.load(sstf.id, idx, fill, func() (*dataBlock, error) {
+				return loadBlockData(filename, sstf.Header, sstf.Index, idx)
+			})
+			if err != nil {
+				return SstEntry{}, false, err
+			}
+
+			// Search for key in the block's entries
+			entry, found, err := block.find(key, seq)
+			if err != nil {
+				return SstEntry{}, false, fmt.Errorf("%s: %w", filename, err)
+			}
+			if found {
+				stats.count(true, true)
+				return entry, true, nil
+			}
+			stats.count(true, false)
 		}
 	}
-	var rv []byte
-	return rv, false
+	var empty SstEntry
+	return empty, false, nil
 }
@@ -2,12 +2,20 @@ package sst
 
 import (
 	"github.com/justinethier/keyva/bloom"
-	"os"
-	"time"
 )
 
 type SstFileHeader struct {
-	Seq uint64
+	Version uint32 // Format version of the SST file
+	Seq     uint64 // Sequence number of the latest entry in the file
+	// The following are only stored in files in the block format. NewSstFile
+	// fills them in for legacy files.
+	Entries  uint64 // Number of entries in the file
+	Smallest string // First key in the file
+	Largest  string // Last key in the file
+	// Unix time the data in the file was written. Files created by Compact
+	// use the latest time of the files they were created from. Zero if
+	// unknown, in which case NewSstFile uses the file's modification time.
+	Time int64
 }
 
 type SstLevel struct {
@@ -16,38 +24,55 @@ type SstLevel struct {
 
 type SstFile struct {
 	Filename string
+	Header   SstFileHeader
 	Filter   *bloom.Filter
 	Index    []SstIndex
-	Cache    []SstIndexData
+	Smallest string // First key in the file
+	Largest  string // Last key in the file
+	Size     int64  // Size of the file on disk in bytes
+	id       uint64 // Identifies the file's blocks in a BlockCache
+}
+
+// Overlaps returns true if the file may contain keys between smallest and
+// largest, inclusive.
+func (f *SstFile) Overlaps(smallest, largest string) bool {
+	return f.Header.Entries != 0 && f.Smallest <= largest && f.Largest >= smallest
 }
 
 type SstIndex struct {
 	Key    string
 	offset int
-}
-
-type SstIndexData struct {
-	Data     []SstEntry // cached file contents
-	CachedAt time.Time  // timestamp when cache was last accessed
-	// may convert to seconds (best way to compare???) using -
-	//now := time.Now()      // current local time
-	//sec := now.Unix()      // number of seconds since January 1, 1970 UTC
-	// TODO: longer-term, we will time out the cache and have a GC that
-	//       empties it if it has not been accessed for THRESHOLD
-	//       will also want a default threshold and a way to change it.
-	//       maybe it will be a member of LsmTree
+	size   int // Size of the data block, unknown for legacy files
 }
 
 type SstEntry struct {
 	Key     string
 	Value   []byte
 	Deleted bool
+	Seq     uint64 // Sequence number assigned when the entry was written
+	Expires int64  // Unix time in nanoseconds the entry expires, zero if never
+}
+
+// Expired returns true if the entry has expired as of the given Unix time in
+// nanoseconds. An expired entry hides older entries for its key, the same
+// as a tombstone.
+func (e *SstEntry) Expired(now int64) bool {
+	return e.Expires != 0 && e.Expires <= now
+}
+
+// entryLess orders entries by key. Entries with the same key are ordered
+// from newest to oldest (IE largest sequence number first).
+func entryLess(a, b *SstEntry) bool {
+	if a.Key != b.Key {
+		return a.Key < b.Key
+	}
+	return a.Seq > b.Seq
 }
 
 type SstHeapNode struct {
 	Seq   uint64
 	Entry *SstEntry
-	File  *os.File
+	Iter  *Iterator
 }
 
 // An min-heap of SST entries
@@ -55,7 +80,7 @@ type SstHeapNode struct {
 type SstHeap []*SstHeapNode
 
 func (h SstHeap) Len() int           { return len(h) }
-func (h SstHeap) Less(i, j int) bool { return h[i].Entry.Key < h[j].Entry.Key }
+func (h SstHeap) Less(i, j int) bool { return entryLess(h[i].Entry, h[j].Entry) }
 func (h SstHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
 
 func (h *SstHeap) Push(x interface{}) {
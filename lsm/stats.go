@@ -0,0 +1,168 @@
+package lsm
+
+import (
+	"fmt"
+	"github.com/justinethier/keyva/lsm/sst"
+	"io"
+	"time"
+)
+
+// Stats describes the contents of the tree and the work it has done since
+// it was opened, see LsmTree.Stats.
+type Stats struct {
+	// SST files in each level of the tree
+	Levels []LevelStats
+
+	Memtable MemtableStats
+
+	// Bytes of Wal files on disk
+	WalSize int64
+
+	BlockCache sst.CacheStats
+	Filter     sst.FilterStats
+
+	// Memtables written to SST files, and the bytes and time taken
+	Flushes    uint64
+	FlushBytes int64
+	FlushTime  time.Duration
+
+	// Merges of SST files, the bytes of the files merged and of the new
+	// files written, and the time taken
+	Compactions            uint64
+	CompactionBytesRead    int64
+	CompactionBytesWritten int64
+	CompactionTime         time.Duration
+
+	// Writes held back until a full memtable was flushed, and the time
+	// they waited
+	WriteStalls    uint64
+	WriteStallTime time.Duration
+}
+
+// LevelStats describes the SST files in a level of the tree.
+type LevelStats struct {
+	Files int
+	Size  int64 // Bytes on disk
+	// Estimated number of keys, from the bloom filter of each file. A key
+	// with entries in more than one file is counted more than once.
+	Keys int64
+}
+
+// Stats returns statistics about the tree.
+func (tree *LsmTree) Stats() (Stats, error) {
+	if tree.isClosed() {
+		return Stats{}, ErrClosed
+	}
+	tree.statsLock.Lock()
+	s := tree.stats
+	tree.statsLock.Unlock()
+
+	v := tree.version()
+	s.Levels = make([]LevelStats, len(v.levels))
+	for l := range v.levels {
+		s.Levels[l].Files = len(v.levels[l].Files)
+		s.Levels[l].Size = levelSize(v.levels[l].Files)
+		for _, f := range v.levels[l].Files {
+			s.Levels[l].Keys += f.Filter.Count()
+		}
+	}
+	tree.unref(v)
+
+	s.Memtable = tree.MemtableStats()
+	s.BlockCache = tree.BlockCacheStats()
+	s.Filter = tree.filterStats.Load()
+	var err error
+	s.WalSize, err = tree.wal.Size()
+	return s, err
+}
+
+// recordFlush counts a memtable written to an SST file of the given size.
+func (tree *LsmTree) recordFlush(start time.Time, size int64) {
+	tree.statsLock.Lock()
+	defer tree.statsLock.Unlock()
+	tree.stats.Flushes++
+	tree.stats.FlushBytes += size
+	tree.stats.FlushTime += time.Since(start)
+}
+
+// recordCompaction counts a merge of files totalling read bytes into the
+// given new files.
+func (tree *LsmTree) recordCompaction(start time.Time, read int64, written []sst.SstFile) {
+	tree.statsLock.Lock()
+	defer tree.statsLock.Unlock()
+	tree.stats.Compactions++
+	tree.stats.CompactionBytesRead += read
+	tree.stats.CompactionBytesWritten += levelSize(written)
+	tree.stats.CompactionTime += time.Since(start)
+}
+
+// recordWriteStall counts a write that waited for a memtable to be flushed
+// and reports it to the event listener.
+func (tree *LsmTree) recordWriteStall(start time.Time) {
+	d := time.Since(start)
+	tree.statsLock.Lock()
+	tree.stats.WriteStalls++
+	tree.stats.WriteStallTime += d
+	tree.statsLock.Unlock()
+	tree.listener.OnWriteStall(WriteStallInfo{Duration: d})
+}
+
+// WritePrometheus writes the statistics in the Prometheus text exposition
+// format.
+func (s *Stats) WritePrometheus(w io.Writer) error {
+	type sample struct {
+		labels string
+		value  interface{}
+	}
+	var err error
+	metric := func(name, kind, help string, samples ...sample) {
+		if err != nil {
+			return
+		}
+		_, err = fmt.Fprintf(w, "# HELP keyva_%s %s\n# TYPE keyva_%s %s\n", name, help, name, kind)
+		for _, smp := range samples {
+			if err == nil {
+				_, err = fmt.Fprintf(w, "keyva_%s%s %v\n", name, smp.labels, smp.value)
+			}
+		}
+	}
+	value := func(v interface{}) sample {
+		return sample{value: v}
+	}
+	perLevel := func(f func(l *LevelStats) interface{}) []sample {
+		var samples []sample
+		for i := range s.Levels {
+			samples = append(samples, sample{fmt.Sprintf(`{level="%d"}`, i), f(&s.Levels[i])})
+		}
+		return samples
+	}
+
+	metric("level_files", "gauge", "Number of SST files in each level.",
+		perLevel(func(l *LevelStats) interface{} { return l.Files })...)
+	metric("level_bytes", "gauge", "Size of the SST files in each level.",
+		perLevel(func(l *LevelStats) interface{} { return l.Size })...)
+	metric("level_keys", "gauge", "Estimated number of keys in each level.",
+		perLevel(func(l *LevelStats) interface{} { return l.Keys })...)
+	metric("memtable_entries", "gauge", "Number of entries in the memtable.", value(s.Memtable.Entries))
+	metric("memtable_bytes", "gauge", "Approximate memory used by the memtable.", value(s.Memtable.Size))
+	metric("immutable_memtables", "gauge", "Full memtables waiting to be flushed.", value(s.Memtable.Immutables))
+	metric("immutable_memtable_bytes", "gauge", "Approximate memory used by full memtables.", value(s.Memtable.ImmutableSize))
+	metric("wal_bytes", "gauge", "Size of the write-ahead log files.", value(s.WalSize))
+	metric("block_cache_hits_total", "counter", "Reads that found their block in the block cache.", value(s.BlockCache.Hits))
+	metric("block_cache_misses_total", "counter", "Reads that loaded their block from disk.", value(s.BlockCache.Misses))
+	metric("block_cache_bytes", "gauge", "Size of the blocks in the block cache.", value(s.BlockCache.Size))
+	metric("block_cache_capacity_bytes", "gauge", "Capacity of the block cache.", value(s.BlockCache.Capacity))
+	metric("bloom_filter_negatives_total", "counter", "SST files skipped by their bloom filter.", value(s.Filter.Negatives))
+	metric("bloom_filter_true_positives_total", "counter", "Bloom filter matches for keys found in the file.", value(s.Filter.TruePositives))
+	metric("bloom_filter_false_positives_total", "counter", "Bloom filter matches for keys not found in the file.", value(s.Filter.FalsePositives))
+	metric("flushes_total", "counter", "Memtables written to SST files.", value(s.Flushes))
+	metric("flush_bytes_total", "counter", "Bytes of SST files written by flushes.", value(s.FlushBytes))
+	metric("flush_seconds_total", "counter", "Time spent flushing memtables.", value(s.FlushTime.Seconds()))
+	metric("compactions_total", "counter", "Merges of SST files.", value(s.Compactions))
+	metric("compaction_read_bytes_total", "counter", "Bytes of SST files merged.", value(s.CompactionBytesRead))
+	metric("compaction_written_bytes_total", "counter", "Bytes of SST files written by merges.", value(s.CompactionBytesWritten))
+	metric("compaction_seconds_total", "counter", "Time spent merging SST files.", value(s.CompactionTime.Seconds()))
+	metric("write_stalls_total", "counter", "Writes held back until a memtable was flushed.", value(s.WriteStalls))
+	metric("write_stall_seconds_total", "counter", "Time writes were held back.", value(s.WriteStallTime.Seconds()))
+	return err
+}
@@ -0,0 +1,67 @@
+package lsm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tbl = newTree(t, dir, 10)
+	defer tbl.Close()
+	for i := 0; i < 25; i++ {
+		tbl.Set(mergeTestKey(i), []byte("value"))
+	}
+	if err := tbl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Merge(0); err != nil {
+		t.Fatal(err)
+	}
+	tbl.Set("a", []byte("value"))
+	tbl.Get(mergeTestKey(1))
+	tbl.Get("b")
+
+	s, err := tbl.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Levels) != 2 || s.Levels[0].Files != 0 || s.Levels[1].Files == 0 ||
+		s.Levels[1].Keys == 0 || s.Levels[1].Size == 0 {
+		t.Error("Unexpected level stats", s.Levels)
+	}
+	if s.Memtable.Entries != 1 || s.WalSize == 0 {
+		t.Error("Unexpected memtable stats", s.Memtable, s.WalSize)
+	}
+	if s.Flushes != 3 || s.FlushBytes == 0 {
+		t.Error("Unexpected flush stats", s.Flushes, s.FlushBytes)
+	}
+	if s.Compactions != 1 || s.CompactionBytesRead != s.FlushBytes || s.CompactionBytesWritten == 0 {
+		t.Error("Unexpected compaction stats", s.Compactions, s.CompactionBytesRead, s.CompactionBytesWritten)
+	}
+	if s.Filter.TruePositives != 1 || s.BlockCache.Misses == 0 {
+		t.Error("Unexpected read stats", s.Filter, s.BlockCache)
+	}
+
+	var buf bytes.Buffer
+	if err := s.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE keyva_flushes_total counter\nkeyva_flushes_total 3\n",
+		"keyva_level_files{level=\"0\"} 0\n",
+		"keyva_compactions_total 1\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Error("Expected metrics to contain", line, "but received", buf.String())
+		}
+	}
+}
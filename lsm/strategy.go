@@ -0,0 +1,244 @@
+package lsm
+
+import (
+	"github.com/justinethier/keyva/lsm/sst"
+	"time"
+)
+
+// CompactionStrategy decides which SST files the merge job merges as the
+// tree grows. A strategy is selected with MergeSettings.Strategy.
+type CompactionStrategy interface {
+	// Pick returns the next compaction to run, or nil if no files need to be
+	// merged. levels holds the files in each level of the tree. Files in
+	// level 0 are ordered from oldest to newest and files in the levels below
+	// it are ordered by key.
+	//
+	// Pick is only called by the merge job, one call at a time.
+	Pick(levels []sst.SstLevel, settings MergeSettings) *Compaction
+}
+
+// Compaction describes a set of SST files to merge.
+type Compaction struct {
+	// Level containing the files to merge
+	Level int
+
+	// Files to merge. Files in level 0 may contain the same keys, so they
+	// must be a run of consecutive files. Files merged from level 0 into
+	// level 1 must include the oldest file in level 0.
+	Files []sst.SstFile
+
+	// Merge the files into the next level, along with any files there that
+	// contain the same keys. Otherwise the files are merged into new files
+	// that replace them in the same level.
+	NextLevel bool
+}
+
+// LeveledStrategy moves data down the levels of the tree. Level 0 is merged
+// into level 1 once it contains more than MergeSettings.NumberOfSstFiles
+// files or its data is older than MergeSettings.TimeWindow.
+//
+// If MergeSettings.DataSize is set each level below it has a target size,
+// and once a level is larger than its target a single file is merged into
+// the next level. Otherwise a level is merged into the next one in full
+// once it contains too many files.
+//
+// This is the default strategy.
+type LeveledStrategy struct {
+	// Largest key of the last file merged from each level
+	pointers map[int]string
+}
+
+func (s *LeveledStrategy) Pick(levels []sst.SstLevel, settings MergeSettings) *Compaction {
+	files := levels[0].Files
+	if settings.NumberOfSstFiles > 0 && len(files) > settings.NumberOfSstFiles {
+		return &Compaction{Level: 0, Files: files, NextLevel: true}
+	}
+	if settings.TimeWindow > 0 && len(files) > 0 {
+		age := time.Since(time.Unix(files[0].Header.Time, 0))
+		if age > time.Duration(settings.TimeWindow)*time.Second {
+			return &Compaction{Level: 0, Files: files, NextLevel: true}
+		}
+	}
+
+	// The bottom level is never merged into another level, it grows as
+	// needed instead
+	for level := 1; level < len(levels); level++ {
+		if settings.MaxLevels > 0 && level >= settings.MaxLevels {
+			break
+		}
+
+		files := levels[level].Files
+		if settings.DataSize > 0 {
+			if levelSize(files) > levelTarget(level, settings) {
+				return &Compaction{Level: level, Files: s.next(level, files), NextLevel: true}
+			}
+		} else if settings.NumberOfSstFiles > 0 &&
+			len(files) > settings.NumberOfSstFiles*(level+1) {
+			// Allow (num_files * level) files in each level so a merge
+			// does not immediately cascade to the levels below it
+			return &Compaction{Level: level, Files: files, NextLevel: true}
+		}
+	}
+	return nil
+}
+
+// next picks a single file to merge from level. Files are picked in key
+// order, starting after the last file merged from the level, so every range
+// of keys in the level is merged in turn.
+func (s *LeveledStrategy) next(level int, files []sst.SstFile) []sst.SstFile {
+	pick := files[0]
+	if last, ok := s.pointers[level]; ok {
+		for _, f := range files {
+			if f.Smallest > last {
+				pick = f
+				break
+			}
+		}
+	}
+	if s.pointers == nil {
+		s.pointers = make(map[int]string)
+	}
+	s.pointers[level] = pick.Largest
+	return []sst.SstFile{pick}
+}
+
+// levelTarget returns the size in bytes that level may grow to before its
+// files are merged into the next level.
+func levelTarget(level int, settings MergeSettings) int64 {
+	multiplier := int64(settings.LevelSizeMultiplier)
+	if multiplier < 1 {
+		multiplier = defaultLevelSizeMultiplier
+	}
+	target := int64(settings.DataSize)
+	for l := 1; l < level; l++ {
+		target *= multiplier
+	}
+	return target
+}
+
+// levelSize returns the total size of the given files in bytes.
+func levelSize(files []sst.SstFile) int64 {
+	var size int64
+	for _, f := range files {
+		size += f.Size
+	}
+	return size
+}
+
+// SizeTieredStrategy keeps data in level 0 and merges files of a similar
+// size together, so each file is rewritten a small number of times. This
+// suits write heavy workloads at the cost of slower reads, since a key may
+// be found in many files.
+//
+// Files are grouped into buckets of consecutive files, oldest first, whose
+// size is within BucketLow and BucketHigh times the average size of the
+// bucket. The bucket with the most files is merged once it has at least
+// MinFiles files.
+type SizeTieredStrategy struct {
+	// Minimum number of files in a bucket before it is merged, defaults to 4
+	MinFiles int
+
+	// Maximum number of files merged at once, defaults to 32
+	MaxFiles int
+
+	// Bounds of the size of files in a bucket relative to its average size,
+	// default to 0.5 and 1.5
+	BucketLow  float64
+	BucketHigh float64
+
+	// Files smaller than this many bytes are all placed in the same bucket,
+	// defaults to 1MB
+	MinSize int64
+}
+
+func (s *SizeTieredStrategy) Pick(levels []sst.SstLevel, settings MergeSettings) *Compaction {
+	minFiles := defaultInt(s.MinFiles, 4)
+	maxFiles := defaultInt(s.MaxFiles, 32)
+	low, high := s.BucketLow, s.BucketHigh
+	if low <= 0 {
+		low = 0.5
+	}
+	if high <= 0 {
+		high = 1.5
+	}
+	minSize := s.MinSize
+	if minSize <= 0 {
+		minSize = 1 << 20
+	}
+
+	var best, bucket []sst.SstFile
+	var total int64
+	for _, f := range levels[0].Files {
+		if len(bucket) > 0 {
+			avg := total / int64(len(bucket))
+			similar := (f.Size < minSize && avg < minSize) ||
+				(float64(f.Size) >= float64(avg)*low && float64(f.Size) <= float64(avg)*high)
+			if !similar {
+				if len(bucket) > len(best) {
+					best = bucket
+				}
+				bucket, total = nil, 0
+			}
+		}
+		bucket = append(bucket, f)
+		total += f.Size
+	}
+	if len(bucket) > len(best) {
+		best = bucket
+	}
+
+	if len(best) < minFiles {
+		return nil
+	}
+	if len(best) > maxFiles {
+		best = best[:maxFiles]
+	}
+	return &Compaction{Level: 0, Files: best}
+}
+
+// TimeWindowStrategy keeps data in level 0 and groups files by the time
+// their data was written. Files in the current window are merged once there
+// are at least MinFiles of them, and once a window has passed all of its
+// files are merged into one. Files from different windows are never merged
+// together, so data that expires at the same time stays in the same files.
+type TimeWindowStrategy struct {
+	// Length of each window, defaults to one day
+	Window time.Duration
+
+	// Minimum number of files in the current window before they are
+	// merged, defaults to 4
+	MinFiles int
+}
+
+func (s *TimeWindowStrategy) Pick(levels []sst.SstLevel, settings MergeSettings) *Compaction {
+	window := int64(s.Window / time.Second)
+	if window <= 0 {
+		window = 24 * 60 * 60
+	}
+	minFiles := defaultInt(s.MinFiles, 4)
+	current := time.Now().Unix() / window
+
+	// Runs of consecutive files from the same window, oldest first
+	files := levels[0].Files
+	for start := 0; start < len(files); {
+		w := files[start].Header.Time / window
+		end := start + 1
+		for end < len(files) && files[end].Header.Time/window == w {
+			end++
+		}
+		run := files[start:end]
+		if (w < current && len(run) > 1) || (w >= current && len(run) >= minFiles) {
+			return &Compaction{Level: 0, Files: run}
+		}
+		start = end
+	}
+	return nil
+}
+
+// defaultInt returns n, or def if n is not set.
+func defaultInt(n int, def int) int {
+	if n <= 0 {
+		return def
+	}
+	return n
+}
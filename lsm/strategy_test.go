@@ -0,0 +1,127 @@
+package lsm
+
+import (
+	"fmt"
+	"github.com/justinethier/keyva/lsm/sst"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func testLevels(sizes []int64, times []int64) []sst.SstLevel {
+	var files []sst.SstFile
+	for i := range sizes {
+		f := sst.SstFile{Filename: sst.NumberedFilename(i), Size: sizes[i]}
+		f.Header.Seq = uint64(i + 1)
+		if times != nil {
+			f.Header.Time = times[i]
+		}
+		files = append(files, f)
+	}
+	return []sst.SstLevel{{Files: files}}
+}
+
+func filenames(c *Compaction) []string {
+	if c == nil {
+		return nil
+	}
+	var names []string
+	for _, f := range c.Files {
+		names = append(names, f.Filename)
+	}
+	return names
+}
+
+func TestSizeTieredStrategy(t *testing.T) {
+	s := &SizeTieredStrategy{MinFiles: 3, MinSize: 10}
+	levels := testLevels([]int64{100, 5000, 4000, 6000, 120, 90, 110, 100}, nil)
+	c := s.Pick(levels, MergeSettings{})
+	if names := filenames(c); len(names) != 4 || names[0] != "sst-0004.sst" || c.NextLevel {
+		t.Error("Unexpected compaction", names)
+	}
+
+	s.MaxFiles = 2
+	if names := filenames(s.Pick(levels, MergeSettings{})); len(names) != 2 || names[0] != "sst-0004.sst" {
+		t.Error("Unexpected compaction", names)
+	}
+
+	s = &SizeTieredStrategy{MinFiles: 5, MinSize: 10}
+	if c := s.Pick(levels, MergeSettings{}); c != nil {
+		t.Error("Unexpected compaction", filenames(c))
+	}
+}
+
+func TestTimeWindowStrategy(t *testing.T) {
+	hour := int64(60 * 60)
+	now := time.Now().Unix() / hour * hour
+	s := &TimeWindowStrategy{Window: time.Hour, MinFiles: 3}
+	times := []int64{now - 3*hour, now - 2*hour, now - 2*hour + 1, now, now + 1}
+	levels := testLevels([]int64{1, 1, 1, 1, 1}, times)
+
+	// Files from a window that has passed are merged together
+	if names := filenames(s.Pick(levels, MergeSettings{})); len(names) != 2 || names[0] != "sst-0001.sst" {
+		t.Error("Unexpected compaction", names)
+	}
+
+	// Files in the current window wait for MinFiles
+	levels = testLevels([]int64{1, 1, 1}, []int64{now - 2*hour, now, now + 1})
+	if c := s.Pick(levels, MergeSettings{}); c != nil {
+		t.Error("Unexpected compaction", filenames(c))
+	}
+	levels = testLevels([]int64{1, 1, 1, 1}, []int64{now - 2*hour, now, now + 1, now + 2})
+	if names := filenames(s.Pick(levels, MergeSettings{})); len(names) != 3 || names[0] != "sst-0001.sst" {
+		t.Error("Unexpected compaction", names)
+	}
+}
+
+func TestTieredMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-strategy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tbl = newTree(t, dir, 100)
+	for i := 1; i <= 3; i++ {
+		tbl.Set("key", []byte(fmt.Sprint("value ", i)))
+		tbl.Set(fmt.Sprint("key ", i), []byte("a"))
+		if err := tbl.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := tbl.levelFiles(0)
+	if len(files) != 3 {
+		t.Fatal("Unexpected number of files in level 0", len(files))
+	}
+
+	// Only consecutive files from level 0 may be merged together
+	err = tbl.runCompaction(&Compaction{Level: 0, Files: []sst.SstFile{files[0], files[2]}})
+	if err == nil {
+		t.Error("Expected error merging files that are not consecutive")
+	}
+
+	// The two oldest files are merged, so the merged file is named after
+	// the newest file but still holds older data
+	tbl.SetMergeSettings(MergeSettings{Strategy: &SizeTieredStrategy{MinFiles: 2, MaxFiles: 2}})
+	tbl.mergeJob(tbl.mergeSettings())
+	files = tbl.levelFiles(0)
+	if len(files) != 1 {
+		t.Fatal("Unexpected number of files in level 0", len(files))
+	}
+	if val, err := tbl.Get("key"); err != nil || string(val) != "value 3" {
+		t.Error("Unexpected value", string(val), err)
+	}
+	tbl.Close()
+
+	tbl = newTree(t, dir, 100)
+	defer tbl.Close()
+	if val, err := tbl.Get("key"); err != nil || string(val) != "value 3" {
+		t.Error("Unexpected value after reopening", string(val), err)
+	}
+	for i := 1; i <= 3; i++ {
+		if _, err := tbl.Get(fmt.Sprint("key ", i)); err != nil {
+			t.Error("Expected to find key", i, err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package lsm
+
+import (
+	"time"
+)
+
+// maxWriteGroup is the most writes that are applied together and share a
+// single sync of the Wal.
+const maxWriteGroup = 128
+
+// SetWalSync determines when writes to the Wal are synced to disk. See
+// SyncMode for the trade-offs between each mode.
+func (tree *LsmTree) SetWalSync(s WalSyncSettings) error {
+	if tree.isClosed() {
+		return ErrClosed
+	}
+	if s.Mode == SyncInterval && s.Interval <= 0 {
+		s.Interval = time.Second
+	}
+
+	// The settings only change once syncJob has accepted them
+	select {
+	case tree.syncUpdate <- s:
+	case <-tree.stop:
+		return ErrClosed
+	}
+	tree.lock.Lock()
+	tree.walSync = s
+	tree.lock.Unlock()
+	return nil
+}
+
+// applyGroup applies a group of writes in order and then, if requested,
+// syncs the Wal before any of the writers are released. If the sync fails
+// every write in the group returns the error, although the writes are
+// already visible in the memtable.
+func (tree *LsmTree) applyGroup(group []*writeRequest, syncAll bool) {
+	sync := false
+	for _, req := range group {
+		tree.applyBatch(req)
+		if req.err == nil && (req.sync || (syncAll && req.batch.Len() > 0)) {
+			sync = true
+		}
+	}
+
+	if sync {
+		if err := tree.wal.Sync(); err != nil {
+			for _, req := range group {
+				if req.err == nil {
+					req.err = err
+				}
+			}
+		}
+	}
+
+	for _, req := range group {
+		close(req.done)
+	}
+}
+
+// syncWal commits all writes logged so far to stable storage. The sync is
+// made from walJob since that is the only place the Wal is written.
+func (tree *LsmTree) syncWal() error {
+	tree.closeLock.RLock()
+	defer tree.closeLock.RUnlock()
+	if tree.isClosed() {
+		return ErrClosed
+	}
+
+	req := writeRequest{batch: &WriteBatch{}, sync: true, done: make(chan struct{})}
+	tree.walChan <- &req
+	<-req.done
+	return req.err
+}
+
+// syncJob periodically syncs the Wal when the sync mode is SyncInterval.
+func (tree *LsmTree) syncJob() {
+	defer tree.wg.Done()
+
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-tree.stop:
+			return
+		case s := <-tree.syncUpdate:
+			if ticker != nil {
+				ticker.Stop()
+				ticker, tick = nil, nil
+			}
+			if s.Mode == SyncInterval {
+				ticker = time.NewTicker(s.Interval)
+				tick = ticker.C
+			}
+		case <-tick:
+			if err := tree.syncWal(); err != nil && err != ErrClosed {
+				tree.backgroundError("sync", err)
+			}
+		}
+	}
+}
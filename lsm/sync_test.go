@@ -0,0 +1,85 @@
+package lsm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test concurrent writers when each write is synced before it returns
+func TestSyncAlways(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tbl = newTree(t, dir, 1000)
+	if err := tbl.SetWalSync(WalSyncSettings{Mode: SyncAlways}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				k := fmt.Sprintf("%d-%d", w, i)
+				if err := tbl.Set(k, []byte(k)); err != nil {
+					t.Error("Unexpected error", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	tbl.Close()
+
+	tbl = newTree(t, dir, 1000)
+	defer tbl.Close()
+	for w := 0; w < 8; w++ {
+		for i := 0; i < 50; i++ {
+			k := fmt.Sprintf("%d-%d", w, i)
+			if val, err := tbl.Get(k); err != nil || string(val) != k {
+				t.Error("Unexpected value", string(val), err, "for key", k)
+			}
+		}
+	}
+}
+
+func TestSyncInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tbl = newTree(t, dir, 25)
+	if err := tbl.SetWalSync(WalSyncSettings{Mode: SyncInterval, Interval: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		tbl.Set(fmt.Sprint(i), []byte("value"))
+		time.Sleep(time.Millisecond)
+	}
+
+	// Sync may be switched off again
+	if err := tbl.SetWalSync(WalSyncSettings{Mode: SyncNone}); err != nil {
+		t.Fatal(err)
+	}
+	tbl.Close()
+	if err := tbl.SetWalSync(WalSyncSettings{Mode: SyncAlways}); err != ErrClosed {
+		t.Error("Expected ErrClosed but received", err)
+	}
+
+	tbl = newTree(t, dir, 25)
+	defer tbl.Close()
+	for i := 0; i < 10; i++ {
+		if _, err := tbl.Get(fmt.Sprint(i)); err != nil {
+			t.Error("Unexpected error", err, "for key", i)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package lsm
+
+import (
+	"errors"
+	"github.com/justinethier/keyva/lsm/sst"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-ttl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tree := newTree(t, dir, 100)
+	tree.Set("b", []byte("old"))
+	tree.SetWithTTL("a", []byte("1"), time.Hour)
+	tree.SetWithTTL("b", []byte("2"), 200*time.Millisecond)
+	tree.Set("c", []byte("3"))
+	tree.Close()
+
+	// Expiry times are recovered from the Wal, then written to an SST file
+	tree = newTree(t, dir, 100)
+	defer func() { tree.Close() }()
+	if val, err := tree.Get("b"); err != nil || string(val) != "2" {
+		t.Error("Unexpected value", string(val), err)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	check := func() {
+		// An expired key does not reveal its older value
+		if _, err := tree.Get("b"); !errors.Is(err, ErrNotFound) {
+			t.Error("Expected key to have expired", err)
+		}
+		if val, err := tree.Get("a"); err != nil || string(val) != "1" {
+			t.Error("Unexpected value", string(val), err)
+		}
+		it, err := tree.NewIterator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+		var keys []string
+		for it.First(); it.Valid(); it.Next() {
+			keys = append(keys, it.Key())
+		}
+		for it.Last(); it.Valid(); it.Prev() {
+			keys = append(keys, it.Key())
+		}
+		if strings.Join(keys, "") != "acca" {
+			t.Error("Unexpected keys", keys)
+		}
+	}
+	check()
+
+	// Merging into the bottom level removes the expired key from disk
+	if err := tree.Merge(0); err != nil {
+		t.Fatal(err)
+	}
+	for l := range tree.levels() {
+		for _, f := range tree.levels()[l].Files {
+			entries, _, err := sst.Load(sst.PathForLevel(dir, l) + "/" + f.Filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if e.Key == "b" {
+					t.Error("Unexpected entry in level", l, e)
+				}
+			}
+		}
+	}
+	check()
+}
+
+func TestTTLHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-ttl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tree := newTree(t, dir, 100)
+	defer tree.Close()
+	for ttl, code := range map[string]int{"1h": http.StatusOK, "60": http.StatusOK, "-1s": http.StatusBadRequest, "soon": http.StatusBadRequest} {
+		req := httptest.NewRequest("PUT", "/key", strings.NewReader("value"))
+		req.Header.Set(TTLHeader, ttl)
+		w := httptest.NewRecorder()
+		tree.ServeHTTP(w, req)
+		if w.Code != code {
+			t.Error("Unexpected status", w.Code, "for TTL", ttl)
+		}
+	}
+	e, ok, err := tree.getEntry("/key", maxSeq, ReadOptions{})
+	if err != nil || !ok || e.Expires <= time.Now().Add(59*time.Second).UnixNano() {
+		t.Error("Expected key to expire in a minute or more", e, err)
+	}
+}
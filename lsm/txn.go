@@ -0,0 +1,96 @@
+package lsm
+
+import (
+	"github.com/justinethier/keyva/lsm/sst"
+)
+
+// Txn is an optimistic transaction that reads and writes multiple keys.
+//
+// Reads see the tree as of the time the transaction began, along with any
+// writes made by the transaction itself. Writes are buffered in memory
+// until Commit, which applies all of them atomically. If any key read by the
+// transaction was changed after it began, Commit fails with ErrConflict and
+// none of the writes are applied. The caller may then retry the transaction.
+type Txn struct {
+	tree   *LsmTree
+	snap   *Snapshot
+	batch  WriteBatch
+	writes map[string]sst.SstEntry // Latest buffered write for each key
+	reads  map[string]struct{}
+	done   bool
+}
+
+// Begin starts a new transaction.
+func (tree *LsmTree) Begin() (*Txn, error) {
+	snap, err := tree.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &Txn{
+		tree:   tree,
+		snap:   snap,
+		writes: make(map[string]sst.SstEntry),
+		reads:  make(map[string]struct{}),
+	}, nil
+}
+
+// Get looks up the given key and returns the corresponding value as a byte
+// array. ErrNotFound is returned if the key does not exist.
+func (txn *Txn) Get(k string) ([]byte, error) {
+	if e, ok := txn.writes[k]; ok {
+		if e.Deleted {
+			return nil, ErrNotFound
+		}
+		return e.Value, nil
+	}
+
+	txn.reads[k] = struct{}{}
+	return txn.snap.Get(k)
+}
+
+// Set will add (or update) an entry with the corresponding key/value when
+// the transaction is committed.
+func (txn *Txn) Set(k string, value []byte) {
+	txn.batch.Put(k, value)
+	txn.writes[k] = sst.SstEntry{Key: k, Value: value}
+}
+
+// Delete will remove the corresponding key when the transaction is committed.
+func (txn *Txn) Delete(k string) {
+	txn.batch.Delete(k)
+	txn.writes[k] = sst.SstEntry{Key: k, Deleted: true}
+}
+
+// Commit atomically applies all of the writes made by the transaction.
+// ErrConflict is returned if any key read by the transaction has changed
+// since the transaction began.
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	defer txn.Rollback()
+
+	seq := txn.snap.seq
+	return txn.tree.write(&txn.batch, func(b *WriteBatch) error {
+		// Called from walJob so no other writes can happen until the
+		// batch is applied
+		for k := range txn.reads {
+			e, found, err := txn.tree.getEntry(k, maxSeq, ReadOptions{})
+			if err != nil {
+				return err
+			} else if found && e.Seq > seq {
+				return ErrConflict
+			}
+		}
+		return nil
+	})
+}
+
+// Rollback discards the transaction without applying any of its writes.
+func (txn *Txn) Rollback() {
+	if txn.done {
+		return
+	}
+	txn.done = true
+	txn.snap.Release()
+}
@@ -0,0 +1,94 @@
+package lsm
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTxn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyva-txn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tbl = newTree(t, dir, 25)
+	defer tbl.Close()
+	tbl.Set("apples", []byte("10"))
+	tbl.Set("pears", []byte("5"))
+
+	// Transaction reads its own writes but nothing is visible until commit
+	txn, err := tbl.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := txn.Get("apples"); err != nil || string(val) != "10" {
+		t.Error("Unexpected value", string(val), "for key apples")
+	}
+	txn.Set("apples", []byte("9"))
+	txn.Delete("pears")
+	if val, _ := txn.Get("apples"); string(val) != "9" {
+		t.Error("Transaction did not read its own write", string(val))
+	}
+	if _, err := txn.Get("pears"); err != ErrNotFound {
+		t.Error("Transaction found its own deleted key")
+	}
+	if val, _ := tbl.Get("apples"); string(val) != "10" {
+		t.Error("Uncommitted write is visible", string(val))
+	}
+
+	if err := txn.Commit(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if val, _ := tbl.Get("apples"); string(val) != "9" {
+		t.Error("Committed write is not visible", string(val))
+	}
+	if _, err := tbl.Get("pears"); err != ErrNotFound {
+		t.Error("Committed delete is not visible")
+	}
+	if err := txn.Commit(); err != ErrTxnDone {
+		t.Error("Expected ErrTxnDone but received", err)
+	}
+
+	// Conflicting write made after the transaction began
+	txn, err = tbl.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn.Get("apples")
+	txn.Set("apples", []byte("8"))
+	txn.Set("oranges", []byte("1"))
+	tbl.Set("apples", []byte("20"))
+	if err := txn.Commit(); err != ErrConflict {
+		t.Error("Expected ErrConflict but received", err)
+	}
+	if val, _ := tbl.Get("apples"); string(val) != "20" {
+		t.Error("Unexpected value after conflict", string(val))
+	}
+	if _, err := tbl.Get("oranges"); err != ErrNotFound {
+		t.Error("Write from a conflicting transaction was applied")
+	}
+
+	// Writes to keys that were not read do not conflict
+	txn, err = tbl.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn.Set("apples", []byte("7"))
+	tbl.Set("apples", []byte("30"))
+	if err := txn.Commit(); err != nil {
+		t.Error("Unexpected error", err)
+	}
+
+	// Rollback discards writes
+	txn, err = tbl.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn.Set("bananas", []byte("3"))
+	txn.Rollback()
+	if _, err := tbl.Get("bananas"); err != ErrNotFound {
+		t.Error("Write from a rolled back transaction was applied")
+	}
+}
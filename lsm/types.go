@@ -1,8 +1,8 @@
 package lsm
 
 import (
-	"github.com/huandu/skiplist"
 	"github.com/justinethier/keyva/bloom"
+	"github.com/justinethier/keyva/lsm/logger"
 	"github.com/justinethier/keyva/lsm/sst"
 	"github.com/justinethier/keyva/lsm/wal"
 	"sync"
@@ -13,23 +13,113 @@ type LsmTree struct {
 	path string
 	wg   sync.WaitGroup
 	lock sync.RWMutex
+	// Set to 1 once the tree is closed. closeLock is held for reading by
+	// writers so Close can wait for writes in progress to finish.
+	closed       int32
+	closeLock    sync.RWMutex
+	stop         chan struct{} // Closed to stop the merge and sync jobs
+	flushOnClose bool
 	// MemTable used as initial in-memory store of new data
-	memtbl     *skiplist.SkipList
-	bufferSize int
-	filter     *bloom.Filter
+	memtbl *memtable
+	// The memtable is full once it holds bufferSize entries, if set, or uses
+	// memtableSize bytes of memory
+	bufferSize   int
+	memtableSize int
+	filter       *bloom.Filter
+	// Full memtables waiting to be written to SST by flushJob, oldest first.
+	// flushCond is signalled whenever this list or the flush state changes.
+	immutables    []*immutableMemtable
+	maxImmutables int
+	flushCond     *sync.Cond
+	flushing      bool
+	flushErr      error
+	stopFlush     bool
+	flushDone     chan struct{}
+	// Sequence number of the most recent write
+	seq uint64
+	// Reference counts of snapshots that are still in use, by sequence number
+	snapLock  sync.Mutex
+	snapshots map[uint64]int
 	// Write Ahead Log used to recover data not yet stored to SST
-	wal     *wal.WriteAheadLog
-	walChan chan *sst.SstEntry
-	// SST files are used for long-term storage
-	sst      []sst.SstLevel
-	merge    MergeSettings
-	cooldown int
-	// TODO: config Config
+	wal        *wal.WriteAheadLog
+	walChan    chan *writeRequest
+	walSync    WalSyncSettings
+	syncUpdate chan WalSyncSettings
+	// SST files are used for long-term storage. The current version lists
+	// the files in each level, older versions may still be in use by
+	// readers. Files removed from the tree are obsolete until no version
+	// uses them.
+	versionLock sync.Mutex
+	current     *version
+	versions    map[*version]bool
+	obsolete    []string
+	// Every change to the current version is recorded in the manifest
+	// first. Held while changing the current version.
+	manifestLock sync.Mutex
+	manifest     *manifest
+	// Held while merging SST files so only one merge runs at a time
+	compactLock sync.Mutex
+	blockCache  *sst.BlockCache
+	// Layout of new SST files, set when the tree is opened
+	table       sst.TableOptions
+	filterStats *sst.FilterStats
+	log         logger.Logger
+	listener    EventListener
+	// Counters of background work and write stalls, see Stats
+	statsLock sync.Mutex
+	stats     Stats
+	// Compressor for each level, see SetCompression
+	compressionLock sync.Mutex
+	compression     []sst.Compressor
+	merge           MergeSettings
+	// Strategy used by mergeJob when none is configured
+	leveled LeveledStrategy
+	// Number of the next SST file created in level 0
+	nextFile int64
 }
 
-type Config struct {
-	MemtblDataSize uint32
-	Merge          MergeSettings
+// SyncMode determines when writes to the Wal are committed to stable storage.
+type SyncMode int
+
+const (
+	// Leave it to the operating system to write the Wal to disk. Writes are
+	// fast but recent ones may be lost if the machine crashes.
+	SyncNone SyncMode = iota
+	// Sync the Wal periodically, so at most one interval of writes are lost.
+	SyncInterval
+	// Sync the Wal before a write returns. Writers that arrive at the same
+	// time share a single sync.
+	SyncAlways
+)
+
+// Define parameters for making writes durable
+type WalSyncSettings struct {
+	Mode SyncMode
+
+	// Amount of time between syncs when Mode is SyncInterval
+	Interval time.Duration
+}
+
+// ReadOptions control how a read accesses data on disk
+type ReadOptions struct {
+	// Do not add data blocks read from disk to the block cache
+	NoCache bool
+}
+
+// MemtableStats describes the memory used by the memtable, see
+// LsmTree.MemtableStats
+type MemtableStats struct {
+	// Entries in the memtable, including older versions of each key
+	Entries int
+
+	// Approximate bytes of memory used by the memtable, and the size at
+	// which it is flushed to an SST file
+	Size  int
+	Limit int
+
+	// Full memtables waiting to be flushed, and the bytes they use
+	Immutables    int
+	ImmutableSize int
 }
 
 // Define parameters for managing the SST levels
@@ -37,6 +127,10 @@ type MergeSettings struct {
 	// Merge immediately from main thread if this is set to true
 	Immediate bool
 
+	// Chooses which files to merge, defaults to a LeveledStrategy
+	// configured by the settings below
+	Strategy CompactionStrategy
+
 	// Maximum number of SST levels
 	MaxLevels int
 
@@ -48,10 +142,19 @@ type MergeSettings struct {
 	// that job could run some merges concurrently as long as there is no conflict. Maybe we do
 	// that later as an enhancement
 
-	// Compact if data in a level reaches this size
+	// Target size in bytes of level 1. Each level below it may hold
+	// LevelSizeMultiplier times more data than the level above. Once a level
+	// grows past its target one of its files is merged into the next level,
+	// along with the files there that overlap it. If zero, levels below
+	// level 0 are merged in full once they contain too many files.
 	DataSize uint32
 
-	// Compact if a level contains more files than this
+	// Growth in target size from one level to the next, defaults to 10
+	LevelSizeMultiplier int
+
+	// Merge level 0 if it contains more files than this. Without a DataSize,
+	// level N is merged once it contains more than (N+1) times this many
+	// files.
 	NumberOfSstFiles int
 
 	// Relocate data from level 0 after this time window (in seconds) is exceeded
@@ -0,0 +1,169 @@
+package lsm
+
+import (
+	"errors"
+	"github.com/justinethier/keyva/lsm/sst"
+	"sync/atomic"
+)
+
+// version is the set of SST files in each level of the tree at one point in
+// time. A version is never modified once it is installed; flushes and merges
+// install a new version instead. Readers hold a reference to the version
+// they are using, so they never block a merge and the files they read are
+// not removed until every reader is done with them.
+type version struct {
+	levels []sst.SstLevel
+	refs   int // Guarded by tree.versionLock
+}
+
+// errVersionChanged is returned when files being merged were removed from
+// the tree by something else, EG: ResetDB.
+var errVersionChanged = errors.New("merged files are no longer part of the tree")
+
+// version returns the current version of the tree. The caller must release
+// it with unref once done.
+func (tree *LsmTree) version() *version {
+	tree.versionLock.Lock()
+	defer tree.versionLock.Unlock()
+	tree.current.refs++
+	return tree.current
+}
+
+// unref releases a version returned by tree.version.
+func (tree *LsmTree) unref(v *version) {
+	tree.versionLock.Lock()
+	tree.release(v)
+	tree.versionLock.Unlock()
+	tree.removeObsoleteFiles()
+}
+
+// release drops a reference to v. Must be called with tree.versionLock held.
+func (tree *LsmTree) release(v *version) {
+	v.refs--
+	if v.refs == 0 {
+		delete(tree.versions, v)
+	}
+}
+
+// setCurrent installs v as the current version of the tree. Must be called
+// with tree.versionLock held.
+func (tree *LsmTree) setCurrent(v *version) {
+	v.refs++
+	tree.versions[v] = true
+	if tree.current != nil {
+		tree.release(tree.current)
+	}
+	tree.current = v
+}
+
+// applyEdit installs a new version of the tree in which the removed SST
+// files are gone and the added files are placed in level. The change is
+// recorded in the manifest before it takes effect. Readers of older versions
+// are not affected, and the removed files are deleted from disk once no
+// version uses them.
+func (tree *LsmTree) applyEdit(level int, added []sst.SstFile, removed []levelFile) error {
+	tree.manifestLock.Lock()
+	defer tree.manifestLock.Unlock()
+
+	// Only edits change the current version, so it cannot change while the
+	// lock is held
+	tree.versionLock.Lock()
+	cur := tree.current
+	tree.versionLock.Unlock()
+
+	n := len(cur.levels)
+	if level >= n {
+		n = level + 1
+	}
+	isRemoved := make(map[levelFile]bool)
+	for _, f := range removed {
+		isRemoved[f] = true
+	}
+	found := 0
+	levels := make([]sst.SstLevel, n)
+	for l := range cur.levels {
+		for _, f := range cur.levels[l].Files {
+			if isRemoved[levelFile{l, f.Filename}] {
+				found++
+			} else {
+				levels[l].Files = append(levels[l].Files, f)
+			}
+		}
+	}
+	if found != len(isRemoved) {
+		return errVersionChanged
+	}
+	levels[level].Files = append(levels[level].Files, added...)
+	sortLevel(level, levels[level].Files)
+
+	e := manifestEdit{nextFile: atomic.LoadInt64(&tree.nextFile), removed: removed}
+	for _, f := range added {
+		e.added = append(e.added, levelFile{level, f.Filename})
+	}
+	if err := tree.manifest.append(&e); err != nil {
+		return err
+	}
+
+	tree.versionLock.Lock()
+	tree.setCurrent(&version{levels: levels})
+	for _, f := range removed {
+		tree.obsolete = append(tree.obsolete, sst.PathForLevel(tree.path, f.level)+"/"+f.filename)
+	}
+	tree.versionLock.Unlock()
+
+	tree.removeObsoleteFiles()
+	return nil
+}
+
+// resetVersion removes every SST file from the tree and starts a new
+// manifest. Used by ResetDB, which removes the files from disk itself.
+func (tree *LsmTree) resetVersion() error {
+	tree.manifestLock.Lock()
+	defer tree.manifestLock.Unlock()
+
+	m, err := createManifest(tree.path, tree.manifest.num+1, nil, atomic.LoadInt64(&tree.nextFile), tree.log)
+	if err != nil {
+		return err
+	}
+	tree.manifest.close()
+	tree.manifest = m
+
+	tree.versionLock.Lock()
+	tree.setCurrent(&version{levels: make([]sst.SstLevel, 1)})
+	tree.obsolete = nil
+	tree.versionLock.Unlock()
+	return nil
+}
+
+// removeObsoleteFiles deletes files that have been removed from the tree
+// once no version uses them any longer.
+func (tree *LsmTree) removeObsoleteFiles() {
+	tree.versionLock.Lock()
+	if len(tree.obsolete) == 0 {
+		tree.versionLock.Unlock()
+		return
+	}
+	inUse := make(map[string]bool)
+	for v := range tree.versions {
+		for l := range v.levels {
+			lPath := sst.PathForLevel(tree.path, l)
+			for _, f := range v.levels[l].Files {
+				inUse[lPath+"/"+f.Filename] = true
+			}
+		}
+	}
+	var remove, keep []string
+	for _, filename := range tree.obsolete {
+		if inUse[filename] {
+			keep = append(keep, filename)
+		} else {
+			remove = append(remove, filename)
+		}
+	}
+	tree.obsolete = keep
+	tree.versionLock.Unlock()
+
+	for _, filename := range remove {
+		tree.removeTableFile(filename)
+	}
+}
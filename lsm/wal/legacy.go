@@ -0,0 +1,67 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/justinethier/keyva/lsm/logger"
+	"github.com/justinethier/keyva/util"
+	"io"
+	"os"
+)
+
+// Log files were originally written as JSON, one record per line. These
+// files are still read on startup so existing data is not lost, but new
+// records are always written in the binary format.
+
+// legacyRecord is a single line of a JSON log. A line contains either one
+// entry or a batch of entries that must be applied together.
+type legacyRecord struct {
+	Entry
+	Batch []Entry
+}
+
+// loadJSON reads all entries from a JSON log file, returning them along
+// with the sequence number of the last entry.
+func loadJSON(filename string, l logger.Logger) ([]Entry, uint64, error) {
+	var buf []Entry
+	fp, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return buf, 0, nil // Empty log
+	} else if err != nil {
+		return buf, 0, err
+	}
+	defer fp.Close()
+
+	var i uint64 = 0
+	var offset int64 = 0
+	r := bufio.NewReader(fp)
+	str, e := util.Readln(r)
+	for e == nil {
+		var data legacyRecord
+		err = json.Unmarshal([]byte(str), &data)
+		if err != nil {
+			// A partially written record means we crashed while writing it,
+			// so it was never applied
+			l.Warn("ignoring incomplete wal record", "file", filename, "error", err)
+			err = os.Truncate(filename, offset)
+			if err != nil {
+				return buf, i, err
+			}
+			break
+		}
+		offset += int64(len(str)) + 1
+		if data.Batch != nil {
+			buf = append(buf, data.Batch...)
+			i = data.Batch[len(data.Batch)-1].Id
+		} else {
+			buf = append(buf, data.Entry)
+			i = data.Id
+		}
+		str, e = util.Readln(r)
+	}
+	if e != nil && e != io.EOF {
+		return buf, i, e
+	}
+
+	return buf, i, nil
+}
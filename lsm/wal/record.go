@@ -0,0 +1,235 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/justinethier/keyva/lsm/logger"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Log files are written in a binary format. Each file begins with a header:
+//
+//   magic   [8]byte   "KEYVAWAL"
+//   version uint32
+//
+// Followed by any number of records:
+//
+//   checksum uint32   CRC-32C of the length and payload
+//   length   uint32   Size of the payload in bytes
+//   payload  []byte
+//
+// The payload of a record is a batch of entries that are applied together:
+//
+//   count uint32
+//   and for each entry:
+//     id      uint64
+//     time    int64
+//     expires int64    Not present in formatNoExpiry files
+//     deleted uint8
+//     key     uvarint length, followed by the key
+//     value   uvarint length, followed by the value
+//
+// All integers are little endian. A record that is cut short or fails its
+// checksum marks the end of the log, as it was never completely written.
+
+var fileMagic = [8]byte{'K', 'E', 'Y', 'V', 'A', 'W', 'A', 'L'}
+
+const (
+	// formatNoExpiry files were written before entries had an expiry time
+	formatNoExpiry   uint32 = 1
+	formatVersion    uint32 = 2
+	fileHeaderSize          = 12
+	recordHeaderSize        = 8
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorrupt is returned when a log file cannot be read because it is not
+// a log file or was written in an unsupported format.
+var ErrCorrupt = errors.New("wal: corrupt log file")
+
+// fileHeader returns the header written to the start of each log file.
+func fileHeader() []byte {
+	buf := make([]byte, fileHeaderSize)
+	copy(buf, fileMagic[:])
+	binary.LittleEndian.PutUint32(buf[8:], formatVersion)
+	return buf
+}
+
+// encodeRecord encodes a batch of entries as a single record.
+func encodeRecord(entries []Entry) []byte {
+	buf := make([]byte, recordHeaderSize+4, 128)
+	binary.LittleEndian.PutUint32(buf[recordHeaderSize:], uint32(len(entries)))
+
+	var tmp [binary.MaxVarintLen64]byte
+	for _, e := range entries {
+		binary.LittleEndian.PutUint64(tmp[:], e.Id)
+		buf = append(buf, tmp[:8]...)
+		binary.LittleEndian.PutUint64(tmp[:], uint64(e.Time))
+		buf = append(buf, tmp[:8]...)
+		binary.LittleEndian.PutUint64(tmp[:], uint64(e.Expires))
+		buf = append(buf, tmp[:8]...)
+		if e.Deleted {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+		n := binary.PutUvarint(tmp[:], uint64(len(e.Key)))
+		buf = append(buf, tmp[:n]...)
+		buf = append(buf, e.Key...)
+		n = binary.PutUvarint(tmp[:], uint64(len(e.Value)))
+		buf = append(buf, tmp[:n]...)
+		buf = append(buf, e.Value...)
+	}
+
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(buf)-recordHeaderSize))
+	binary.LittleEndian.PutUint32(buf[0:], crc32.Checksum(buf[4:], crcTable))
+	return buf
+}
+
+// decodeRecord decodes the entries from the payload of a record in a file
+// of the given version.
+func decodeRecord(payload []byte, version uint32) ([]Entry, error) {
+	if len(payload) < 4 {
+		return nil, ErrCorrupt
+	}
+	// Size of the fixed length fields of an entry
+	fixed := 25
+	if version == formatNoExpiry {
+		fixed = 17
+	}
+	count := binary.LittleEndian.Uint32(payload)
+	payload = payload[4:]
+	// Each entry also has two lengths of at least one byte
+	if count == 0 || uint64(count)*uint64(fixed+2) > uint64(len(payload)) {
+		return nil, ErrCorrupt
+	}
+
+	entries := make([]Entry, count)
+	for i := range entries {
+		if len(payload) < fixed {
+			return nil, ErrCorrupt
+		}
+		e := &entries[i]
+		e.Id = binary.LittleEndian.Uint64(payload)
+		e.Time = int64(binary.LittleEndian.Uint64(payload[8:]))
+		if version != formatNoExpiry {
+			e.Expires = int64(binary.LittleEndian.Uint64(payload[16:]))
+		}
+		e.Deleted = payload[fixed-1] != 0
+		payload = payload[fixed:]
+
+		key, rest, err := readBytes(payload)
+		if err != nil {
+			return nil, err
+		}
+		e.Key = string(key)
+		e.Value, payload, err = readBytes(rest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(payload) != 0 {
+		return nil, ErrCorrupt
+	}
+	return entries, nil
+}
+
+// readBytes reads a length prefixed byte string from buf and returns it
+// along with the remainder of buf.
+func readBytes(buf []byte) ([]byte, []byte, error) {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 || length > uint64(len(buf)-n) {
+		return nil, nil, ErrCorrupt
+	}
+	end := n + int(length)
+	b := make([]byte, length)
+	copy(b, buf[n:end])
+	return b, buf[end:], nil
+}
+
+// loadBinary reads all entries from a binary log file, returning them along
+// with the sequence number of the last entry. Anything following the last
+// complete record is removed from the file, so new records are not written
+// after a torn or corrupt one.
+func loadBinary(filename string, l logger.Logger) ([]Entry, uint64, error) {
+	var buf []Entry
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return buf, 0, nil // Empty log
+	} else if err != nil {
+		return buf, 0, err
+	}
+
+	header := fileHeader()
+	if len(data) < fileHeaderSize {
+		if !bytes.HasPrefix(header, data) {
+			return buf, 0, fmt.Errorf("%w: %s has an invalid header", ErrCorrupt, filename)
+		}
+		// Crashed while creating the file, the header is written again on open
+		return buf, 0, os.Truncate(filename, 0)
+	}
+	if !bytes.Equal(data[:8], header[:8]) {
+		return buf, 0, fmt.Errorf("%w: %s is not a log file", ErrCorrupt, filename)
+	}
+	version := binary.LittleEndian.Uint32(data[8:])
+	if version != formatVersion && version != formatNoExpiry {
+		return buf, 0, fmt.Errorf("%w: %s has unsupported version %d", ErrCorrupt, filename, version)
+	}
+
+	var id uint64
+	offset := fileHeaderSize
+	for offset < len(data) {
+		entries, n := nextRecord(data[offset:], version)
+		if n == 0 {
+			l.Warn("ignoring corrupt wal record", "file", filename, "offset", offset)
+			return buf, id, os.Truncate(filename, int64(offset))
+		}
+		buf = append(buf, entries...)
+		id = entries[len(entries)-1].Id
+		offset += n
+	}
+	return buf, id, nil
+}
+
+// isCurrentFormat returns false if filename is a log file written in an
+// older format, which new records must not be appended to.
+func isCurrentFormat(filename string) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+	header := make([]byte, fileHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return true // Header is written again on open
+	}
+	return binary.LittleEndian.Uint32(header[8:]) == formatVersion
+}
+
+// nextRecord decodes the record at the start of data. It returns the
+// entries and the size of the record, or a size of zero if the record is
+// incomplete or corrupt.
+func nextRecord(data []byte, version uint32) ([]Entry, int) {
+	if len(data) < recordHeaderSize {
+		return nil, 0
+	}
+	length := binary.LittleEndian.Uint32(data[4:])
+	if uint64(length) > uint64(len(data)-recordHeaderSize) {
+		return nil, 0
+	}
+	end := recordHeaderSize + int(length)
+	if crc32.Checksum(data[4:end], crcTable) != binary.LittleEndian.Uint32(data) {
+		return nil, 0
+	}
+	entries, err := decodeRecord(data[recordHeaderSize:end], version)
+	if err != nil {
+		return nil, 0
+	}
+	return entries, end
+}
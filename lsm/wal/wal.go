@@ -1,15 +1,14 @@
 package wal
 
 import (
-	"bufio"
-	"encoding/json"
 	"fmt"
-	"github.com/justinethier/keyva/util"
-	"log"
+	"github.com/justinethier/keyva/lsm/logger"
 	"os"
 	//"sync"
 	"io/ioutil"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -33,9 +32,12 @@ import (
 
 // TODO: no thread safety, for now we rely on the caller to hold the proper locks
 type WriteAheadLog struct {
-	nextId uint64
-	path   string
-	file   *os.File
+	nextId   uint64
+	path     string
+	file     *os.File
+	filename string // Name of the current log file
+	size     int64  // Bytes of complete records in the current log file
+	log      logger.Logger
 }
 
 type Entry struct {
@@ -44,27 +46,54 @@ type Entry struct {
 	Value   []byte
 	Deleted bool
 	Time    int64
+	Expires int64 // Unix time in nanoseconds the entry expires, zero if never
 }
 
 // New creates a new instance of WriteAheadLog. It also checks to
 // see if there are entries on disk from the current log, and if so
 // it returns them so those entries can be loaded into memory.
-func New(path string) (*WriteAheadLog, []Entry) {
-	wal := WriteAheadLog{0, path, nil}
+func New(path string) (*WriteAheadLog, []Entry, error) {
+	return NewWithLogger(path, logger.Default())
+}
+
+// NewWithLogger is the same as New but reports problems found with the log
+// files, such as a corrupt record, to l.
+func NewWithLogger(path string, l logger.Logger) (*WriteAheadLog, []Entry, error) {
+	wal := WriteAheadLog{path: path, log: l}
 
 	// Create data directory if it does not exist
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		err := os.Mkdir(path, 0755)
 		if err != nil {
-			log.Fatal(err)
+			return nil, nil, err
 		}
 	}
 
-	entries := wal.entries()
+	entries, err := wal.entries()
+	if err != nil {
+		return nil, nil, err
+	}
 
-	// Append to existing log
-	wal.openLog(wal.currentFilename())
-	return &wal, entries
+	// Append to existing log. A legacy JSON log, or one in an older
+	// format, is left as it is and new entries are written to the next log
+	// file instead.
+	filenames, err := wal.getFilenames()
+	if err != nil {
+		return nil, nil, err
+	}
+	id := 0
+	if len(filenames) > 0 {
+		latest := filenames[len(filenames)-1]
+		id = fileId(latest)
+		if filepath.Ext(latest) == ".json" || !isCurrentFormat(path+"/"+latest) {
+			id++
+		}
+	}
+	err = wal.openLog(id2Filename(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &wal, entries, nil
 }
 
 // TODO: this is broken because SST might have a capacity of, say, 50 but that could correspond to thousands of wal records if there are updates, deletes, etc.
@@ -74,15 +103,38 @@ func New(path string) (*WriteAheadLog, []Entry) {
 // at all. otherwise it is much more likely we would append from existing log. and if we append on a full log that is fine, because we will make everything robust enough
 //  to still work in that case.
 
-// Next closes the current log on disk and opens the next one for writing.
-func (wal *WriteAheadLog) Next() {
-	current := wal.currentFilename()
-	next := wal.nextFilename()
-	wal.openLog(next)
-	// Clean up old file, assumes old one no longer needed (EG: flushed to SST)
-	if current != next {
-		os.Remove(wal.path + "/" + current)
+// Rotate closes the current log on disk and opens the next one for writing.
+// The name of the previous log is returned. It is kept on disk until its
+// entries are stored elsewhere and it is removed by Retire.
+func (wal *WriteAheadLog) Rotate() (string, error) {
+	current := wal.filename
+	err := wal.Sync()
+	if err != nil {
+		return "", err
 	}
+	return current, wal.openLog(id2Filename(fileId(current) + 1))
+}
+
+// Retire removes the given log file from disk along with any older log
+// files. It must only be called once all of their entries are safely
+// stored elsewhere (EG: flushed to SST). Retire does not modify the current
+// log, so it is safe to call while entries are being appended.
+func (wal *WriteAheadLog) Retire(filename string) error {
+	filenames, err := wal.getFilenames()
+	if err != nil {
+		return err
+	}
+	id := fileId(filename)
+	for _, f := range filenames {
+		if fileId(f) > id {
+			break
+		}
+		err = os.Remove(wal.path + "/" + f)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
 }
 
 func (wal *WriteAheadLog) Sequence() uint64 {
@@ -91,158 +143,214 @@ func (wal *WriteAheadLog) Sequence() uint64 {
 
 func (wal *WriteAheadLog) SetSequence(seq uint64) {
 	wal.nextId = seq
-	log.Println("Updated WAL sequence to", wal.nextId)
+	wal.log.Debug("updated wal sequence", "seq", seq)
+}
+
+// Size returns the total size in bytes of the log files on disk. It may be
+// called while entries are being appended.
+func (wal *WriteAheadLog) Size() (int64, error) {
+	filenames, err := wal.getFilenames()
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, filename := range filenames {
+		fi, err := os.Stat(wal.path + "/" + filename)
+		if err == nil {
+			size += fi.Size()
+		} else if !os.IsNotExist(err) { // May have just been retired
+			return 0, err
+		}
+	}
+	return size, nil
 }
 
 // Reset deletes all wal files from disk
-func (wal *WriteAheadLog) Reset() {
+func (wal *WriteAheadLog) Reset() error {
 	// tree.lock.Lock()
 	// defer tree.lock.Unlock()
 
-	filenames := wal.getFilenames()
+	filenames, err := wal.getFilenames()
+	if err != nil {
+		return err
+	}
 	for _, filename := range filenames {
-		os.Remove(filename) // ... and remove from disk
+		err = os.Remove(wal.path + "/" + filename) // ... and remove from disk
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
+
+	// Start over with a new log
+	return wal.openLog(id2Filename(0))
 }
 
-// openLog opens the given file as the current write-ahead-log
-func (wal *WriteAheadLog) openLog(filename string) {
+// openLog opens the given file as the current write-ahead-log, writing the
+// file header if the file is new.
+func (wal *WriteAheadLog) openLog(filename string) error {
 	wal.Close()
 
 	f, err := os.OpenFile(wal.path+"/"+filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	size := fi.Size()
+	if size == 0 {
+		_, err = f.Write(fileHeader())
+		if err != nil {
+			f.Close()
+			return err
+		}
+		size = fileHeaderSize
 	}
 	wal.file = f
+	wal.filename = filename
+	wal.size = size
+	return nil
 }
 
-// Entries retrives all entries from the most recent write ahead log file.
-// It is presumed older entries are already written to an SST file.
-func (wal *WriteAheadLog) entries() []Entry {
-	filename := wal.currentFilename()
-	entries, id := load(wal.path + "/" + filename)
-	wal.nextId = id
-	return entries
+// Entries retrives all entries from the write ahead log files on disk, oldest
+// first. Some of these entries may already be written to an SST file if we
+// stopped before the log file was retired.
+func (wal *WriteAheadLog) entries() ([]Entry, error) {
+	filenames, err := wal.getFilenames()
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for _, filename := range filenames {
+		buf, id, err := load(wal.path+"/"+filename, wal.log)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, buf...)
+		if id > wal.nextId {
+			wal.nextId = id
+		}
+	}
+	return entries, nil
 }
 
-func (wal *WriteAheadLog) Append(key string, value []byte, deleted bool) uint64 {
+// Append adds a new entry to the log and returns the sequence number
+// assigned to that entry.
+func (wal *WriteAheadLog) Append(key string, value []byte, deleted bool) (uint64, error) {
 	//wal.lock.Lock()
 	//defer wal.lock.Unlock()
 
-	wal.nextId++
-	id := wal.nextId
-	e := Entry{id, key, value, deleted, time.Now().Unix()}
-	b, err := json.Marshal(e)
+	id := wal.nextId + 1
+	err := wal.AppendEntry(Entry{Id: id, Key: key, Value: value, Deleted: deleted})
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
-	_, err = wal.file.Write(b)
-	if err != nil {
-		panic(err) // TODO: probably don't want to do this... ???
-	}
-
-	_, err = wal.file.Write([]byte("\n"))
-	if err != nil {
-		panic(err)
-	}
-
-	return id
+	return id, nil
 }
 
-func (wal *WriteAheadLog) Sync() {
-	// Ensure data is written to file system (performance issue?)
-	err := wal.file.Sync()
-	if err != nil {
-		panic(err)
+// AppendEntry adds an entry to the log that has already been assigned a
+// sequence number by the caller. Sequence numbers must always increase.
+func (wal *WriteAheadLog) AppendEntry(e Entry) error {
+	if e.Time == 0 {
+		e.Time = time.Now().Unix()
 	}
+	return wal.write([]Entry{e})
 }
 
-//
-func load(filename string) ([]Entry, uint64) {
-	var buf []Entry
-	fp, err := os.Open(filename)
-	if os.IsNotExist(err) {
-		return buf, 0 // Empty log
-	} else if err != nil {
-		panic(err)
+// AppendBatch adds a batch of entries to the log as a single record, so
+// on recovery either all of the entries are loaded or none of them are.
+// Entries must already be assigned sequence numbers by the caller.
+func (wal *WriteAheadLog) AppendBatch(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
 	}
-	defer fp.Close()
 
-	var i uint64 = 0
-	r := bufio.NewReader(fp)
-	str, e := util.Readln(r)
-	for e == nil {
-		var data Entry
-		err = json.Unmarshal([]byte(str), &data)
-		i = data.Id
-		//fmt.Println(data)
-		buf = append(buf, data)
-		str, e = util.Readln(r)
+	now := time.Now().Unix()
+	for i := range entries {
+		if entries[i].Time == 0 {
+			entries[i].Time = now
+		}
 	}
-
-	return buf, i
+	return wal.write(entries)
 }
 
-func (wal *WriteAheadLog) Close() {
-	if wal.file != nil {
-		wal.file.Close()
+// write appends entries to the log as a single record. If the record cannot
+// be written in full the log is truncated back to the end of the previous
+// record, so a failed write never corrupts the records that follow it.
+func (wal *WriteAheadLog) write(entries []Entry) error {
+	n, err := wal.file.Write(encodeRecord(entries))
+	if err != nil {
+		if n > 0 {
+			wal.file.Truncate(wal.size)
+		}
+		return err
 	}
+	wal.size += int64(n)
+	wal.nextId = entries[len(entries)-1].Id
+	return nil
 }
 
-func (wal *WriteAheadLog) nextFilename() string {
-	n := wal.latestFileId()
-	return fmt.Sprintf("write-ahead-log-%04d.json", n+1)
+// Sync commits the contents of the current log to stable storage.
+func (wal *WriteAheadLog) Sync() error {
+	// Ensure data is written to file system (performance issue?)
+	return wal.file.Sync()
 }
 
-func (wal *WriteAheadLog) currentFilename() string {
-	n := wal.latestFileId()
-	if n < 0 {
-		n = 0
+// load reads all entries from the given log file, which may be in either
+// the binary format or the legacy JSON format.
+func load(filename string, l logger.Logger) ([]Entry, uint64, error) {
+	if filepath.Ext(filename) == ".json" {
+		return loadJSON(filename, l)
 	}
-	return fmt.Sprintf("write-ahead-log-%04d.json", n)
+	return loadBinary(filename, l)
 }
 
-func (wal *WriteAheadLog) id2Filename(id int) string {
-	return fmt.Sprintf("write-ahead-log-%04d.json", id)
+func (wal *WriteAheadLog) Close() error {
+	if wal.file == nil {
+		return nil
+	}
+	err := wal.file.Close()
+	wal.file = nil
+	return err
 }
 
-func (wal *WriteAheadLog) latestFileId() int {
-	files, err := ioutil.ReadDir(wal.path)
-	if err != nil {
-		log.Fatal(err)
-	}
+func id2Filename(id int) string {
+	return fmt.Sprintf("write-ahead-log-%04d.log", id)
+}
 
-	var walFiles []string
-	for _, file := range files {
-		matched, _ := regexp.Match(`^write-ahead-log-[0-9]*\.json`, []byte(file.Name()))
-		if matched && !file.IsDir() {
-			//fmt.Println(file.Name(), file.IsDir())
-			walFiles = append(walFiles, file.Name())
-		}
-	}
+// filenamePattern matches log files, including legacy JSON logs. Files are
+// numbered with at least 4 digits.
+var filenamePattern = regexp.MustCompile(`^write-ahead-log-([0-9]{4,})\.(json|log)$`)
 
-	if len(walFiles) > 0 {
-		var latest = walFiles[len(walFiles)-1][16:20]
-		n, _ := strconv.Atoi(latest)
-		return n
+// fileId returns the number of the given log file, or -1 if filename is
+// not the name of a log file.
+func fileId(filename string) int {
+	m := filenamePattern.FindStringSubmatch(filename)
+	if m == nil {
+		return -1
 	}
-
-	return -1 // No WAL yet
+	n, _ := strconv.Atoi(m[1])
+	return n
 }
 
-func (wal *WriteAheadLog) getFilenames() []string {
+// getFilenames returns the names of the log files on disk, oldest first
+func (wal *WriteAheadLog) getFilenames() ([]string, error) {
 	files, err := ioutil.ReadDir(wal.path)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	var walFiles []string
 	for _, file := range files {
-		matched, _ := regexp.Match(`^write-ahead-log-[0-9]*\.json`, []byte(file.Name()))
-		if matched && !file.IsDir() {
+		if filenamePattern.MatchString(file.Name()) && !file.IsDir() {
 			walFiles = append(walFiles, file.Name())
 		}
 	}
 
-	return walFiles
+	sort.SliceStable(walFiles, func(i, j int) bool {
+		return fileId(walFiles[i]) < fileId(walFiles[j])
+	})
+	return walFiles, nil
 }
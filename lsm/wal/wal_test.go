@@ -1,14 +1,217 @@
 package wal
 
 import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
 	"testing"
 )
 
 func TestBasic(t *testing.T) {
-	wal, _ := New("testdb")
-	wal.Append("a", []byte("a string"), false)
-	wal.Append("b", []byte("a string"), false)
-	wal.Append("c", []byte("a string"), false)
+	wal, _, err := New("testdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if _, err := wal.Append(k, []byte("a string"), false); err != nil {
+			t.Error("Unexpected error", err)
+		}
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "keyva-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func checkEntries(t *testing.T, entries []Entry, keys ...string) {
+	if len(entries) != len(keys) {
+		t.Fatal("Expected", len(keys), "entries but found", len(entries))
+	}
+	for i, k := range keys {
+		if entries[i].Key != k || entries[i].Id != uint64(i+1) {
+			t.Error("Unexpected entry", entries[i], "expected key", k)
+		}
+	}
+}
+
+// Test that entries written by a JSON log are still loaded
+func TestLegacyLog(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	data := `{"Id":1,"Key":"a","Value":"MQ==","Deleted":false,"Time":0,"Batch":null}
+{"Batch":[{"Id":2,"Key":"b","Value":"Mg==","Deleted":false,"Time":0},{"Id":3,"Key":"c","Value":null,"Deleted":true,"Time":0}]}
+`
+	err := ioutil.WriteFile(dir+"/write-ahead-log-0000.json", []byte(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, entries, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, entries, "a", "b", "c")
+	if string(entries[1].Value) != "2" || !entries[2].Deleted {
+		t.Error("Unexpected entries", entries)
+	}
+	if w.Sequence() != 3 {
+		t.Error("Unexpected sequence", w.Sequence())
+	}
+
+	// New entries are written to a binary log
+	if _, err := w.Append("d", []byte("4"), false); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if _, err := os.Stat(dir + "/write-ahead-log-0001.log"); err != nil {
+		t.Error(err)
+	}
+
+	w, entries, err = New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	checkEntries(t, entries, "a", "b", "c", "d")
+
+	// Retiring the binary log also removes the older JSON log
+	filename, err := w.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Retire(filename); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir + "/write-ahead-log-0000.json"); !os.IsNotExist(err) {
+		t.Error("Expected JSON log to be removed", err)
+	}
+}
+
+// Test that recovery stops at the first record that fails its checksum
+func TestCorruptRecord(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	w, _, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int64
+	for _, k := range []string{"a", "b", "c"} {
+		if _, err := w.Append(k, []byte("value"), false); err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, w.size)
+	}
+	w.Close()
+
+	// Flip a bit in the value of the second record
+	filename := dir + "/write-ahead-log-0000.log"
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[sizes[1]-1] ^= 1
+	if err = ioutil.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w, entries, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, entries, "a")
+	if w.Sequence() != 1 {
+		t.Error("Unexpected sequence", w.Sequence())
+	}
+
+	// The corrupt records are removed so new ones can be appended
+	if fi, err := os.Stat(filename); err != nil || fi.Size() != sizes[0] {
+		t.Error("Expected log to be truncated to", sizes[0], err)
+	}
+	if _, err := w.Append("b", []byte("new"), false); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	w, entries, err = New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	checkEntries(t, entries, "a", "b")
+}
+
+// Test that expiry times are logged, and that logs written before entries
+// had one can still be read
+func TestExpires(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// Version 1 log containing a single entry for key "a"
+	payload := []byte{1, 0, 0, 0}
+	payload = append(payload, 1, 0, 0, 0, 0, 0, 0, 0) // id
+	payload = append(payload, 0, 0, 0, 0, 0, 0, 0, 0) // time
+	payload = append(payload, 0, 1, 'a', 1, '1')
+	record := make([]byte, recordHeaderSize)
+	binary.LittleEndian.PutUint32(record[4:], uint32(len(payload)))
+	record = append(record, payload...)
+	binary.LittleEndian.PutUint32(record, crc32.Checksum(record[4:], crcTable))
+	data := append(fileHeader(), record...)
+	binary.LittleEndian.PutUint32(data[8:], formatNoExpiry)
+	err := ioutil.WriteFile(dir+"/write-ahead-log-0000.log", data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, entries, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, entries, "a")
+	if string(entries[0].Value) != "1" || entries[0].Expires != 0 {
+		t.Error("Unexpected entry", entries[0])
+	}
+
+	// New entries are written to a log in the current format
+	err = w.AppendEntry(Entry{Id: 2, Key: "b", Value: []byte("2"), Expires: 12345})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if _, err := os.Stat(dir + "/write-ahead-log-0001.log"); err != nil {
+		t.Error(err)
+	}
+
+	w, entries, err = New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	checkEntries(t, entries, "a", "b")
+	if entries[1].Expires != 12345 {
+		t.Error("Unexpected expiry time", entries[1])
+	}
+}
+
+// Test that a file that is not a log is not mistaken for one
+func TestInvalidHeader(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	err := ioutil.WriteFile(dir+"/write-ahead-log-0000.log", []byte("not a log file"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := New(dir); !errors.Is(err, ErrCorrupt) {
+		t.Error("Expected ErrCorrupt but received", err)
+	}
 }
 
 // TODO: test failover by running one test to build up a WAL then
@@ -19,3 +222,53 @@ func TestBasic(t *testing.T) {
 // }
 
 // TODO: test recovery again from a snapshot. EG: recover up to ID X
+
+// Test that log files are still found once their numbers need more than 4
+// digits
+func TestFileIdRollover(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(dir+"/"+id2Filename(9999), fileHeader(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	w, _, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if _, err := w.Append(k, []byte("value"), false); err != nil {
+			t.Fatal(err)
+		}
+		if k != "c" {
+			if _, err := w.Rotate(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if w.filename != "write-ahead-log-10001.log" {
+		t.Error("Unexpected log file", w.filename)
+	}
+	w.Close()
+
+	w, entries, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	checkEntries(t, entries, "a", "b", "c")
+	if w.filename != "write-ahead-log-10001.log" {
+		t.Error("Expected to append to the latest log but opened", w.filename)
+	}
+
+	if err := w.Retire("write-ahead-log-10000.log"); err != nil {
+		t.Fatal(err)
+	}
+	filenames, err := w.getFilenames()
+	if err != nil || len(filenames) != 1 || filenames[0] != "write-ahead-log-10001.log" {
+		t.Error("Unexpected log files", filenames, err)
+	}
+	if size, err := w.Size(); err != nil || size != w.size {
+		t.Error("Unexpected size", size, err, "expected", w.size)
+	}
+}